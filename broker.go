@@ -1,11 +1,14 @@
 package kafka
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"net"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -20,8 +23,15 @@ const (
 	StartOffsetOldest = -1
 
 	// StartOffsetNewest configures the consumer to fetch messages produced
-	// after creating the consumer.
+	// after creating the consumer. The newest offset is read with a single
+	// offset request when the consumer is created, as fetch requests have
+	// no way to ask for the end of the log; brokers answer those with
+	// proto.ErrOffsetOutOfRange.
 	StartOffsetNewest = -2
+
+	// StartFromRelative configures the consumer to fetch starting
+	// RelativeOffset messages before the newest one.
+	StartFromRelative = -3
 )
 
 var (
@@ -33,11 +43,42 @@ var (
 	// ErrNoData is returned by consumers on Fetch when the retry limit is set and exceeded.
 	ErrNoData = errors.New("no data")
 
+	// ErrAllBrokersUnreachable is returned by producers configured with
+	// FailFastOnNoBrokers when none of the cluster nodes accept connections.
+	ErrAllBrokersUnreachable = errors.New("all brokers unreachable")
+
+	// ErrKeyPartitionMismatch is returned by producers configured with
+	// AssertKeyPartitionConsistency when a message key hashes to a partition
+	// other than the one written to.
+	ErrKeyPartitionMismatch = errors.New("message key does not match partition")
+
+	// ErrNoPartitionResponse is returned by producers when the broker's
+	// response does not contain the partition written to, which can happen
+	// while partitions are reassigned. ProduceWithStats retries it like
+	// other transient errors.
+	ErrNoPartitionResponse = errors.New("no response for partition")
+
+	// ErrConsumerPaused is returned by paused consumers on Consume and
+	// ConsumeBatch unless ConsumerConf.BlockWhenPaused is set.
+	ErrConsumerPaused = errors.New("consumer paused")
+
+	// ErrNoBrokersInMetadata is returned by Cluster.RefreshMetadata when the
+	// metadata response does not list any brokers, in which case the
+	// previously known brokers are kept.
+	ErrNoBrokersInMetadata = errors.New("metadata response without brokers")
+
+	// ErrOffsetMismatch is returned by producers configured with
+	// PreserveOffsets when the broker stored the messages at an offset other
+	// than that of the first message. It is not retried, as the messages
+	// were written.
+	ErrOffsetMismatch = errors.New("produced offset does not match message offset")
+
 	// Make sure interfaces are implemented
-	_ Client            = &Broker{}
-	_ Consumer          = &consumer{}
-	_ Producer          = &producer{}
-	_ OffsetCoordinator = &offsetCoordinator{}
+	_ Client                 = &Broker{}
+	_ Consumer               = &consumer{}
+	_ Producer               = &producer{}
+	_ OffsetCoordinator      = &offsetCoordinator{}
+	_ BatchOffsetCoordinator = &offsetCoordinator{}
 )
 
 // Client is the interface implemented by Broker.
@@ -53,10 +94,61 @@ type Client interface {
 type Consumer interface {
 	// Consume reads a message from a consumer, returning an error when encountered.
 	Consume() (*proto.Message, error)
+	// ConsumeCtx works like Consume, but gives up once ctx is done,
+	// returning its error.
+	ConsumeCtx(ctx context.Context) (*proto.Message, error)
 	// SeekToLatest advances the Consumer's offset to the newest messages available, affecting
 	// future calls to Consume. Calling this method violates the ALO guarantees normally associated
 	// with Kafka consumption.
 	SeekToLatest() error
+	// TailN returns the last n messages of the partition in reverse offset
+	// order, newest first, or fewer if the partition holds less than n
+	// messages. It does not change the position of the Consumer.
+	TailN(n int) ([]*proto.Message, error)
+	// ConsumeRange returns the messages with offsets from start up to, but
+	// excluding, end, or fewer if the partition ends before. Afterwards the
+	// Consumer continues reading from end.
+	ConsumeRange(start, end int64) ([]*proto.Message, error)
+	// ConsumeTimeRange returns the messages with timestamps between from and
+	// to, inclusive. Reading starts at the earliest message not older than
+	// from and stops at the first message newer than to, from which the
+	// Consumer continues reading afterwards. It requires kafka 0.11 or newer.
+	// Only the first offset is looked up by the broker, using OffsetForTime.
+	// Fetch requests cannot be bounded by timestamps, so the messages after
+	// it are filtered by the Consumer.
+	ConsumeTimeRange(from, to time.Time) ([]*proto.Message, error)
+	// LogStartOffset returns the offset of the oldest message kept by the
+	// partition as reported by the last fetch, telling how much of the log
+	// was removed by retention. It is -1 until known, which requires fetch
+	// requests of version 5 or newer, see BrokerConf.ForceAPIVersions.
+	LogStartOffset() int64
+	// Pause stops the Consumer from fetching messages until Resume is
+	// called. Meanwhile Consume returns ErrConsumerPaused, or blocks if
+	// ConsumerConf.BlockWhenPaused is set.
+	Pause()
+	// Resume lets a paused Consumer continue reading from where it stopped.
+	Resume()
+	// StartFromCommittedPlus moves the Consumer to the offset committed for
+	// its partition by coord, plus skip, which lets it step past messages
+	// that cannot be processed.
+	StartFromCommittedPlus(coord OffsetCoordinator, skip int64) error
+	// Reassign moves the Consumer to another partition of its topic, reading
+	// from startOffset, which can also be StartOffsetNewest or
+	// StartOffsetOldest. Unlike creating a new Consumer, the partition is
+	// looked up in the cached metadata and the connections are reused.
+	Reassign(partition int32, startOffset int64) error
+	// ConsumeBytes returns the next messages whose keys and values together
+	// take at most maxBytes, buffering the rest of the fetched messages for
+	// the following calls. A single message larger than maxBytes is returned
+	// on its own, so that reading never gets stuck.
+	ConsumeBytes(maxBytes int) ([]*proto.Message, error)
+	// StreamRaw writes the messages with offsets from "from" up to, but
+	// excluding, "to" to w as the broker stored them, without decoding,
+	// and returns the number of bytes written. Whole message set entries
+	// and record batches are written, so the output can include messages
+	// outside of the range. It stops early when the partition ends before
+	// to and does not change the position of the Consumer.
+	StreamRaw(w io.Writer, from, to int64) (int64, error)
 }
 
 // BatchConsumer is the interface that wraps the ConsumeBatch method.
@@ -65,15 +157,82 @@ type Consumer interface {
 // when encountered.
 type BatchConsumer interface {
 	ConsumeBatch() ([]*proto.Message, error)
+	// Offset returns the offset of the next message that will be fetched,
+	// which can be stored to resume consuming later.
+	Offset() int64
+	// SeekToOffset moves the consumer to the given offset. StartOffsetNewest
+	// and StartOffsetOldest are accepted as well, same as for
+	// ConsumerConf.StartOffset.
+	SeekToOffset(offset int64) error
 }
 
-// Producer is the interface that wraps the Produce method.
+// Producer is the interface that wraps the Produce and Validate methods.
 //
 // Produce writes the messages to the given topic and partition.
 // It returns the offset of the first message and any error encountered.
-// The offset of each message is also updated accordingly.
+// The offset of each message is also updated accordingly, as is its timestamp
+// when the broker assigns it, see RecordMetadata.
+//
+// ProduceWithResult works like Produce, but returns the offsets of both the
+// first and the last message.
+//
+// ProduceCtx works like Produce, but gives up once ctx is done, returning
+// its error.
+//
+// ProduceRecord writes a single message like Produce does and returns where
+// and with which timestamp it was stored.
+//
+// ProduceOne works like Produce called with a single message built of the
+// given key and value, but allocates less.
+//
+// Validate checks that messages could be written to the given topic and
+// partition, without writing anything.
+//
+// InvalidateLeaderCache drops the partition leaders known for the given topic,
+// so that the next write to it refreshes metadata first.
+//
+// Close stops the producer. Writes started afterwards fail with
+// ErrProducerClosed. Writes in progress finish the attempt in flight but are
+// not retried, and Close returns once they are done.
+//
+// Producers returned by Broker are safe for concurrent use. Calls writing to
+// the same partition are sent one after another, so the messages of a single
+// call are never interleaved with those of another one.
 type Producer interface {
 	Produce(topic string, partition int32, messages ...*proto.Message) (offset int64, err error)
+	ProduceWithResult(topic string, partition int32, messages ...*proto.Message) (ProduceResult, error)
+	ProduceOne(topic string, partition int32, key, value []byte) (offset int64, err error)
+	ProduceCtx(ctx context.Context, topic string, partition int32, messages ...*proto.Message) (offset int64, err error)
+	ProduceRecord(topic string, partition int32, msg *proto.Message) (RecordMetadata, error)
+	Validate(topic string, partition int32) error
+	InvalidateLeaderCache(topic string)
+	Close() error
+}
+
+// ProduceResult tells where the messages of a single produce call were
+// written.
+type ProduceResult struct {
+	// BaseOffset is the offset of the first message, same as returned by
+	// Produce.
+	BaseOffset int64
+
+	// LastOffset is the offset of the last message. Messages written using a
+	// single request have consecutive offsets, but when they are split over
+	// several requests messages of other producers can end up in between.
+	LastOffset int64
+}
+
+// RecordMetadata tells where a single message was written.
+type RecordMetadata struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+
+	// Timestamp is the timestamp stored with the message. Brokers assign it
+	// for topics using log append time, which is only reported with produce
+	// requests of version 2 or higher, see BrokerConf.ForceAPIVersions.
+	// Otherwise it is the timestamp the message was sent with, if any.
+	Timestamp time.Time
 }
 
 // OffsetCoordinator is the interface which wraps the Commit and Offset methods.
@@ -82,6 +241,16 @@ type OffsetCoordinator interface {
 	Offset(topic string, partition int32) (offset int64, metadata string, err error)
 }
 
+// BatchOffsetCoordinator is the interface that adds the Offsets method to
+// OffsetCoordinator.
+//
+// Offsets reads the offsets committed for many partitions of a topic with a
+// single request.
+type BatchOffsetCoordinator interface {
+	OffsetCoordinator
+	Offsets(topic string, partitions []int32) (map[int32]OffsetMeta, error)
+}
+
 type topicPartition struct {
 	topic     string
 	partition int32
@@ -119,8 +288,60 @@ type BrokerConf struct {
 	// Defaults to False.
 	AllowTopicCreation bool
 
+	// TopicCreationWait bounds how long the broker waits for the partitions
+	// of a topic it just created to get a leader. The topic's metadata is
+	// refreshed with the same backoff as LeaderRetryWait in the meantime.
+	// Only used with AllowTopicCreation.
+	//
+	// Defaults to 5s.
+	TopicCreationWait time.Duration
+
 	// Configuration specific to the connections to the cluster.
 	ClusterConnectionConf ClusterConnectionConf
+
+	// ForceAPIVersions pins the version of requests sent by the broker, keyed
+	// by request kind (for example proto.FetchReqKind). A pinned version is
+	// used as is, even if the client would choose a different one, which is
+	// useful for testing against specific kafka versions. Only metadata,
+	// fetch, offset and produce requests support versions other than 0.
+	// Background metadata refreshes of the cluster are not affected.
+	//
+	// Defaults to nil, letting the client choose.
+	ForceAPIVersions map[int16]int16
+
+	// ExpectedClusterID makes NewBroker fail unless the cluster reports this
+	// ID, to guard against talking to the wrong cluster. Requires
+	// ClusterConnectionConf.MetadataVersion to be 2 or higher.
+	//
+	// Defaults to empty string, which disables the check.
+	ExpectedClusterID string
+
+	// PrefetchTopics lists topics whose metadata NewBroker requests right
+	// away, so that partition leaders and counts are known before the first
+	// produce or consume. Failing to get their metadata is not an error.
+	//
+	// Defaults to nil, which fetches no topic specifically.
+	PrefetchTopics []string
+
+	// MaxConcurrentProduces limits the number of produce requests the
+	// producers of this broker have in flight at the same time, over all
+	// topics and partitions. Further requests wait for one to finish instead
+	// of failing with NoConnectionsAvailable once the connection pool is
+	// exhausted. It should not exceed ClusterConnectionConf.ConnectionLimit.
+	//
+	// Defaults to 0, which turns this limit off.
+	MaxConcurrentProduces int
+
+	// ConnectionPool, if set, is used for the connections of the broker
+	// instead of the pool NewBroker shares between brokers of the same
+	// cluster and ClientID. This lets tests control the connections, or
+	// brokers configured differently share a pool. The pool must know the
+	// addresses of the cluster's brokers, which are not updated when they
+	// change, see ConnectionPool.InitializeAddrs. Metadata requests do not
+	// use it.
+	//
+	// Defaults to nil, which uses the shared pool.
+	ConnectionPool *ConnectionPool
 }
 
 // NewBrokerConf constructs default configuration.
@@ -128,12 +349,56 @@ func NewBrokerConf(clientID string) BrokerConf {
 	return BrokerConf{
 		ClientID:              clientID,
 		AllowTopicCreation:    false,
+		TopicCreationWait:     5 * time.Second,
 		LeaderRetryLimit:      10,
 		LeaderRetryWait:       500 * time.Millisecond,
 		ClusterConnectionConf: NewClusterConnectionConf(),
 	}
 }
 
+// Validate returns an error if the configuration cannot be used to connect
+// to a cluster, including errors of ClusterConnectionConf.
+func (conf BrokerConf) Validate() error {
+	if conf.LeaderRetryLimit <= 0 {
+		return fmt.Errorf("invalid LeaderRetryLimit %d: must be positive", conf.LeaderRetryLimit)
+	}
+	if conf.MaxConcurrentProduces < 0 {
+		return fmt.Errorf("invalid MaxConcurrentProduces %d: must not be negative", conf.MaxConcurrentProduces)
+	}
+	for kind, version := range conf.ForceAPIVersions {
+		if version < 0 {
+			return fmt.Errorf("invalid ForceAPIVersions version %d of request kind %d: must not be negative",
+				version, kind)
+		}
+	}
+	err := validateDurations(
+		durationField{"LeaderRetryWait", conf.LeaderRetryWait},
+		durationField{"TopicCreationWait", conf.TopicCreationWait},
+	)
+	if err != nil {
+		return err
+	}
+	return conf.ClusterConnectionConf.Validate()
+}
+
+// durationField is a named duration of a configuration, checked by
+// validateDurations.
+type durationField struct {
+	name  string
+	value time.Duration
+}
+
+// validateDurations returns an error for the first of the durations that is
+// negative.
+func validateDurations(fields ...durationField) error {
+	for _, f := range fields {
+		if f.value < 0 {
+			return fmt.Errorf("invalid %s %s: must not be negative", f.name, f.value)
+		}
+	}
+	return nil
+}
+
 // NodeMap maps a broker node ID to a connection handle.
 type NodeMap map[int32]string
 
@@ -141,46 +406,177 @@ type NodeMap map[int32]string
 // create clients to the cluster.
 type Broker struct {
 	conf    BrokerConf
-	conns   *connectionPool
+	conns   *ConnectionPool
 	cluster *Cluster
+	clock   clock
+
+	// produceSlots holds a token for every produce request in flight, or is
+	// nil if their number is not limited.
+	produceSlots chan struct{}
 }
 
 // NewBroker returns a broker to a given list of kafka addresses.
 //
 // The returned broker is not necessarily initially connected to any kafka node.
+// Brokers created with the same cluster name share the metadata of the one
+// created first, including its node addresses and cluster connection
+// configuration.
 func NewBroker(clusterName string, nodeAddresses []string, conf BrokerConf) (*Broker, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
 	metadata, err := getMetadataCache().getOrCreateMetadata(clusterName, nodeAddresses, conf.ClusterConnectionConf)
 	if err != nil {
 		log.Warningf("Failed to get cluster Metadata %s from cache", nodeAddresses)
 		return nil, err
 	}
 
-	metadataConnPool, err := metadata.connectionPoolForClient(conf.ClientID, conf.ClusterConnectionConf)
-	if err != nil {
-		log.Warningf("Failed to get ConnectionPool for metadata from cache")
-		return nil, err
+	if conf.ExpectedClusterID != "" {
+		if id := metadata.ClusterID(); id != conf.ExpectedClusterID {
+			log.Warningf("Connected to cluster %q, expected %q", id, conf.ExpectedClusterID)
+			return nil, fmt.Errorf("unexpected cluster ID %q, expected %q", id, conf.ExpectedClusterID)
+		}
+	}
+
+	if err := metadata.RefreshTopics(conf.PrefetchTopics...); err != nil {
+		log.Warningf("Failed to prefetch metadata of topics %v: %s", conf.PrefetchTopics, err)
+	}
+
+	metadataConnPool := conf.ConnectionPool
+	if metadataConnPool == nil {
+		metadataConnPool, err = metadata.connectionPoolForClient(conf.ClientID, conf.ClusterConnectionConf)
+		if err != nil {
+			log.Warningf("Failed to get ConnectionPool for metadata from cache")
+			return nil, err
+		}
+	}
+
+	var produceSlots chan struct{}
+	if conf.MaxConcurrentProduces > 0 {
+		produceSlots = make(chan struct{}, conf.MaxConcurrentProduces)
 	}
 
 	return &Broker{
-		conf,
-		metadataConnPool,
-		metadata,
+		conf:         conf,
+		conns:        metadataConnPool,
+		cluster:      metadata,
+		clock:        realClock{},
+		produceSlots: produceSlots,
 	}, nil
 }
 
 // Metadata returns a copy of the metadata. This does not require a lock as it's fetching
 // a new copy from Kafka, we never use our internal state.
 func (b *Broker) Metadata() (*proto.MetadataResp, error) {
-	resp, err := b.cluster.Fetch(b.conf.ClientID)
+	version := b.apiVersion(proto.MetadataReqKind, b.conf.ClusterConnectionConf.MetadataVersion)
+	resp, err := b.cluster.FetchVersion(b.conf.ClientID, version)
 	return resp, err
 }
 
 // PartitionCount returns the count of partitions in a topic, or 0 and an error if the topic
-// does not exist.
+// does not exist. A topic that is being created may report 0 partitions
+// without an error; it should be treated as not ready yet.
 func (b *Broker) PartitionCount(topic string) (int32, error) {
 	return b.cluster.PartitionCount(topic)
 }
 
+// OnMetadataChange registers fn to be called with the new metadata epoch
+// after every full metadata refresh. See Cluster.OnMetadataChange.
+func (b *Broker) OnMetadataChange(fn func(epoch int64)) {
+	b.cluster.OnMetadataChange(fn)
+}
+
+// RefreshMetadataForTopic updates the cached metadata of the given topic only.
+func (b *Broker) RefreshMetadataForTopic(topic string) error {
+	return b.RefreshMetadataForTopics([]string{topic})
+}
+
+// RefreshMetadataForTopics updates the cached metadata of the given topics,
+// requesting all of them with a single metadata request. Metadata of other
+// topics is left untouched.
+func (b *Broker) RefreshMetadataForTopics(topics []string) error {
+	seen := make(map[string]struct{}, len(topics))
+	unique := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		if _, ok := seen[topic]; !ok {
+			seen[topic] = struct{}{}
+			unique = append(unique, topic)
+		}
+	}
+	return b.cluster.RefreshTopics(unique...)
+}
+
+// Warmup establishes connections to the leaders of all partitions of given
+// topics and returns them to the pool, so that the first produce or consume
+// does not have to wait for dialing. Metadata of topics that are not known yet
+// is fetched with a single request. Every partition is attempted even if some
+// fail; the first error encountered is returned.
+func (b *Broker) Warmup(topics []string) error {
+	var unknown []string
+	for _, topic := range topics {
+		if _, err := b.cluster.PartitionCount(topic); err != nil {
+			unknown = append(unknown, topic)
+		}
+	}
+	var resErr error
+	if len(unknown) > 0 {
+		if err := b.RefreshMetadataForTopics(unknown); err != nil {
+			log.Warningf("cannot refresh metadata for warm up: %s", err)
+			resErr = err
+		}
+	}
+
+	for _, topic := range topics {
+		count, err := b.cluster.PartitionCount(topic)
+		if err != nil {
+			log.Warningf("cannot warm up connections for %s: %s", topic, err)
+			if resErr == nil {
+				resErr = err
+			}
+			continue
+		}
+		for partition := int32(0); partition < count; partition++ {
+			conn, err := b.leaderConnection(topic, partition)
+			if err != nil {
+				log.Warningf("cannot warm up connection for %s:%d: %s", topic, partition, err)
+				if resErr == nil {
+					resErr = err
+				}
+				continue
+			}
+			b.conns.Idle(conn)
+		}
+	}
+	return resErr
+}
+
+// CloseConnectionsToNode closes all pooled connections to the given node.
+// Connections currently in use fail their pending request, which triggers the
+// usual retry and metadata refresh handling. Subsequent requests re-dial.
+func (b *Broker) CloseConnectionsToNode(nodeID int32) error {
+	addr := b.cluster.GetNodeAddress(nodeID)
+	if addr == "" {
+		return fmt.Errorf("unknown broker ID: %d", nodeID)
+	}
+	log.Infof("closing connections to node %d at %s", nodeID, addr)
+	return b.conns.CloseConnectionsByAddr(addr)
+}
+
+// ConnectionPoolStats returns the connection reuse counters of the broker's
+// connection pool. Metadata connections are not included.
+func (b *Broker) ConnectionPoolStats() ConnectionPoolStats {
+	return b.conns.Stats()
+}
+
+// apiVersion returns the version that should be used for the given request
+// kind, which is the given version unless pinned with ForceAPIVersions.
+func (b *Broker) apiVersion(requestKind int16, version int16) int16 {
+	if pinned, ok := b.conf.ForceAPIVersions[requestKind]; ok {
+		return pinned
+	}
+	return version
+}
+
 // getLeaderEndpoint returns the ID of the node responsible for a topic/partition.
 // This may refresh metadata and may also initiate topic creation if the topic is
 // unknown and such is enabled. This method may take a long time to return.
@@ -212,15 +608,52 @@ func (b *Broker) getLeaderEndpoint(topic string, partition int32) (int32, error)
 
 	// Try to create the topic by requesting the metadata for that one specific topic
 	// (this is the hack Kafka uses to allow topics to be created on demand)
-	if _, err := b.cluster.Fetch(b.conf.ClientID, topic); err != nil {
+	version := b.apiVersion(proto.MetadataReqKind, b.conf.ClusterConnectionConf.MetadataVersion)
+	resp, err := b.cluster.FetchVersion(b.conf.ClientID, version, topic)
+	if err != nil {
 		log.Warningf("[getLeaderEndpoint %s:%d] failed to get metadata for topic: %s",
 			topic, partition, err)
 		return 0, err
 	}
+	b.cluster.cacheTopics(resp)
+	if topicError(resp, topic) == proto.ErrInvalidTopic {
+		// refreshing metadata again cannot make the name valid
+		log.Warningf("[getLeaderEndpoint %s:%d] invalid topic", topic, partition)
+		return 0, proto.ErrInvalidTopic
+	}
 
-	// Successfully refreshed metadata, try to get endpoint again
-	if nodeID, err := b.cluster.GetEndpoint(topic, partition); err == nil {
-		return nodeID, nil
+	// Partitions of a topic that was just created may not have a leader yet,
+	// so keep refreshing its metadata for a while until they settle.
+	retry := &backoff.Backoff{Min: b.conf.LeaderRetryWait, Jitter: true}
+	deadline := b.clock.Now().Add(b.conf.TopicCreationWait)
+	for {
+		// Successfully refreshed metadata, try to get endpoint again
+		if nodeID, err := b.cluster.GetEndpoint(topic, partition); err == nil && nodeID >= 0 {
+			return nodeID, nil
+		}
+		remaining := deadline.Sub(b.clock.Now())
+		if remaining <= 0 || !leaderPending(resp, topic, partition) {
+			break
+		}
+		sleepFor := retry.Duration()
+		if sleepFor > remaining {
+			sleepFor = remaining
+		}
+		log.Debugf("[getLeaderEndpoint %s:%d] waiting %s for leader of created topic",
+			topic, partition, sleepFor)
+		b.clock.Sleep(sleepFor)
+
+		if resp, err = b.cluster.FetchVersion(b.conf.ClientID, version, topic); err != nil {
+			log.Warningf("[getLeaderEndpoint %s:%d] failed to get metadata for topic: %s",
+				topic, partition, err)
+			return 0, err
+		}
+		b.cluster.cacheTopics(resp)
+	}
+	if leaderPending(resp, topic, partition) {
+		log.Warningf("[getLeaderEndpoint %s:%d] no leader for created topic after %s",
+			topic, partition, b.conf.TopicCreationWait)
+		return 0, proto.ErrLeaderNotAvailable
 	}
 
 	// This topic is dead to us, we failed to find it and failed to create it
@@ -229,6 +662,35 @@ func (b *Broker) getLeaderEndpoint(topic string, partition int32) (int32, error)
 	return 0, proto.ErrUnknownTopicOrPartition
 }
 
+// topicError returns the error reported for given topic in resp, if any.
+func topicError(resp *proto.MetadataResp, topic string) error {
+	for _, t := range resp.Topics {
+		if t.Name == topic {
+			return t.Err
+		}
+	}
+	return nil
+}
+
+// leaderPending returns true if given metadata response tells the topic
+// exists, but the partition has no leader yet.
+func leaderPending(resp *proto.MetadataResp, topic string, partition int32) bool {
+	for _, t := range resp.Topics {
+		if t.Name != topic {
+			continue
+		}
+		if t.Err == proto.ErrLeaderNotAvailable {
+			return true
+		}
+		for _, p := range t.Partitions {
+			if p.ID == partition {
+				return p.Leader < 0 || p.Err == proto.ErrLeaderNotAvailable
+			}
+		}
+	}
+	return false
+}
+
 // leaderConnection returns connection to leader for given partition. If
 // connection does not exist, broker will try to connect.
 //
@@ -238,19 +700,43 @@ func (b *Broker) getLeaderEndpoint(topic string, partition int32) (int32, error)
 // the leader we will return a random broker. The broker will error if we end
 // up producing to it incorrectly (i.e., our metadata happened to be out of
 // date).
+//
+// Partitions of the same topic led by the same node get the same connection
+// as long as it is idle, see ConnectionPool.GetTopicConnectionByAddr.
 func (b *Broker) leaderConnection(topic string, partition int32) (*connection, error) {
+	conn, _, err := b.connectToLeader(context.Background(), topic, partition, false)
+	return conn, err
+}
+
+// connectToLeader works like leaderConnection, but also returns the ID of the
+// node connected to. If failFast is set, it returns ErrAllBrokersUnreachable
+// instead of retrying when an attempt fails and none of the cluster nodes are
+// reachable. It gives up once ctx is done, returning its error.
+func (b *Broker) connectToLeader(
+	ctx context.Context, topic string, partition int32, failFast bool) (*connection, int32, error) {
+
 	retry := &backoff.Backoff{Min: b.conf.LeaderRetryWait, Jitter: true}
 	var resErr error
 	for try := 0; try < b.conf.LeaderRetryLimit; try++ {
 		if try != 0 {
+			if failFast && !b.conns.AnyReachable() {
+				log.Warningf("[leaderConnection %s:%d] no broker reachable: %s",
+					topic, partition, resErr)
+				return nil, 0, ErrAllBrokersUnreachable
+			}
 			sleepFor := retry.Duration()
 			log.Debugf("cannot get leader connection for %s:%d: retry=%d, sleep=%s",
 				topic, partition, try, sleepFor)
-			time.Sleep(sleepFor)
+			if err := b.clock.SleepCtx(ctx, sleepFor); err != nil {
+				return nil, 0, err
+			}
 		}
 
 		// Figure out which broker (node/endpoint) is presently leader for this t/p
 		nodeID, err := b.getLeaderEndpoint(topic, partition)
+		if err == proto.ErrInvalidTopic {
+			return nil, 0, err
+		}
 		if err != nil {
 			resErr = err
 			continue
@@ -264,7 +750,10 @@ func (b *Broker) leaderConnection(topic string, partition int32) (*connection, e
 				topic, partition, nodeID)
 			b.cluster.ForgetEndpoint(topic, partition)
 		} else {
-			if conn, err := b.conns.GetConnectionByAddr(addr); err != nil {
+			if conn, err := b.conns.GetTopicConnectionByAddr(ctx, addr, topic); err != nil {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return nil, 0, ctxErr
+				}
 				resErr = err
 				log.Warningf("[leaderConnection %s:%d] failed to connect to %s: %s",
 					topic, partition, addr, err)
@@ -276,14 +765,14 @@ func (b *Broker) leaderConnection(topic string, partition int32) (*connection, e
 				}
 			} else {
 				// Successful (supposedly) connection
-				return conn, nil
+				return conn, nodeID, nil
 			}
 		}
 	}
 	if resErr == nil {
 		resErr = errors.New("programmer error in leaderConnection: err can't be nil")
 	}
-	return nil, resErr
+	return nil, 0, resErr
 }
 
 // coordinatorConnection returns connection to offset coordinator for given group. May
@@ -313,8 +802,9 @@ func (b *Broker) coordinatorConnection(consumerGroup string) (*connection, error
 	return conn, nil
 }
 
-// getGroupCoordinator is an internal function that fetches a group coordinator.
-func (b *Broker) getGroupCoordinator(consumerGroup string) (*proto.GroupCoordinatorResp, error) {
+// anyConnection returns a connection to any of the brokers, preferring idle
+// connections. The caller must ensure Idle is eventually called.
+func (b *Broker) anyConnection() (*connection, error) {
 	// Attempt to get idle connection first, else, try all possible brokers
 	// randomly permuted
 	conn := b.conns.GetIdleConnection()
@@ -330,9 +820,18 @@ func (b *Broker) getGroupCoordinator(consumerGroup string) (*proto.GroupCoordina
 		}
 	}
 	if conn == nil {
-		log.Warningf("coordinatorConnection: failed to connect to any broker")
 		return nil, errors.New("failed to connect to any broker")
 	}
+	return conn, nil
+}
+
+// getGroupCoordinator is an internal function that fetches a group coordinator.
+func (b *Broker) getGroupCoordinator(consumerGroup string) (*proto.GroupCoordinatorResp, error) {
+	conn, err := b.anyConnection()
+	if err != nil {
+		log.Warningf("coordinatorConnection: failed to connect to any broker")
+		return nil, err
+	}
 
 	// Ensure we release this connection
 	defer func(lconn *connection) { go b.conns.Idle(lconn) }(conn)
@@ -357,20 +856,30 @@ func (b *Broker) getGroupCoordinator(consumerGroup string) (*proto.GroupCoordina
 
 // offset will return offset value for given partition. Use timems to specify
 // which offset value should be returned.
-func (b *Broker) offset(topic string, partition int32, timems int64) (int64, error) {
+func (b *Broker) offset(topic string, partition int32, timems int64, version int16) (int64, error) {
+	offsets, err := b.offsets(topic, partition, version, proto.OffsetReqPartition{
+		ID:         partition,
+		TimeMs:     timems,
+		MaxOffsets: 2,
+	})
+	// Happens when there are no messages in the partition
+	if len(offsets) == 0 {
+		return 0, err
+	}
+	return offsets[0], err
+}
+
+// offsets sends a single offset request asking for all given entries of the
+// partition and returns the offsets of all answered entries, in order.
+func (b *Broker) offsets(topic string, partition int32, version int16, parts ...proto.OffsetReqPartition) ([]int64, error) {
 	req := &proto.OffsetReq{
+		Version:   b.apiVersion(proto.OffsetReqKind, version),
 		ClientID:  b.conf.ClientID,
 		ReplicaID: -1, // any client
 		Topics: []proto.OffsetReqTopic{
 			{
-				Name: topic,
-				Partitions: []proto.OffsetReqPartition{
-					{
-						ID:         partition,
-						TimeMs:     timems,
-						MaxOffsets: 2,
-					},
-				},
+				Name:       topic,
+				Partitions: parts,
 			},
 		},
 	}
@@ -380,12 +889,12 @@ func (b *Broker) offset(topic string, partition int32, timems int64) (int64, err
 offsetRetryLoop:
 	for try := 0; try < b.conf.LeaderRetryLimit; try++ {
 		if try != 0 {
-			time.Sleep(retry.Duration())
+			b.clock.Sleep(retry.Duration())
 		}
 
 		conn, err := b.leaderConnection(topic, partition)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 		defer func(lconn *connection) { go b.conns.Idle(lconn) }(conn)
 
@@ -398,9 +907,11 @@ offsetRetryLoop:
 				resErr = err
 				continue
 			}
-			return 0, err
+			return nil, err
 		}
 
+		var offsets []int64
+		var found bool
 		for _, t := range resp.Topics {
 			for _, p := range t.Partitions {
 				if t.Name != topic || p.ID != partition {
@@ -422,29 +933,216 @@ offsetRetryLoop:
 					continue offsetRetryLoop
 				}
 
-				// Happens when there are no messages in the partition
-				if len(p.Offsets) == 0 {
-					return 0, p.Err
+				if p.Err != nil {
+					return append(offsets, p.Offsets...), p.Err
 				}
-				return p.Offsets[0], p.Err
+				offsets = append(offsets, p.Offsets...)
+				found = true
 			}
 		}
+		if found {
+			return offsets, nil
+		}
 	}
 
 	if resErr == nil {
-		return 0, errors.New("incomplete fetch response")
+		return nil, errors.New("incomplete fetch response")
 	}
-	return 0, resErr
+	return nil, resErr
 }
 
 // OffsetEarliest returns the oldest offset available on the given partition.
 func (b *Broker) OffsetEarliest(topic string, partition int32) (int64, error) {
-	return b.offset(topic, partition, -2)
+	return b.offset(topic, partition, -2, 0)
 }
 
 // OffsetLatest return the offset of the next message produced in given partition
 func (b *Broker) OffsetLatest(topic string, partition int32) (int64, error) {
-	return b.offset(topic, partition, -1)
+	return b.offset(topic, partition, -1, 0)
+}
+
+// OffsetBounds returns the oldest offset available on the given partition
+// and the offset of the next message produced to it, asking for both with a
+// single request. Brokers keeping only one of the two entries of the request
+// for the same partition answer the latest one with all the offsets they
+// know of, the oldest of which is the earliest offset.
+func (b *Broker) OffsetBounds(topic string, partition int32) (earliest, latest int64, err error) {
+	offsets, err := b.offsets(topic, partition, 0,
+		proto.OffsetReqPartition{ID: partition, TimeMs: proto.OffsetReqTimeEarliest, MaxOffsets: 1},
+		proto.OffsetReqPartition{ID: partition, TimeMs: proto.OffsetReqTimeLatest, MaxOffsets: math.MaxInt32})
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(offsets) == 0 {
+		// Happens when there are no messages in the partition
+		return 0, 0, nil
+	}
+	earliest, latest = offsets[0], offsets[0]
+	for _, offset := range offsets[1:] {
+		if offset < earliest {
+			earliest = offset
+		}
+		if offset > latest {
+			latest = offset
+		}
+	}
+	return earliest, latest, nil
+}
+
+// OffsetForTime returns the offset of the earliest message in given partition
+// whose timestamp is greater or equal to t, or -1 if there is no such message.
+// This requires kafka 0.10.1 or newer.
+func (b *Broker) OffsetForTime(topic string, partition int32, t time.Time) (int64, error) {
+	return b.offset(topic, partition, t.UnixNano()/int64(time.Millisecond), 1)
+}
+
+// ApproximateMessageCount returns the number of messages in given topic,
+// summing the difference between the latest and the earliest offset of every
+// partition. The count is only approximate: messages removed by compaction
+// are still counted, and retention or produces may change the offsets of a
+// partition while the others are read.
+func (b *Broker) ApproximateMessageCount(topic string) (int64, error) {
+	count, err := b.refreshedPartitionCount(topic)
+	if err != nil {
+		return 0, err
+	}
+
+	earliest, err := b.partitionOffsets(topic, count, proto.OffsetReqTimeEarliest)
+	if err != nil {
+		return 0, err
+	}
+	latest, err := b.partitionOffsets(topic, count, proto.OffsetReqTimeLatest)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for partition := int32(0); partition < count; partition++ {
+		total += latest[partition] - earliest[partition]
+	}
+	return total, nil
+}
+
+// TopicLag returns the lag of every partition of given topic: the number of
+// messages between the committed offset of the partition and its latest
+// offset. Latest offsets of all partitions are fetched with a single request
+// per leader. Partitions missing from committed, or with a negative committed
+// offset, are reported as if nothing was consumed from them. Lag is never
+// negative, even if the committed offset is past the latest one.
+func (b *Broker) TopicLag(topic string, committed map[int32]int64) (map[int32]int64, error) {
+	count, err := b.refreshedPartitionCount(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	latest, err := b.partitionOffsets(topic, count, proto.OffsetReqTimeLatest)
+	if err != nil {
+		return nil, err
+	}
+	lag := make(map[int32]int64, count)
+	for partition, offset := range latest {
+		done := committed[partition]
+		if done < 0 {
+			done = 0
+		}
+		if offset > done {
+			lag[partition] = offset - done
+		} else {
+			lag[partition] = 0
+		}
+	}
+	return lag, nil
+}
+
+// refreshedPartitionCount returns the partition count of given topic,
+// refreshing its metadata if the topic is not known yet.
+func (b *Broker) refreshedPartitionCount(topic string) (int32, error) {
+	count, err := b.cluster.PartitionCount(topic)
+	if err != nil {
+		if err = b.cluster.RefreshTopics(topic); err == nil {
+			count, err = b.cluster.PartitionCount(topic)
+		}
+	}
+	return count, err
+}
+
+// partitionOffsets returns the offset for given time of every partition of a
+// topic with given partition count, sending a single request to the leader of
+// every partition. Partitions
+// missing from the responses or failing are read again one by one, which
+// retries on leadership changes.
+func (b *Broker) partitionOffsets(topic string, partitions int32, timems int64) (map[int32]int64, error) {
+	byLeader := make(map[int32][]proto.OffsetReqPartition)
+	for partition := int32(0); partition < partitions; partition++ {
+		nodeID, err := b.getLeaderEndpoint(topic, partition)
+		if err != nil {
+			nodeID = -1
+		}
+		byLeader[nodeID] = append(byLeader[nodeID], proto.OffsetReqPartition{
+			ID:         partition,
+			TimeMs:     timems,
+			MaxOffsets: 2,
+		})
+	}
+
+	offsets := make(map[int32]int64, partitions)
+	for nodeID, parts := range byLeader {
+		addr := b.cluster.GetNodeAddress(nodeID)
+		if nodeID < 0 || addr == "" {
+			continue
+		}
+		conn, err := b.conns.GetConnectionByAddr(addr)
+		if err != nil {
+			log.Warningf("cannot connect to node %d for offsets of %s: %s", nodeID, topic, err)
+			continue
+		}
+		resp, err := conn.Offset(&proto.OffsetReq{
+			Version:   b.apiVersion(proto.OffsetReqKind, 0),
+			ClientID:  b.conf.ClientID,
+			ReplicaID: -1, // any client
+			Topics:    []proto.OffsetReqTopic{{Name: topic, Partitions: parts}},
+		})
+		if err != nil {
+			log.Warningf("cannot fetch offsets of %s from node %d: %s", topic, nodeID, err)
+			_ = conn.Close()
+			continue
+		}
+		go b.conns.Idle(conn)
+
+		for _, t := range resp.Topics {
+			if t.Name != topic {
+				continue
+			}
+			for _, p := range t.Partitions {
+				if p.Err != nil {
+					continue
+				}
+				// no offsets are returned when there are no messages
+				offsets[p.ID] = 0
+				if len(p.Offsets) > 0 {
+					offsets[p.ID] = p.Offsets[0]
+				}
+			}
+		}
+	}
+
+	for partition := int32(0); partition < partitions; partition++ {
+		if _, ok := offsets[partition]; ok {
+			continue
+		}
+		offset, err := b.offset(topic, partition, timems, 0)
+		if err != nil {
+			return nil, err
+		}
+		offsets[partition] = offset
+	}
+	return offsets, nil
+}
+
+// CompressionTier is the compression of produce requests whose messages add
+// up to at least MinBytes of keys and values.
+type CompressionTier struct {
+	MinBytes    int
+	Compression proto.Compression
 }
 
 // ProducerConf is the configuration for a producer.
@@ -452,15 +1150,24 @@ type ProducerConf struct {
 	// Compression method to use, defaulting to proto.CompressionNone.
 	Compression proto.Compression
 
+	// CompressionTiers chooses the compression of every produce request
+	// based on the uncompressed size of its messages, so that small writes
+	// are not slowed down by compression that barely pays off. The tier with
+	// the biggest MinBytes not over the size applies, smaller requests use
+	// Compression.
+	//
+	// Defaults to nil, which always uses Compression.
+	CompressionTiers []CompressionTier
+
 	// Timeout of single produce request. By default, 5 seconds.
 	RequestTimeout time.Duration
 
 	// Message ACK configuration. Use proto.RequiredAcksAll to require all
 	// servers to write, proto.RequiredAcksLocal to wait only for leader node
-	// answer or proto.RequiredAcksNone to not wait for any response.
-	// Setting this to any other, greater than zero value will make producer to
-	// wait for given number of servers to confirm write before returning.
-	RequiredAcks int16
+	// answer or proto.RequiredAcksNone to not wait for any response. Brokers
+	// reject any other value, so Produce returns proto.ErrInvalidRequiredAcks
+	// without sending anything when it is set to something else.
+	RequiredAcks proto.RequiredAcks
 
 	// RetryLimit specify how many times message producing should be retried in
 	// case of failure, before returning the error to the caller. By default
@@ -472,33 +1179,259 @@ type ProducerConf struct {
 	//
 	// Defaults to 200ms.
 	RetryWait time.Duration
-}
 
-// NewProducerConf returns a default producer configuration.
-func NewProducerConf() ProducerConf {
-	return ProducerConf{
-		Compression:    proto.CompressionNone,
-		RequestTimeout: 5 * time.Second,
-		RequiredAcks:   proto.RequiredAcksAll,
-		RetryLimit:     10,
-		RetryWait:      200 * time.Millisecond,
-	}
-}
+	// MaxMessagesPerRequest caps the number of messages sent in a single
+	// produce request. Larger Produce calls are split into consecutive
+	// requests of at most this many messages. Writes are then only atomic
+	// within each request, not across the whole call.
+	//
+	// Defaults to 0, which means no limit.
+	MaxMessagesPerRequest int
+
+	// FailFastOnNoBrokers makes Produce return ErrAllBrokersUnreachable
+	// right away when connecting to the leader fails and no other node of the
+	// cluster can be connected to either, instead of retrying up to
+	// LeaderRetryLimit times.
+	//
+	// Defaults to false.
+	FailFastOnNoBrokers bool
+
+	// AssertKeyPartitionConsistency makes Produce verify that every message
+	// with a key is written to the partition HashPartition computes for that
+	// key, returning ErrKeyPartitionMismatch without sending anything
+	// otherwise. Enable it when messages are routed by key hash to catch
+	// misrouted messages early.
+	//
+	// Defaults to false.
+	AssertKeyPartitionConsistency bool
+
+	// OnServed, if set, is called with the ID of the node that handled every
+	// produce request sent, right after its response is read. Useful to
+	// find hot brokers.
+	//
+	// Defaults to nil.
+	OnServed func(topic string, partition, nodeID int32)
+
+	// BeforeAttempt, if set, is called before every attempt to send a produce
+	// request, including retries, with the number of the attempt starting at
+	// 1. Useful to instrument retries or inject faults in tests.
+	//
+	// Defaults to nil.
+	BeforeAttempt func(topic string, partition int32, attempt int)
+
+	// ValidateTopicName makes Produce check the topic name before sending
+	// anything, returning proto.ErrInvalidTopic for names brokers would
+	// reject: empty ones, "." and "..", names longer than 249 characters and
+	// names with characters other than ASCII letters, digits, '.', '_' and
+	// '-'.
+	//
+	// Defaults to false.
+	ValidateTopicName bool
+
+	// RecordBatches makes Produce write messages as v2 record batches, which
+	// keep message timestamps and headers. The timestamps are stored as
+	// deltas from the smallest one in the batch, so they are preserved
+	// exactly, compressed or not. This requires kafka 0.11 or newer.
+	//
+	// Defaults to false, which uses the legacy message format that drops
+	// timestamps and headers.
+	RecordBatches bool
+
+	// PreserveOffsets makes Produce keep the offsets of the messages instead
+	// of setting them to those assigned by the broker, for mirroring from
+	// another cluster while keeping the source offsets for bookkeeping.
+	// Unless RequiredAcks is proto.RequiredAcksNone, Produce also checks that
+	// the broker stored the first message at its source offset, so that the
+	// mirror continues where the source does, and returns
+	// ErrOffsetMismatch otherwise. The messages were written regardless.
+	// Only the first message is checked, gaps in the source offsets, like
+	// those left by compaction, show up in later writes.
+	//
+	// Defaults to false.
+	PreserveOffsets bool
+}
+
+// NewProducerConf returns a default producer configuration.
+func NewProducerConf() ProducerConf {
+	return ProducerConf{
+		Compression:           proto.CompressionNone,
+		RequestTimeout:        5 * time.Second,
+		RequiredAcks:          proto.RequiredAcksAll,
+		RetryLimit:            10,
+		RetryWait:             200 * time.Millisecond,
+		MaxMessagesPerRequest: 0,
+		FailFastOnNoBrokers:   false,
+	}
+}
+
+// Validate returns an error if the configuration cannot be used to produce
+// messages.
+func (conf ProducerConf) Validate() error {
+	if !conf.RequiredAcks.Valid() {
+		return proto.ErrInvalidRequiredAcks
+	}
+	if conf.RetryLimit < 0 {
+		return fmt.Errorf("invalid RetryLimit %d: must not be negative", conf.RetryLimit)
+	}
+	if conf.MaxMessagesPerRequest < 0 {
+		return fmt.Errorf("invalid MaxMessagesPerRequest %d: must not be negative", conf.MaxMessagesPerRequest)
+	}
+	err := validateDurations(
+		durationField{"RequestTimeout", conf.RequestTimeout},
+		durationField{"RetryWait", conf.RetryWait},
+	)
+	if err != nil {
+		return err
+	}
+	for _, tier := range conf.CompressionTiers {
+		switch tier.Compression {
+		case proto.CompressionNone, proto.CompressionGzip, proto.CompressionSnappy:
+		default:
+			return fmt.Errorf("cannot handle compression method: %d", tier.Compression)
+		}
+	}
+	return nil
+}
+
+// compression returns the compression to use for a request writing given
+// messages.
+func (conf ProducerConf) compression(messages []*proto.Message) proto.Compression {
+	if len(conf.CompressionTiers) == 0 {
+		return conf.Compression
+	}
+	var size int
+	for _, msg := range messages {
+		size += len(msg.Key) + len(msg.Value)
+	}
+	compression, best := conf.Compression, -1
+	for _, tier := range conf.CompressionTiers {
+		if tier.MinBytes <= size && tier.MinBytes > best {
+			compression, best = tier.Compression, tier.MinBytes
+		}
+	}
+	return compression
+}
 
 // producer is the link to the client with extra configuration.
 type producer struct {
 	conf   ProducerConf
 	broker *Broker
+
+	// confErr is the result of validating conf, which is checked once when
+	// the producer is created and returned by every write.
+	confErr error
+
+	// mu protects partitions and must not be used outside of lockPartition.
+	mu         *sync.Mutex
+	partitions map[topicPartition]*partitionLock
+
+	// closeMu protects closed, so that no write can start once Close waits
+	// for those in progress, tracked by writes. closing is closed by Close.
+	closeMu sync.Mutex
+	closed  bool
+	closing chan struct{}
+	writes  sync.WaitGroup
 }
 
 // Producer returns new producer instance, bound to the broker.
 func (b *Broker) Producer(conf ProducerConf) Producer {
+	return b.producer(conf)
+}
+
+func (b *Broker) producer(conf ProducerConf) *producer {
 	return &producer{
-		conf:   conf,
-		broker: b,
+		conf:       conf,
+		broker:     b,
+		confErr:    conf.Validate(),
+		mu:         &sync.Mutex{},
+		partitions: make(map[topicPartition]*partitionLock),
+		closing:    make(chan struct{}),
+	}
+}
+
+// Close stops the producer, see Producer. It never fails.
+func (p *producer) Close() error {
+	p.closeMu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.closing)
+	}
+	p.closeMu.Unlock()
+
+	p.writes.Wait()
+	return nil
+}
+
+// startWrite registers a write with the producer, so that Close waits for
+// it, or returns ErrProducerClosed. The write has to call p.writes.Done once
+// it is finished.
+func (p *producer) startWrite() error {
+	p.closeMu.Lock()
+	defer p.closeMu.Unlock()
+
+	if p.closed {
+		return ErrProducerClosed
+	}
+	p.writes.Add(1)
+	return nil
+}
+
+// partitionLock is held while writing to a partition. refs counts the writers
+// holding or waiting for it.
+type partitionLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockPartition acquires the lock held while writing to given partition and
+// returns the function releasing it. Locks are removed once their last writer
+// releases them, so that writing to ever new partitions does not grow the
+// producer.
+func (p *producer) lockPartition(topic string, partition int32) (unlock func()) {
+	tp := topicPartition{topic: topic, partition: partition}
+	p.mu.Lock()
+	lock, ok := p.partitions[tp]
+	if !ok {
+		lock = &partitionLock{}
+		p.partitions[tp] = lock
+	}
+	lock.refs++
+	p.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		p.mu.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(p.partitions, tp)
+		}
+		p.mu.Unlock()
 	}
 }
 
+// StatsProducer is a Producer which can also report the retries needed to
+// write the messages.
+type StatsProducer interface {
+	Producer
+	ProduceWithStats(topic string, partition int32, messages ...*proto.Message) (offset int64, stats ProduceStats, err error)
+}
+
+// ProduceStats describes the work done by a single ProduceWithStats call.
+type ProduceStats struct {
+	// Attempts is the number of produce requests sent. It is larger than the
+	// number of requests needed to write the messages when some of them had
+	// to be retried.
+	Attempts int
+
+	// Wait is the total time spent waiting between retries.
+	Wait time.Duration
+}
+
+// StatsProducer returns new producer instance, bound to the broker.
+func (b *Broker) StatsProducer(conf ProducerConf) StatsProducer {
+	return b.producer(conf)
+}
+
 // Produce writes messages to the given destination. Writes within the call are
 // atomic, meaning either all or none of them are written to kafka.  Produce
 // has a configurable amount of retries which may be attempted when common
@@ -506,18 +1439,390 @@ func (b *Broker) Producer(conf ProducerConf) Producer {
 // RetryLimit and RetryWait attributes.
 //
 // Upon a successful call, the message's Offset field is updated.
+//
+// If MaxMessagesPerRequest is set, the messages are written using as many
+// requests as needed and the returned offset is still the one of the first
+// message. An error stops the remaining requests from being sent, but
+// messages from the earlier requests stay written.
+//
+// proto.ErrMessageSizeTooLarge is returned when the broker refuses the
+// messages for being larger than its configured limit. Retrying the same call
+// cannot succeed, the messages have to be sent in smaller batches instead.
 func (p *producer) Produce(
 	topic string, partition int32, messages ...*proto.Message) (offset int64, err error) {
 
-	offset, err = p.produce(topic, partition, messages...)
+	return p.produceAll(context.Background(), topic, partition, nil, messages...)
+}
+
+// ProduceWithResult writes messages like Produce does. Offsets are only known
+// if RequiredAcks is not proto.RequiredAcksNone.
+func (p *producer) ProduceWithResult(
+	topic string, partition int32, messages ...*proto.Message) (ProduceResult, error) {
+
+	offset, err := p.produceAll(context.Background(), topic, partition, nil, messages...)
+	if err != nil {
+		return ProduceResult{}, err
+	}
+	return newProduceResult(offset, messages), nil
+}
+
+// ProduceOne writes a single message like Produce does. The message is
+// allocated together with the message set holding it, which saves an
+// allocation compared to passing a single message to Produce.
+func (p *producer) ProduceOne(
+	topic string, partition int32, key, value []byte) (offset int64, err error) {
+
+	one := &singleMessage{msg: proto.Message{Key: key, Value: value}}
+	one.set[0] = &one.msg
+	return p.produceAll(context.Background(), topic, partition, nil, one.set[:]...)
+}
+
+// ProduceCtx writes messages like Produce does, but gives up once ctx is
+// done, returning its error, without waiting for further retries or
+// connections. The deadline, if earlier than RequestTimeout, is used as the
+// timeout sent to the broker as well as the read and write deadline of the
+// connection. Messages may have been written even if an error is returned.
+func (p *producer) ProduceCtx(
+	ctx context.Context, topic string, partition int32, messages ...*proto.Message) (offset int64, err error) {
+
+	return p.produceAll(ctx, topic, partition, nil, messages...)
+}
+
+// ProduceRecord writes a single message like Produce does. The offset is
+// only known if RequiredAcks is not proto.RequiredAcksNone.
+func (p *producer) ProduceRecord(topic string, partition int32, msg *proto.Message) (RecordMetadata, error) {
+	offset, err := p.produceAll(context.Background(), topic, partition, nil, msg)
+	if err != nil {
+		return RecordMetadata{}, err
+	}
+	return RecordMetadata{
+		Topic:     topic,
+		Partition: partition,
+		Offset:    offset,
+		Timestamp: msg.Timestamp,
+	}, nil
+}
+
+// singleMessage is a message together with the message set it is the only
+// member of.
+type singleMessage struct {
+	msg proto.Message
+	set [1]*proto.Message
+}
+
+// newProduceResult returns the result of writing messages, which must already
+// have their offsets set.
+func newProduceResult(baseOffset int64, messages []*proto.Message) ProduceResult {
+	result := ProduceResult{BaseOffset: baseOffset, LastOffset: baseOffset}
+	if len(messages) > 0 {
+		result.LastOffset = messages[len(messages)-1].Offset
+	}
+	return result
+}
+
+// ProduceWithStats writes messages like Produce does, but retries requests
+// failing with a transient error up to RetryLimit times, waiting RetryWait
+// with exponential backoff between attempts. Returned stats tell how many
+// attempts were made and how long they took to wait for, also when an error
+// is returned.
+func (p *producer) ProduceWithStats(
+	topic string, partition int32, messages ...*proto.Message) (offset int64, stats ProduceStats, err error) {
+
+	offset, err = p.produceAll(context.Background(), topic, partition, &stats, messages...)
+	return offset, stats, err
+}
+
+// produceAll writes the messages, splitting them over several requests if
+// MaxMessagesPerRequest is set. Requests are only retried if stats is not
+// nil, in which case the attempts are recorded in it. All of the requests
+// are given up once ctx is done.
+func (p *producer) produceAll(
+	ctx context.Context, topic string, partition int32, stats *ProduceStats, messages ...*proto.Message) (offset int64, err error) {
+
+	if err := p.startWrite(); err != nil {
+		return 0, err
+	}
+	defer p.writes.Done()
+
+	if p.confErr != nil {
+		return 0, p.confErr
+	}
+	if p.conf.ValidateTopicName && !validTopicName(topic) {
+		return 0, proto.ErrInvalidTopic
+	}
+	if p.conf.AssertKeyPartitionConsistency {
+		if err := p.checkKeyPartition(topic, partition, messages); err != nil {
+			return 0, err
+		}
+	}
+
+	unlock := p.lockPartition(topic, partition)
+	defer unlock()
+
+	limit := p.conf.MaxMessagesPerRequest
+	if limit <= 0 || len(messages) <= limit {
+		return p.produceRetry(ctx, topic, partition, stats, messages...)
+	}
+
+	for start := 0; start < len(messages); start += limit {
+		end := start + limit
+		if end > len(messages) {
+			end = len(messages)
+		}
+		off, err := p.produceRetry(ctx, topic, partition, stats, messages[start:end]...)
+		if err != nil {
+			return 0, err
+		}
+		if start == 0 {
+			offset = off
+		}
+	}
+	return offset, nil
+}
+
+// maxTopicNameLength is the longest topic name brokers accept.
+const maxTopicNameLength = 249
+
+// validTopicName returns true if brokers would accept given topic name, see
+// ProducerConf.ValidateTopicName.
+func validTopicName(topic string) bool {
+	if topic == "" || topic == "." || topic == ".." || len(topic) > maxTopicNameLength {
+		return false
+	}
+	for i := 0; i < len(topic); i++ {
+		switch ch := topic[i]; {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case ch == '.', ch == '_', ch == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// checkKeyPartition returns ErrKeyPartitionMismatch if any of the messages
+// has a key that hashes to a partition different from the given one.
+func (p *producer) checkKeyPartition(topic string, partition int32, messages []*proto.Message) error {
+	count, err := p.broker.cluster.PartitionCount(topic)
+	if err != nil || count == 0 {
+		// a topic without partitions is still being created
+		if err = p.broker.cluster.RefreshTopics(topic); err == nil {
+			count, err = p.broker.cluster.PartitionCount(topic)
+		}
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrNoPartitions
+		}
+	}
+	for _, msg := range messages {
+		if msg.Key == nil {
+			continue
+		}
+		if expected := HashPartition(msg.Key, count); expected != partition {
+			log.Errorf("message key %q of %s belongs to partition %d, not %d",
+				msg.Key, topic, expected, partition)
+			return ErrKeyPartitionMismatch
+		}
+	}
+	return nil
+}
+
+// produceRetry sends a single produce request, retrying it on transient
+// errors if stats is not nil.
+func (p *producer) produceRetry(
+	ctx context.Context, topic string, partition int32, stats *ProduceStats, messages ...*proto.Message) (offset int64, err error) {
+
+	if stats == nil {
+		if p.conf.BeforeAttempt != nil {
+			p.conf.BeforeAttempt(topic, partition, 1)
+		}
+		return p.produceRequest(ctx, topic, partition, messages...)
+	}
+
+	retry := &backoff.Backoff{Min: p.conf.RetryWait, Jitter: true}
+	var leaderMoving bool
+	for try := 0; ; try++ {
+		if try != 0 {
+			sleepFor := retry.Duration()
+			log.Debugf("cannot produce to %s:%d: retry=%d, sleep=%s: %s",
+				topic, partition, try, sleepFor, err)
+			stats.Wait += sleepFor
+			if serr := p.sleepRetry(ctx, sleepFor); serr == ErrProducerClosed {
+				// the attempt in flight when Close was called was the last
+				return offset, err
+			} else if serr != nil {
+				return 0, serr
+			}
+		}
+		stats.Attempts++
+		if p.conf.BeforeAttempt != nil {
+			p.conf.BeforeAttempt(topic, partition, try+1)
+		}
+		offset, err = p.produceRequest(ctx, topic, partition, messages...)
+		if err == nil || try >= p.conf.RetryLimit || !isTransientProduceError(err) {
+			return offset, err
+		}
+		switch {
+		case isLeaderMoveError(err):
+			leaderMoving = true
+		case leaderMoving && isConnectionError(err):
+			// During a controlled shutdown the broker first gives up
+			// leadership and then closes its connections, so the cached
+			// leader is gone and retrying it is pointless.
+			log.Debugf("leader of %s:%d closed the connection, refreshing metadata",
+				topic, partition)
+			if err := p.broker.cluster.RefreshMetadata(); err != nil {
+				log.Warningf("cannot refresh metadata: %s", err)
+			}
+		}
+	}
+}
+
+// sleepRetry waits d before the next attempt of a write. It returns the error
+// of ctx once it is done, or ErrProducerClosed once the producer is closed.
+func (p *producer) sleepRetry(ctx context.Context, d time.Duration) error {
+	select {
+	case <-p.closing:
+		return ErrProducerClosed
+	default:
+	}
+	sleepCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-p.closing:
+			cancel()
+		case <-sleepCtx.Done():
+		}
+	}()
+	if err := p.broker.clock.SleepCtx(sleepCtx, d); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return ErrProducerClosed
+	}
+	return nil
+}
+
+// isLeaderMoveError returns true if err means that the partition leadership
+// is moving to a different broker.
+func isLeaderMoveError(err error) bool {
+	return err == proto.ErrLeaderNotAvailable || err == proto.ErrNotLeaderForPartition
+}
+
+// isConnectionError returns true if err means that the connection was closed
+// or is otherwise broken.
+func isConnectionError(err error) bool {
+	if _, ok := err.(*net.OpError); ok {
+		return true
+	}
+	return err == io.EOF || err == syscall.EPIPE
+}
+
+// requestTimeout returns timeout, or the time left until the deadline of ctx
+// if that is shorter.
+func requestTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left < timeout {
+			if left < 0 {
+				return 0
+			}
+			return left
+		}
+	}
+	return timeout
+}
+
+// isTransientProduceError returns true if sending the same produce request
+// again might succeed.
+func isTransientProduceError(err error) bool {
+	if err == proto.ErrNotEnoughReplicasAfterAppend {
+		// the messages were written, so retrying would duplicate them
+		return false
+	}
+	if proto.IsRetryable(err) {
+		return true
+	}
+	switch err {
+	case ErrNoPartitionResponse, io.EOF, syscall.EPIPE:
+		return true
+	}
+	switch err.(type) {
+	case *net.OpError, *NoConnectionsAvailable:
+		return true
+	}
+	return false
+}
+
+// Validate checks the producer configuration, that the partition is known to
+// the cluster and that a connection to its leader can be established. Unlike
+// Produce, it never creates the topic and returns
+// proto.ErrUnknownTopicOrPartition if it does not exist.
+func (p *producer) Validate(topic string, partition int32) error {
+	if p.confErr != nil {
+		return p.confErr
+	}
+	if _, err := p.broker.cluster.GetEndpoint(topic, partition); err != nil {
+		if err := p.broker.cluster.RefreshMetadata(); err != nil {
+			return err
+		}
+		if _, err := p.broker.cluster.GetEndpoint(topic, partition); err != nil {
+			return proto.ErrUnknownTopicOrPartition
+		}
+	}
+
+	conn, _, err := p.broker.connectToLeader(context.Background(), topic, partition, p.conf.FailFastOnNoBrokers)
+	if err != nil {
+		return err
+	}
+	p.broker.conns.Idle(conn)
+	return nil
+}
+
+// InvalidateLeaderCache forgets the leaders of all partitions of the given
+// topic. Leaders are cached per cluster, so this affects all brokers connected
+// to the same cluster.
+func (p *producer) InvalidateLeaderCache(topic string) {
+	p.broker.cluster.ForgetTopicEndpoints(topic)
+}
+
+// produceRequest writes the messages with a single produce request and handles
+// the result, updating message offsets or refreshing metadata as needed.
+func (p *producer) produceRequest(
+	ctx context.Context, topic string, partition int32, messages ...*proto.Message) (offset int64, err error) {
+
+	offset, err = p.produce(ctx, topic, partition, messages...)
 	switch err {
 	case nil:
+		if p.conf.PreserveOffsets {
+			if p.conf.RequiredAcks != proto.RequiredAcksNone && offset != messages[0].Offset {
+				log.Warningf("messages with offset %d written to %s:%d at offset %d",
+					messages[0].Offset, topic, partition, offset)
+				return offset, ErrOffsetMismatch
+			}
+			break
+		}
 		// offset is the offset value of first published messages
 		for i, msg := range messages {
 			msg.Offset = int64(i) + offset
 		}
 	case io.EOF, syscall.EPIPE:
 		// Connection dying / network issues won't be fixed by a metadata refresh.
+	case proto.ErrMessageSizeTooLarge, proto.ErrInvalidTopic:
+		// The messages have to be split by the caller, or the topic name
+		// fixed, nothing to do here.
+	case context.DeadlineExceeded, context.Canceled:
+		// The caller gave up, which says nothing about the leader.
+	case proto.ErrLeaderNotAvailable, proto.ErrNotLeaderForPartition:
+		// Leadership moved, often along with other changes like partitions
+		// added to the topic. The refresh is done before returning, so that
+		// callers checking the partition count, like DistributingProducer,
+		// see it right away.
+		if err := p.broker.cluster.RefreshMetadata(); err != nil {
+			log.Warningf("cannot refresh metadata: %s", err)
+		}
 	default:
 		// NoConnectionsAvailable also indicates the issue won't be fixed by metadata refresh.
 		if _, ok := err.(*NoConnectionsAvailable); !ok {
@@ -533,33 +1838,44 @@ func (p *producer) Produce(
 
 // produce send produce request to leader for given destination.
 func (p *producer) produce(
-	topic string, partition int32, messages ...*proto.Message) (offset int64, err error) {
+	ctx context.Context, topic string, partition int32, messages ...*proto.Message) (offset int64, err error) {
 
-	conn, err := p.broker.leaderConnection(topic, partition)
+	// the slot is only released once the connection is back in the pool, so
+	// that the next request waiting for it can get a connection
+	if err := p.broker.acquireProduceSlot(ctx); err != nil {
+		return 0, err
+	}
+	conn, nodeID, err := p.broker.connectToLeader(ctx, topic, partition, p.conf.FailFastOnNoBrokers)
 	if err != nil {
+		p.broker.releaseProduceSlot()
 		return 0, err
 	}
-	defer func(lconn *connection) { go p.broker.conns.Idle(lconn) }(conn)
-
-	req := proto.ProduceReq{
-		ClientID:     p.broker.conf.ClientID,
-		Compression:  p.conf.Compression,
-		RequiredAcks: p.conf.RequiredAcks,
-		Timeout:      p.conf.RequestTimeout,
-		Topics: []proto.ProduceReqTopic{
-			{
-				Name: topic,
-				Partitions: []proto.ProduceReqPartition{
-					{
-						ID:       partition,
-						Messages: messages,
-					},
-				},
-			},
-		},
+	defer func(lconn *connection) {
+		go func() {
+			p.broker.conns.Idle(lconn)
+			p.broker.releaseProduceSlot()
+		}()
+	}(conn)
+
+	var version int16
+	if p.conf.RecordBatches {
+		// record batches are supported starting with version 3
+		version = 3
+	}
+	pooled := newPooledProduceReq(topic, partition, messages)
+	req := &pooled.req
+	req.ClientID = p.broker.conf.ClientID
+	req.Compression = p.conf.compression(messages)
+	req.RequiredAcks = p.conf.RequiredAcks
+	req.Timeout = requestTimeout(ctx, p.conf.RequestTimeout)
+	req.Version = p.broker.apiVersion(proto.ProduceReqKind, version)
+
+	resp, err := conn.ProduceCtx(ctx, req)
+	if err != proto.ErrRequestTimeout && ctx.Err() == nil {
+		// On timeout the request may still be being written in the
+		// background, so it is left to the garbage collector instead.
+		pooled.release()
 	}
-
-	resp, err := conn.Produce(&req)
 	if err != nil {
 		if _, ok := err.(*net.OpError); ok || err == io.EOF || err == syscall.EPIPE {
 			// Connection is broken, so should be closed, but the error is
@@ -572,28 +1888,95 @@ func (p *producer) produce(
 		return 0, err
 	}
 
+	if p.conf.OnServed != nil {
+		p.conf.OnServed(topic, partition, nodeID)
+	}
+
 	// No response if we've asked for no acks
-	if req.RequiredAcks == proto.RequiredAcksNone {
+	if p.conf.RequiredAcks == proto.RequiredAcksNone {
 		return 0, err
 	}
 
 	// Presently we only handle producing to a single topic/partition so return it as
-	// soon as we've found it
+	// soon as we've found it. Entries are matched by topic and partition ID
+	// rather than position, because brokers may return partitions that were
+	// not part of the request, for example while partitions are moved.
 	for _, t := range resp.Topics {
 		for _, p := range t.Partitions {
 			if t.Name != topic || p.ID != partition {
-				log.Warningf("produce response with unexpected data for %s:%d",
+				log.Debugf("ignoring produce response data for unrequested %s:%d",
 					t.Name, p.ID)
 				continue
 			}
 
+			if p.Err == nil && resp.Version >= 2 && p.LogAppendTime >= 0 {
+				// the broker replaced the timestamps of the messages
+				appended := time.Unix(0, p.LogAppendTime*int64(time.Millisecond))
+				for _, msg := range messages {
+					msg.Timestamp = appended
+				}
+			}
 			return p.Offset, p.Err
 		}
 	}
 
-	// If we get here we didn't find the topic/partition in the response, this is an
-	// error condition of some kind
-	return 0, errors.New("incomplete produce response")
+	// If we get here we didn't find the topic/partition in the response, most
+	// likely the partition is being moved, so refresh metadata and try again
+	log.Warningf("produce response without data for %s:%d", topic, partition)
+	return 0, ErrNoPartitionResponse
+}
+
+// pooledProduceReq is a produce request for a single partition, allocated
+// together with its topic and partition slices so that all of them can be
+// reused through produceReqPool.
+type pooledProduceReq struct {
+	req        proto.ProduceReq
+	topics     [1]proto.ProduceReqTopic
+	partitions [1]proto.ProduceReqPartition
+}
+
+var produceReqPool = sync.Pool{
+	New: func() interface{} { return new(pooledProduceReq) },
+}
+
+// newPooledProduceReq returns a request writing messages to the given
+// partition, taken from produceReqPool. Call release once the request is no
+// longer used.
+func newPooledProduceReq(topic string, partition int32, messages []*proto.Message) *pooledProduceReq {
+	r := produceReqPool.Get().(*pooledProduceReq)
+	r.partitions[0] = proto.ProduceReqPartition{ID: partition, Messages: messages}
+	r.topics[0] = proto.ProduceReqTopic{Name: topic, Partitions: r.partitions[:]}
+	r.req.Topics = r.topics[:]
+	return r
+}
+
+// release clears the request, so that it does not keep messages alive or leak
+// them into another request, and puts it back to produceReqPool.
+func (r *pooledProduceReq) release() {
+	*r = pooledProduceReq{}
+	produceReqPool.Put(r)
+}
+
+// acquireProduceSlot blocks until fewer than MaxConcurrentProduces produce
+// requests are in flight and takes a slot for another one. It gives up when
+// ctx is done, returning its error without taking a slot.
+func (b *Broker) acquireProduceSlot(ctx context.Context) error {
+	if b.produceSlots == nil {
+		return nil
+	}
+	select {
+	case b.produceSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseProduceSlot frees a slot taken by acquireProduceSlot.
+func (b *Broker) releaseProduceSlot() {
+	if b.produceSlots != nil {
+		<-b.produceSlots
+	}
 }
 
 // ConsumerConf represents consumer configuration.
@@ -623,6 +2006,14 @@ type ConsumerConf struct {
 	// Default is 50ms.
 	RetryWait time.Duration
 
+	// RetryWaitJitter randomizes every RetryWait sleep by up to this fraction
+	// of it in either direction, so that consumers of the same partition do
+	// not refetch in lockstep. For example 0.2 makes consumers sleep between
+	// 80% and 120% of RetryWait.
+	//
+	// Default is 0, which means no jitter.
+	RetryWaitJitter float64
+
 	// RetryErrLimit limits the number of retry attempts when an error is
 	// encountered.
 	//
@@ -646,83 +2037,338 @@ type ConsumerConf struct {
 	// Default is 2000000 bytes.
 	MaxFetchSize int32
 
+	// AdaptiveFetchSize makes the consumer tune the size of data it fetches
+	// between MinAdaptiveFetchSize and MaxFetchSize. Fetching starts with the
+	// smallest size, which is doubled whenever a response comes back at
+	// least three quarters full and halved whenever it comes back less than
+	// a quarter full. Compressed messages count with their uncompressed size.
+	//
+	// Default is false, which means always fetching MaxFetchSize.
+	AdaptiveFetchSize bool
+
+	// MinAdaptiveFetchSize is the smallest size fetched with
+	// AdaptiveFetchSize set.
+	//
+	// Default is 65536 bytes.
+	MinAdaptiveFetchSize int32
+
 	// Consumer cursor starting point. Set to StartOffsetNewest to receive only
 	// newly created messages or StartOffsetOldest to read everything. Assign
 	// any offset value to manually set cursor -- consuming starts with the
 	// message whose offset is equal to given value (including first message).
+	// Set to StartFromRelative to start RelativeOffset messages behind the
+	// newest one.
 	//
 	// Default is StartOffsetOldest.
 	StartOffset int64
-}
 
-// NewConsumerConf returns the default consumer configuration.
-func NewConsumerConf(topic string, partition int32) ConsumerConf {
-	return ConsumerConf{
-		Topic:          topic,
-		Partition:      partition,
-		RequestTimeout: time.Millisecond * 50,
-		RetryLimit:     -1,
-		RetryWait:      time.Millisecond * 50,
-		RetryErrLimit:  10,
-		RetryErrWait:   time.Millisecond * 500,
-		MinFetchSize:   1,
-		MaxFetchSize:   2000000,
-		StartOffset:    StartOffsetOldest,
-	}
-}
+	// RelativeOffset is the number of messages before the high watermark
+	// to start consuming at when StartOffset is StartFromRelative. The
+	// consumer starts at the oldest message if the partition has fewer.
+	//
+	// Default is 0.
+	RelativeOffset int64
 
-// Consumer represents a single partition reading buffer. Consumer is also
-// providing limited failure handling and message filtering.
-type consumer struct {
-	broker *Broker
-	conf   ConsumerConf
+	// IsolationLevel controls visibility of transactional messages. Set to
+	// proto.IsolationLevelReadCommitted to receive only messages of committed
+	// transactions; aborted messages are then skipped. This requires kafka
+	// 0.11 or newer.
+	//
+	// Default is proto.IsolationLevelReadUncommitted.
+	IsolationLevel int8
 
-	// mu protects the following and must not be used outside of consumer.
-	mu     *sync.Mutex
-	offset int64 // offset of next NOT consumed message
-	msgbuf []*proto.Message
-}
+	// MaxMessagesPerSecond limits the rate at which Consume returns messages.
+	// Consume sleeps as needed between messages to stay within the limit.
+	// Batches returned by ConsumeBatch are not limited.
+	//
+	// Default is 0, which turns this limit off.
+	MaxMessagesPerSecond int
 
-// Consumer creates a new consumer instance, bound to the broker.
-func (b *Broker) Consumer(conf ConsumerConf) (Consumer, error) {
-	return b.consumer(conf)
-}
+	// MaxRecordsPerFetch limits the number of messages returned by a single
+	// ConsumeBatch call, regardless of MaxFetchSize. Messages of a fetch
+	// beyond the limit are buffered and returned by the following calls
+	// without fetching again.
+	//
+	// Default is 0, which turns this limit off.
+	MaxRecordsPerFetch int
 
-// BatchConsumer creates a new BatchConsumer instance, bound to the broker.
+	// SkipMalformed makes the consumer skip messages that cannot be decoded,
+	// for example because of an invalid crc, and continue with the next
+	// message of the set. Skipped messages are logged. Otherwise reading
+	// stops at a corrupted message, which is fetched again and again.
+	//
+	// Default is false.
+	SkipMalformed bool
+
+	// ConsumeDeadline limits the total time a single Consume or ConsumeBatch
+	// call keeps refetching when no data is returned. ErrNoData is returned
+	// once it passes, even if RetryLimit allows more attempts.
+	//
+	// Default is 0, which turns this limit off.
+	ConsumeDeadline time.Duration
+
+	// OnServed, if set, is called with the ID of the node that handled every
+	// fetch request sent, right after its response is read.
+	//
+	// Default is nil.
+	OnServed func(topic string, partition, nodeID int32)
+
+	// RackID enables fetching from followers. It is sent with every fetch
+	// request so that brokers configured with a replica selector can
+	// suggest a replica in the same rack, which the consumer then fetches
+	// from until it fails. This requires kafka 2.4 or newer.
+	//
+	// Default is empty, which means always fetching from the leader.
+	RackID string
+
+	// DedupeWindow makes Consume skip messages whose key is the same as that
+	// of a message it returned within this duration. Messages without a key
+	// are never skipped. Batches returned by ConsumeBatch are not deduped.
+	//
+	// Default is 0, which turns deduplication off.
+	DedupeWindow time.Duration
+
+	// DedupeWindowSize limits the number of recently returned keys
+	// remembered for DedupeWindow. The least recently returned keys are
+	// forgotten first, so their duplicates are no longer skipped.
+	//
+	// Default is 10000.
+	DedupeWindowSize int
+
+	// BlockWhenPaused makes Consume and ConsumeBatch of a paused consumer
+	// wait for Resume instead of returning ErrConsumerPaused.
+	//
+	// Default is false.
+	BlockWhenPaused bool
+
+	// CommitEveryMessage makes Consume commit the offset following every
+	// message with Coordinator before returning it, which trades throughput
+	// for durability. If the commit fails, Consume returns its error and the
+	// message is returned again by the next call. Batches returned by
+	// ConsumeBatch are not committed.
+	//
+	// Default is false.
+	CommitEveryMessage bool
+
+	// Coordinator commits the offsets for CommitEveryMessage, which requires
+	// it to be set.
+	//
+	// Default is nil.
+	Coordinator OffsetCoordinator
+
+	// OnIdle, if set, is called with the time since messages were last
+	// fetched, or since the consumer was created, each time another
+	// IdleThreshold passes without any. This tells partitions that stopped
+	// receiving messages from consumers that are stuck. It is called from
+	// within Consume and ConsumeBatch, so only while they wait for data.
+	//
+	// Default is nil.
+	OnIdle func(idle time.Duration)
+
+	// IdleThreshold is how long the consumer has to go without messages for
+	// OnIdle to be called. It is required with OnIdle.
+	//
+	// Default is 0.
+	IdleThreshold time.Duration
+}
+
+// NewConsumerConf returns the default consumer configuration.
+func NewConsumerConf(topic string, partition int32) ConsumerConf {
+	return ConsumerConf{
+		Topic:                topic,
+		Partition:            partition,
+		RequestTimeout:       time.Millisecond * 50,
+		RetryLimit:           -1,
+		RetryWait:            time.Millisecond * 50,
+		RetryErrLimit:        10,
+		RetryErrWait:         time.Millisecond * 500,
+		MinFetchSize:         1,
+		MaxFetchSize:         2000000,
+		StartOffset:          StartOffsetOldest,
+		MinAdaptiveFetchSize: 65536,
+		IsolationLevel:       proto.IsolationLevelReadUncommitted,
+		DedupeWindowSize:     10000,
+	}
+}
+
+// Validate returns an error if the configuration cannot be used to consume
+// messages.
+func (conf ConsumerConf) Validate() error {
+	if conf.Topic == "" {
+		return errors.New("invalid Topic: must not be empty")
+	}
+	if conf.Partition < 0 {
+		return fmt.Errorf("invalid Partition %d: must not be negative", conf.Partition)
+	}
+	if conf.RetryLimit < -1 {
+		return fmt.Errorf("invalid RetryLimit %d: must be -1 or more", conf.RetryLimit)
+	}
+	if conf.RetryWaitJitter < 0 || conf.RetryWaitJitter > 1 {
+		return fmt.Errorf("invalid RetryWaitJitter %g: must be between 0 and 1", conf.RetryWaitJitter)
+	}
+	if conf.RetryErrLimit <= 0 {
+		return fmt.Errorf("invalid RetryErrLimit %d: must be positive", conf.RetryErrLimit)
+	}
+	if conf.MinFetchSize < 0 {
+		return fmt.Errorf("invalid MinFetchSize %d: must not be negative", conf.MinFetchSize)
+	}
+	if conf.MaxFetchSize < messageOverhead {
+		return fmt.Errorf("invalid MaxFetchSize %d: must fit a message of at least %d bytes",
+			conf.MaxFetchSize, messageOverhead)
+	}
+	if conf.AdaptiveFetchSize && conf.MinAdaptiveFetchSize < messageOverhead {
+		return fmt.Errorf("invalid MinAdaptiveFetchSize %d: must fit a message of at least %d bytes",
+			conf.MinAdaptiveFetchSize, messageOverhead)
+	}
+	switch conf.StartOffset {
+	case StartOffsetOldest, StartOffsetNewest, StartFromRelative:
+	default:
+		if conf.StartOffset < 0 {
+			return fmt.Errorf("invalid StartOffset %d", conf.StartOffset)
+		}
+	}
+	if conf.StartOffset == StartFromRelative && conf.RelativeOffset < 0 {
+		return fmt.Errorf("invalid RelativeOffset %d: must not be negative", conf.RelativeOffset)
+	}
+	switch conf.IsolationLevel {
+	case proto.IsolationLevelReadUncommitted, proto.IsolationLevelReadCommitted:
+	default:
+		return fmt.Errorf("invalid IsolationLevel %d", conf.IsolationLevel)
+	}
+	if conf.MaxMessagesPerSecond < 0 {
+		return fmt.Errorf("invalid MaxMessagesPerSecond %d: must not be negative", conf.MaxMessagesPerSecond)
+	}
+	if conf.MaxRecordsPerFetch < 0 {
+		return fmt.Errorf("invalid MaxRecordsPerFetch %d: must not be negative", conf.MaxRecordsPerFetch)
+	}
+	if conf.DedupeWindow > 0 && conf.DedupeWindowSize <= 0 {
+		return fmt.Errorf("invalid DedupeWindowSize %d: must be positive with DedupeWindow set", conf.DedupeWindowSize)
+	}
+	if conf.CommitEveryMessage && conf.Coordinator == nil {
+		return errors.New("invalid Coordinator: must be set with CommitEveryMessage")
+	}
+	if conf.OnIdle != nil && conf.IdleThreshold <= 0 {
+		return fmt.Errorf("invalid IdleThreshold %s: must be positive with OnIdle set", conf.IdleThreshold)
+	}
+	return validateDurations(
+		durationField{"RequestTimeout", conf.RequestTimeout},
+		durationField{"RetryWait", conf.RetryWait},
+		durationField{"RetryErrWait", conf.RetryErrWait},
+		durationField{"ConsumeDeadline", conf.ConsumeDeadline},
+		durationField{"DedupeWindow", conf.DedupeWindow},
+		durationField{"IdleThreshold", conf.IdleThreshold},
+	)
+}
+
+// Consumer represents a single partition reading buffer. Consumer is also
+// providing limited failure handling and message filtering.
+type consumer struct {
+	broker *Broker
+	conf   ConsumerConf
+
+	// mu protects the following and must not be used outside of consumer.
+	mu     *sync.Mutex
+	offset int64 // offset of next NOT consumed message
+	msgbuf []*proto.Message
+	limit  *rateLimiter
+	dedupe *keyDeduper
+
+	malformed     int64 // number of skipped malformed messages
+	lastMalformed int64 // highest offset counted in malformed, or -1
+	readReplica   int32 // node to fetch from instead of the leader, or -1
+	logStart      int64 // log start offset reported by the last fetch, or -1
+	fetchSize     int32 // size to fetch with AdaptiveFetchSize set
+
+	idleSince    time.Time     // when messages were last fetched
+	idleReported time.Duration // idle time last passed to OnIdle
+
+	// pauseMu protects the pause state. It is separate from mu, so that
+	// Resume can be called while Consume waits holding mu.
+	pauseMu sync.Mutex
+	paused  bool
+	resumed chan struct{} // closed by Resume
+}
+
+// Consumer creates a new consumer instance, bound to the broker.
+func (b *Broker) Consumer(conf ConsumerConf) (Consumer, error) {
+	return b.consumer(conf)
+}
+
+// BatchConsumer creates a new BatchConsumer instance, bound to the broker.
 func (b *Broker) BatchConsumer(conf ConsumerConf) (BatchConsumer, error) {
 	return b.consumer(conf)
 }
 
 func (b *Broker) consumer(conf ConsumerConf) (*consumer, error) {
-	offset := conf.StartOffset
-	if offset < 0 {
-		switch offset {
-		case StartOffsetNewest:
-			off, err := b.OffsetLatest(conf.Topic, conf.Partition)
-			if err != nil {
-				return nil, err
-			}
-			offset = off
-		case StartOffsetOldest:
-			off, err := b.OffsetEarliest(conf.Topic, conf.Partition)
-			if err != nil {
-				return nil, err
-			}
-			offset = off
-		default:
-			return nil, fmt.Errorf("invalid start offset: %d", conf.StartOffset)
-		}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	var offset int64
+	var err error
+	if conf.StartOffset == StartFromRelative {
+		offset, err = b.relativeOffset(conf.Topic, conf.Partition, conf.RelativeOffset)
+	} else {
+		offset, err = b.startOffset(conf.Topic, conf.Partition, conf.StartOffset)
+	}
+	if err != nil {
+		return nil, err
 	}
 	c := &consumer{
-		broker: b,
-		mu:     &sync.Mutex{},
-		conf:   conf,
-		msgbuf: make([]*proto.Message, 0),
-		offset: offset,
+		broker:        b,
+		mu:            &sync.Mutex{},
+		conf:          conf,
+		msgbuf:        make([]*proto.Message, 0),
+		offset:        offset,
+		limit:         newRateLimiter(conf.MaxMessagesPerSecond, b.clock),
+		dedupe:        newKeyDeduper(conf.DedupeWindow, conf.DedupeWindowSize, b.clock),
+		readReplica:   -1,
+		logStart:      -1,
+		lastMalformed: -1,
+		fetchSize:     conf.MaxFetchSize,
+		idleSince:     b.clock.Now(),
+	}
+	if conf.AdaptiveFetchSize && conf.MinAdaptiveFetchSize < conf.MaxFetchSize {
+		c.fetchSize = conf.MinAdaptiveFetchSize
 	}
 	return c, nil
 }
 
+// relativeOffset returns the offset n messages before the high watermark of
+// given partition, but not before its oldest message.
+func (b *Broker) relativeOffset(topic string, partition int32, n int64) (int64, error) {
+	if n < 0 {
+		return 0, fmt.Errorf("invalid relative offset: %d", n)
+	}
+	latest, err := b.OffsetLatest(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	earliest, err := b.OffsetEarliest(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	if offset := latest - n; offset > earliest {
+		return offset, nil
+	}
+	return earliest, nil
+}
+
+// startOffset resolves StartOffsetNewest and StartOffsetOldest to the actual
+// offset of given partition. Any other offset is returned unchanged.
+func (b *Broker) startOffset(topic string, partition int32, offset int64) (int64, error) {
+	if offset >= 0 {
+		return offset, nil
+	}
+	switch offset {
+	case StartOffsetNewest:
+		return b.OffsetLatest(topic, partition)
+	case StartOffsetOldest:
+		return b.OffsetEarliest(topic, partition)
+	default:
+		return 0, fmt.Errorf("invalid start offset: %d", offset)
+	}
+}
+
 // consume is returning a batch of messages from consumed partition.
 // Consumer can retry fetching messages even if responses return no new
 // data. Retry behaviour can be configured through RetryLimit and RetryWait
@@ -731,84 +2377,622 @@ func (b *Broker) consumer(conf ConsumerConf) (*consumer, error) {
 // consume can retry sending request on common errors. This behaviour can
 // be configured with RetryErrLimit and RetryErrWait consumer configuration
 // attributes.
-func (c *consumer) consume() ([]*proto.Message, error) {
+//
+// No data retries stop once ConsumeDeadline passes.
+func (c *consumer) consume(ctx context.Context) ([]*proto.Message, error) {
+	var deadline time.Time
+	if c.conf.ConsumeDeadline > 0 {
+		deadline = c.broker.clock.Now().Add(c.conf.ConsumeDeadline)
+	}
+
 	var msgbuf []*proto.Message
 	var retry int
 	for len(msgbuf) == 0 {
 		var err error
-		msgbuf, err = c.fetch()
+		msgbuf, err = c.fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(msgbuf) == 0 {
+			c.checkIdle()
+			retry++
+			if c.conf.RetryLimit != -1 && retry > c.conf.RetryLimit {
+				return nil, ErrNoData
+			}
+			wait := c.retryWait()
+			if !deadline.IsZero() {
+				left := deadline.Sub(c.broker.clock.Now())
+				if left <= 0 {
+					return nil, ErrNoData
+				}
+				if wait > left {
+					wait = left
+				}
+			}
+			if wait > 0 {
+				if err := c.broker.clock.SleepCtx(ctx, wait); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	c.idleSince = c.broker.clock.Now()
+	c.idleReported = 0
+	return msgbuf, nil
+}
+
+// checkIdle calls OnIdle if another IdleThreshold passed since messages were
+// last fetched.
+func (c *consumer) checkIdle() {
+	if c.conf.OnIdle == nil {
+		return
+	}
+	idle := c.broker.clock.Now().Sub(c.idleSince)
+	if idle-c.idleReported >= c.conf.IdleThreshold {
+		c.idleReported = idle
+		c.conf.OnIdle(idle)
+	}
+}
+
+// retryWait returns how long to wait before refetching after a fetch returned
+// no data, applying RetryWaitJitter to RetryWait.
+func (c *consumer) retryWait() time.Duration {
+	wait := c.conf.RetryWait
+	if jitter := c.conf.RetryWaitJitter; jitter > 0 && wait > 0 {
+		if jitter > 1 {
+			jitter = 1
+		}
+		wait += time.Duration(float64(wait) * jitter * (2*rndFloat64() - 1))
+	}
+	return wait
+}
+
+func (c *consumer) Consume() (*proto.Message, error) {
+	return c.ConsumeCtx(context.Background())
+}
+
+// ConsumeCtx works like Consume, but gives up once ctx is done, returning
+// its error, also while paused, rate limited, or waiting between retries or
+// for a connection. The deadline, if earlier than RequestTimeout, limits how
+// long the broker waits for new messages as well as the read and write
+// deadline of the connection.
+func (c *consumer) ConsumeCtx(ctx context.Context) (*proto.Message, error) {
+	if err := c.waitResumed(ctx); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the token is taken before any message leaves the buffer, so that none
+	// is lost if ctx is done meanwhile
+	if err := c.limit.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	for {
+		if len(c.msgbuf) == 0 {
+			var err error
+			c.msgbuf, err = c.consume(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		msg := c.msgbuf[0]
+		if c.conf.CommitEveryMessage {
+			// committed before the message is taken from the buffer, so
+			// that it is returned again if the commit fails
+			if err := c.conf.Coordinator.Commit(c.conf.Topic, c.conf.Partition, msg.Offset+1); err != nil {
+				return nil, err
+			}
+		}
+		c.msgbuf[0] = nil
+		c.msgbuf = c.msgbuf[1:]
+		c.offset = msg.Offset + 1
+		if c.dedupe.duplicate(msg.Key) {
+			log.Debugf("skipped duplicate key %q of %s:%d at offset %d",
+				msg.Key, c.conf.Topic, c.conf.Partition, msg.Offset)
+			continue
+		}
+
+		return msg, nil
+	}
+}
+
+func (c *consumer) ConsumeBatch() ([]*proto.Message, error) {
+	if err := c.waitResumed(context.Background()); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	batch := c.msgbuf
+	if len(batch) == 0 {
+		var err error
+		batch, err = c.consume(context.Background())
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.msgbuf = make([]*proto.Message, 0)
+	if max := c.conf.MaxRecordsPerFetch; max > 0 && len(batch) > max {
+		c.msgbuf = batch[max:]
+		batch = batch[:max:max]
+	}
+	c.offset = batch[len(batch)-1].Offset + 1
+
+	return batch, nil
+}
+
+func (c *consumer) ConsumeBytes(maxBytes int) ([]*proto.Message, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("invalid byte budget: %d", maxBytes)
+	}
+	if err := c.waitResumed(context.Background()); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	batch := c.msgbuf
+	if len(batch) == 0 {
+		var err error
+		batch, err = c.consume(context.Background())
+		if err != nil {
+			return nil, err
+		}
+	}
+	var n, size int
+	for ; n < len(batch); n++ {
+		msgSize := len(batch[n].Key) + len(batch[n].Value)
+		if n > 0 && size+msgSize > maxBytes {
+			break
+		}
+		size += msgSize
+	}
+	c.msgbuf = batch[n:]
+	batch = batch[:n:n]
+	c.offset = batch[n-1].Offset + 1
+
+	return batch, nil
+}
+
+func (c *consumer) Offset() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.offset
+}
+
+// buffered returns the number of fetched messages not consumed yet.
+func (c *consumer) buffered() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.msgbuf)
+}
+
+func (c *consumer) LogStartOffset() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.logStart
+}
+
+func (c *consumer) Pause() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+
+	if !c.paused {
+		c.paused = true
+		c.resumed = make(chan struct{})
+	}
+}
+
+func (c *consumer) Resume() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+
+	if c.paused {
+		c.paused = false
+		close(c.resumed)
+	}
+}
+
+// waitResumed returns ErrConsumerPaused if the consumer is paused, or waits
+// until it is resumed or ctx is done if BlockWhenPaused is set.
+func (c *consumer) waitResumed(ctx context.Context) error {
+	for {
+		c.pauseMu.Lock()
+		paused, resumed := c.paused, c.resumed
+		c.pauseMu.Unlock()
+
+		if !paused {
+			return nil
+		}
+		if !c.conf.BlockWhenPaused {
+			return ErrConsumerPaused
+		}
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *consumer) SeekToOffset(offset int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	off, err := c.broker.startOffset(c.conf.Topic, c.conf.Partition, offset)
+	if err != nil {
+		return err
+	}
+	oldOffset := c.offset
+	c.offset = off
+	c.msgbuf = make([]*proto.Message, 0)
+	log.Infof("SeekToOffset moving [%s:%d] offset %d -> %d.",
+		c.conf.Topic, c.conf.Partition, oldOffset, c.offset)
+	return nil
+}
+
+func (c *consumer) SeekToLatest() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	off, err := c.broker.OffsetLatest(c.conf.Topic, c.conf.Partition)
+	if err != nil {
+		return err
+	}
+	oldOffset := c.offset
+	c.offset = off
+	c.msgbuf = make([]*proto.Message, 0)
+	log.Infof("SeekToLatest moving [%s:%d] offset %d -> %d.",
+		c.conf.Topic, c.conf.Partition, oldOffset, c.offset)
+	return nil
+}
+
+func (c *consumer) StartFromCommittedPlus(coord OffsetCoordinator, skip int64) error {
+	if skip < 0 {
+		return fmt.Errorf("invalid skip: %d", skip)
+	}
+	committed, _, err := coord.Offset(c.conf.Topic, c.conf.Partition)
+	if err != nil {
+		return err
+	}
+	if committed < 0 {
+		return fmt.Errorf("no offset committed for %s:%d", c.conf.Topic, c.conf.Partition)
+	}
+	return c.SeekToOffset(committed + skip)
+}
+
+func (c *consumer) Reassign(partition int32, startOffset int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.broker.cluster.GetEndpoint(c.conf.Topic, partition); err != nil {
+		return proto.ErrUnknownTopicOrPartition
+	}
+	off, err := c.broker.startOffset(c.conf.Topic, partition, startOffset)
+	if err != nil {
+		return err
+	}
+	log.Infof("Reassign moving [%s:%d] offset %d -> [%s:%d] offset %d.",
+		c.conf.Topic, c.conf.Partition, c.offset, c.conf.Topic, partition, off)
+	c.conf.Partition = partition
+	c.offset = off
+	c.msgbuf = make([]*proto.Message, 0)
+	c.dedupe = newKeyDeduper(c.conf.DedupeWindow, c.conf.DedupeWindowSize, c.broker.clock)
+	c.readReplica = -1
+	c.logStart = -1
+	return nil
+}
+
+func (c *consumer) TailN(n int) ([]*proto.Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n <= 0 {
+		return nil, nil
+	}
+	latest, err := c.broker.OffsetLatest(c.conf.Topic, c.conf.Partition)
+	if err != nil {
+		return nil, err
+	}
+	earliest, err := c.broker.OffsetEarliest(c.conf.Topic, c.conf.Partition)
+	if err != nil {
+		return nil, err
+	}
+	offset := latest - int64(n)
+	if offset < earliest {
+		offset = earliest
+	}
+
+	msgs, err := c.fetchRange(offset, latest)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs, nil
+}
+
+func (c *consumer) ConsumeRange(start, end int64) ([]*proto.Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("invalid offset range: %d-%d", start, end)
+	}
+	msgs, err := c.fetchRange(start, end)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("ConsumeRange moving [%s:%d] offset %d -> %d.",
+		c.conf.Topic, c.conf.Partition, c.offset, end)
+	c.offset = end
+	c.msgbuf = make([]*proto.Message, 0)
+	return msgs, nil
+}
+
+func (c *consumer) ConsumeTimeRange(from, to time.Time) ([]*proto.Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if to.Before(from) {
+		return nil, fmt.Errorf("invalid time range: %s-%s", from, to)
+	}
+	latest, err := c.broker.OffsetLatest(c.conf.Topic, c.conf.Partition)
+	if err != nil {
+		return nil, err
+	}
+	start, err := c.broker.OffsetForTime(c.conf.Topic, c.conf.Partition, from)
+	if err != nil {
+		return nil, err
+	}
+	if start < 0 {
+		// no message is that recent
+		start = latest
+	}
+
+	msgs := make([]*proto.Message, 0)
+	offset := start
+timeRangeLoop:
+	for offset < latest {
+		// record batches always carry timestamps, older formats may not
+		batch, err := c.fetchFrom(context.Background(), offset, 4)
+		if err != nil {
+			return nil, err
+		}
+		next := offset
+		for _, msg := range batch {
+			if msg.Offset < next {
+				continue
+			}
+			if msg.Timestamp.After(to) {
+				offset = msg.Offset
+				break timeRangeLoop
+			}
+			// timestamps are not guaranteed to be monotonic
+			if !msg.Timestamp.Before(from) {
+				msgs = append(msgs, msg)
+			}
+			next = msg.Offset + 1
+		}
+		if next == offset {
+			break
+		}
+		offset = next
+	}
+
+	log.Infof("ConsumeTimeRange moving [%s:%d] offset %d -> %d.",
+		c.conf.Topic, c.conf.Partition, c.offset, offset)
+	c.offset = offset
+	c.msgbuf = make([]*proto.Message, 0)
+	return msgs, nil
+}
+
+func (c *consumer) StreamRaw(w io.Writer, from, to int64) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if from < 0 || to < from {
+		return 0, fmt.Errorf("invalid offset range: %d-%d", from, to)
+	}
+	var written int64
+	for offset := from; offset < to; {
+		raw, err := c.fetchRawFrom(offset)
+		if err != nil {
+			return written, err
+		}
+		entries := proto.RawEntries(raw)
+		if len(entries) == 0 {
+			if len(raw) > 0 {
+				return written, fmt.Errorf("entry at offset %d does not fit into MaxFetchSize %d",
+					offset, c.conf.MaxFetchSize)
+			}
+			// nothing more to read
+			break
+		}
+		next := offset
+		for _, e := range entries {
+			// record batches and compressed message sets can start before
+			// the requested offset
+			if e.LastOffset < next {
+				continue
+			}
+			if next >= to {
+				break
+			}
+			n, err := w.Write(e.Data)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+			next = e.LastOffset + 1
+		}
+		if next == offset {
+			break
+		}
+		offset = next
+	}
+	return written, nil
+}
+
+// fetchRawFrom sends a fetch request for the message set starting at offset
+// and returns it undecoded, retrying like fetchFrom does.
+func (c *consumer) fetchRawFrom(offset int64) ([]byte, error) {
+	req := proto.FetchReq{
+		ClientID:    c.broker.conf.ClientID,
+		MaxWaitTime: c.conf.RequestTimeout,
+		MinBytes:    c.conf.MinFetchSize,
+		Topics: []proto.FetchReqTopic{
+			{
+				Name: c.conf.Topic,
+				Partitions: []proto.FetchReqPartition{
+					{
+						ID:          c.conf.Partition,
+						FetchOffset: offset,
+						MaxBytes:    c.conf.MaxFetchSize,
+					},
+				},
+			},
+		},
+	}
+	var version int16
+	if c.conf.IsolationLevel == proto.IsolationLevelReadCommitted {
+		version = 4
+	}
+	req.Version = c.broker.apiVersion(proto.FetchReqKind, version)
+	if req.Version >= 3 {
+		req.MaxBytes = c.conf.MaxFetchSize
+	}
+	if req.Version >= 4 {
+		req.IsolationLevel = c.conf.IsolationLevel
+	}
+
+	var resErr error
+	retry := &backoff.Backoff{Min: c.conf.RetryErrWait, Jitter: true}
+fetchRawRetryLoop:
+	for try := 0; try < c.conf.RetryErrLimit; try++ {
+		if try != 0 {
+			c.broker.clock.Sleep(retry.Duration())
+		}
+
+		conn, _, err := c.fetchConnection(context.Background())
 		if err != nil {
-			return nil, err
+			resErr = err
+			continue
 		}
-		if len(msgbuf) == 0 {
-			retry++
-			if c.conf.RetryLimit != -1 && retry > c.conf.RetryLimit {
-				return nil, ErrNoData
-			}
-			if c.conf.RetryWait > 0 {
-				time.Sleep(c.conf.RetryWait)
+		defer func(lconn *connection) { go c.broker.conns.Idle(lconn) }(conn)
+
+		resp, err := conn.fetchRaw(context.Background(), &req)
+		if err != nil {
+			log.Debugf("cannot fetch raw messages (try %d): %s", try, err)
+			_ = conn.Close()
+			resErr = err
+			continue
+		}
+		for _, t := range resp.Topics {
+			for _, p := range t.Partitions {
+				if t.Name != c.conf.Topic || p.ID != c.conf.Partition {
+					log.Warningf("fetch response with unexpected data for %s:%d",
+						t.Name, p.ID)
+					continue
+				}
+				switch p.Err {
+				case proto.ErrLeaderNotAvailable, proto.ErrNotLeaderForPartition,
+					proto.ErrBrokerNotAvailable, proto.ErrUnknownTopicOrPartition:
+					log.Warningf("cannot fetch raw messages (try %d): %s", try, p.Err)
+					if err := c.broker.cluster.RefreshMetadata(); err != nil {
+						log.Warningf("cannot refresh metadata: %s", err)
+					}
+					resErr = p.Err
+					continue fetchRawRetryLoop
+				}
+				return p.RawMessages, p.Err
 			}
 		}
+		return nil, errors.New("incomplete fetch response")
 	}
 
-	return msgbuf, nil
+	return nil, resErr
 }
 
-func (c *consumer) Consume() (*proto.Message, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if len(c.msgbuf) == 0 {
-		var err error
-		c.msgbuf, err = c.consume()
+// fetchRange returns messages with offsets from start up to, but excluding,
+// end, sending as many fetch requests as needed. Fewer messages are returned
+// when the partition does not hold that many.
+func (c *consumer) fetchRange(start, end int64) ([]*proto.Message, error) {
+	msgs := make([]*proto.Message, 0, end-start)
+	for offset := start; offset < end; {
+		batch, err := c.fetchFrom(context.Background(), offset, 0)
 		if err != nil {
 			return nil, err
 		}
+		next := offset
+		for _, msg := range batch {
+			// compressed message sets can start before the requested offset
+			if msg.Offset >= next && msg.Offset < end {
+				msgs = append(msgs, msg)
+				next = msg.Offset + 1
+			}
+		}
+		if next == offset {
+			// nothing more to read, the log might have been truncated
+			break
+		}
+		offset = next
 	}
-
-	msg := c.msgbuf[0]
-	c.msgbuf[0] = nil
-	c.msgbuf = c.msgbuf[1:]
-	c.offset = msg.Offset + 1
-	return msg, nil
+	return msgs, nil
 }
 
-func (c *consumer) ConsumeBatch() ([]*proto.Message, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	batch, err := c.consume()
-	if err != nil {
-		return nil, err
-	}
-	c.offset = batch[len(batch)-1].Offset + 1
-
-	return batch, nil
+// fetch and return next batch of messages. In case of certain set of errors,
+// retry sending fetch request. Retry behaviour can be configured with
+// RetryErrLimit and RetryErrWait consumer configuration attributes.
+func (c *consumer) fetch(ctx context.Context) ([]*proto.Message, error) {
+	return c.fetchFrom(ctx, c.offset, 0)
 }
 
-func (c *consumer) SeekToLatest() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	off, err := c.broker.OffsetLatest(c.conf.Topic, c.conf.Partition)
-	if err != nil {
-		return err
+// maxMalformedSkips limits how many fetches in a row fetchFrom sends when
+// every one of them returns nothing but malformed messages.
+const maxMalformedSkips = 64
+
+// fetchFrom works like fetch, but reads messages starting at given offset
+// instead of the consumer's offset, using at least the given fetch request
+// version. Fetches returning nothing but malformed messages are repeated from
+// the offset following them, up to maxMalformedSkips times.
+func (c *consumer) fetchFrom(ctx context.Context, offset int64, version int16) ([]*proto.Message, error) {
+	for skips := 0; ; skips++ {
+		msgs, next, err := c.fetchOnce(ctx, offset, version)
+		if err != nil || len(msgs) > 0 || next <= offset {
+			return msgs, err
+		}
+		if skips >= maxMalformedSkips {
+			return nil, fmt.Errorf("%d fetches of %s:%d returned only malformed messages, up to offset %d",
+				skips+1, c.conf.Topic, c.conf.Partition, next-1)
+		}
+		offset = next
 	}
-	oldOffset := c.offset
-	c.offset = off
-	c.msgbuf = make([]*proto.Message, 0)
-	log.Infof("SeekToLatest moving [%s:%d] offset %d -> %d.",
-		c.conf.Topic, c.conf.Partition, oldOffset, c.offset)
-	return nil
 }
 
-// fetch and return next batch of messages. In case of certain set of errors,
-// retry sending fetch request. Retry behaviour can be configured with
-// RetryErrLimit and RetryErrWait consumer configuration attributes.
-func (c *consumer) fetch() ([]*proto.Message, error) {
+// fetchOnce sends a fetch request for messages starting at given offset,
+// retrying on errors like fetch does. Besides the messages it returns the
+// offset following the malformed messages of the response if there is
+// nothing else, or the given offset otherwise.
+func (c *consumer) fetchOnce(ctx context.Context, offset int64, version int16) ([]*proto.Message, int64, error) {
+	fetchSize := c.conf.MaxFetchSize
+	if c.conf.AdaptiveFetchSize {
+		fetchSize = c.fetchSize
+	}
 	req := proto.FetchReq{
 		ClientID:    c.broker.conf.ClientID,
-		MaxWaitTime: c.conf.RequestTimeout,
+		MaxWaitTime: requestTimeout(ctx, c.conf.RequestTimeout),
 		MinBytes:    c.conf.MinFetchSize,
 		Topics: []proto.FetchReqTopic{
 			{
@@ -816,35 +3000,74 @@ func (c *consumer) fetch() ([]*proto.Message, error) {
 				Partitions: []proto.FetchReqPartition{
 					{
 						ID:          c.conf.Partition,
-						FetchOffset: c.offset,
-						MaxBytes:    c.conf.MaxFetchSize,
+						FetchOffset: offset,
+						MaxBytes:    fetchSize,
 					},
 				},
 			},
 		},
 	}
+	if c.conf.IsolationLevel == proto.IsolationLevelReadCommitted && version < 4 {
+		// isolation level is supported starting with version 4
+		version = 4
+	}
+	if c.conf.RackID != "" && version < 11 {
+		// preferred read replicas are supported starting with version 11
+		version = 11
+	}
+	req.Version = c.broker.apiVersion(proto.FetchReqKind, version)
+	if req.Version >= 3 {
+		req.MaxBytes = fetchSize
+	}
+	if req.Version >= 4 {
+		req.IsolationLevel = c.conf.IsolationLevel
+	}
+	if req.Version >= 11 {
+		req.RackID = c.conf.RackID
+	}
 
 	var resErr error
+	var leaderMoving bool
 	retry := &backoff.Backoff{Min: c.conf.RetryErrWait, Jitter: true}
 consumeRetryLoop:
 	for try := 0; try < c.conf.RetryErrLimit; try++ {
 		if try != 0 {
-			time.Sleep(retry.Duration())
+			if err := c.broker.clock.SleepCtx(ctx, retry.Duration()); err != nil {
+				return nil, offset, err
+			}
 		}
 
-		conn, err := c.broker.leaderConnection(c.conf.Topic, c.conf.Partition)
+		conn, nodeID, err := c.fetchConnection(ctx)
+		if err == context.DeadlineExceeded || err == context.Canceled {
+			return nil, offset, err
+		}
 		if err != nil {
 			resErr = err
 			continue
 		}
 		defer func(lconn *connection) { go c.broker.conns.Idle(lconn) }(conn)
 
-		resp, err := conn.Fetch(&req)
+		resp, err := conn.fetch(ctx, &req, c.conf.SkipMalformed)
+		if err == context.DeadlineExceeded || err == context.Canceled {
+			// the connection was closed, there is no point in retrying
+			return nil, offset, err
+		}
 		resErr = err
+		if err != nil && c.readReplica >= 0 {
+			// go back to the leader, it will suggest a replica again
+			c.readReplica = -1
+		}
 		if _, ok := err.(*net.OpError); ok || err == io.EOF || err == syscall.EPIPE {
 			log.Debugf("connection died while fetching messages from %s:%d: %s",
 				c.conf.Topic, c.conf.Partition, err)
 			_ = conn.Close()
+			if leaderMoving {
+				// the leader closed the connection as part of a controlled
+				// shutdown, so the metadata refreshed before is stale
+				if err := c.broker.cluster.RefreshMetadata(); err != nil {
+					log.Warningf("cannot refresh metadata: %s", err)
+				}
+			}
 			continue
 		}
 
@@ -853,6 +3076,9 @@ consumeRetryLoop:
 			_ = conn.Close()
 			continue
 		}
+		if c.conf.OnServed != nil {
+			c.conf.OnServed(c.conf.Topic, c.conf.Partition, nodeID)
+		}
 
 		// Should only be a single topic/partition in the response, the one we asked about.
 		for _, t := range resp.Topics {
@@ -862,6 +3088,25 @@ consumeRetryLoop:
 						t.Name, p.ID)
 					continue
 				}
+				if req.Version >= 5 {
+					c.logStart = p.LogStartOffset
+				}
+				if c.conf.AdaptiveFetchSize && p.Err == nil {
+					c.tuneFetchSize(fetchSize, messageSetSize(p.Messages))
+				}
+
+				if p.Err != nil && c.readReplica >= 0 {
+					log.Warningf("cannot fetch messages from replica %d (try %d): %s",
+						c.readReplica, try, p.Err)
+					c.readReplica = -1
+					resErr = p.Err
+					continue consumeRetryLoop
+				}
+				if req.Version >= 11 && p.PreferredReadReplica >= 0 && p.PreferredReadReplica != nodeID {
+					log.Debugf("fetching %s:%d from preferred replica %d",
+						t.Name, p.ID, p.PreferredReadReplica)
+					c.readReplica = p.PreferredReadReplica
+				}
 
 				switch p.Err {
 				case proto.ErrLeaderNotAvailable, proto.ErrNotLeaderForPartition,
@@ -872,15 +3117,101 @@ consumeRetryLoop:
 					if err := c.broker.cluster.RefreshMetadata(); err != nil {
 						log.Warningf("cannot refresh metadata: %s", err)
 					}
+					leaderMoving = isLeaderMoveError(p.Err)
 					continue consumeRetryLoop
 				}
-				return p.Messages, p.Err
+				next := offset
+				counted := c.lastMalformed
+				for i, off := range p.MalformedOffsets {
+					if off >= next {
+						next = off + 1
+					}
+					// responses can repeat messages before the requested
+					// offset, or ones already counted by an earlier fetch
+					if off < offset || off <= counted || containsOffset(p.MalformedOffsets[:i], off) {
+						continue
+					}
+					if off > c.lastMalformed {
+						c.lastMalformed = off
+					}
+					c.malformed++
+					log.Warningf("skipped malformed message %s:%d at offset %d (%d skipped so far)",
+						t.Name, p.ID, off, c.malformed)
+				}
+				if len(p.Messages) > 0 || p.Err != nil {
+					next = offset
+				}
+				return p.Messages, next, p.Err
 			}
 		}
-		return nil, errors.New("incomplete fetch response")
+		return nil, offset, errors.New("incomplete fetch response")
 	}
 
-	return nil, resErr
+	return nil, offset, resErr
+}
+
+// containsOffset returns true if offsets holds offset.
+func containsOffset(offsets []int64, offset int64) bool {
+	for _, off := range offsets {
+		if off == offset {
+			return true
+		}
+	}
+	return false
+}
+
+// messageOverhead is the size of the offset, size, crc, magic, attributes,
+// timestamp and key and value lengths of a message set entry.
+const messageOverhead = 34
+
+// messageSetSize estimates the size in bytes the messages took in a fetch
+// response, which is not kept when decoding. Compressed messages are counted
+// as if they were not.
+func messageSetSize(messages []*proto.Message) int32 {
+	var size int64
+	for _, msg := range messages {
+		size += messageOverhead + int64(len(msg.Key)) + int64(len(msg.Value))
+	}
+	if size > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int32(size)
+}
+
+// tuneFetchSize adjusts the size of the next fetch based on the size of the
+// messages returned for a fetch of fetched bytes, see AdaptiveFetchSize.
+func (c *consumer) tuneFetchSize(fetched, returned int32) {
+	switch {
+	case int64(returned)*4 >= int64(fetched)*3:
+		if c.fetchSize = fetched * 2; c.fetchSize > c.conf.MaxFetchSize || c.fetchSize < fetched {
+			c.fetchSize = c.conf.MaxFetchSize
+		}
+	case int64(returned)*4 < int64(fetched):
+		if c.fetchSize = fetched / 2; c.fetchSize < c.conf.MinAdaptiveFetchSize {
+			c.fetchSize = c.conf.MinAdaptiveFetchSize
+		}
+	}
+}
+
+// fetchConnection returns a connection to the preferred read replica if the
+// leader suggested one and it can be connected to, and to the leader of the
+// partition otherwise, together with the ID of the node connected to.
+func (c *consumer) fetchConnection(ctx context.Context) (*connection, int32, error) {
+	if c.readReplica >= 0 {
+		if addr := c.broker.cluster.GetNodeAddress(c.readReplica); addr != "" {
+			conn, err := c.broker.conns.GetConnectionByAddrCtx(ctx, addr)
+			if err == nil {
+				return conn, c.readReplica, nil
+			}
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, 0, ctxErr
+			}
+			log.Warningf("cannot connect to replica %d of %s:%d: %s",
+				c.readReplica, c.conf.Topic, c.conf.Partition, err)
+		}
+		c.readReplica = -1
+	}
+	return c.broker.connectToLeader(ctx, c.conf.Topic, c.conf.Partition, false)
 }
 
 // OffsetCoordinatorConf is configuration for the offset coordinatior.
@@ -893,6 +3224,15 @@ type OffsetCoordinatorConf struct {
 	// RetryErrWait controls wait duration between retries after failed fetch
 	// request. By default 500ms.
 	RetryErrWait time.Duration
+
+	// GenerationID and MemberID identify the consumer group member
+	// committing, as assigned when it joined the group. Commits of a member
+	// fenced out by a rebalance then fail with proto.ErrIllegalGeneration or
+	// proto.ErrUnknownMemberID instead of overwriting the offsets committed
+	// by the new owner of the partition. By default MemberID is empty, which
+	// commits without group membership.
+	GenerationID int32
+	MemberID     string
 }
 
 // NewOffsetCoordinatorConf returns default OffsetCoordinator configuration.
@@ -901,7 +3241,20 @@ func NewOffsetCoordinatorConf(consumerGroup string) OffsetCoordinatorConf {
 		ConsumerGroup: consumerGroup,
 		RetryErrLimit: 10,
 		RetryErrWait:  time.Millisecond * 500,
+		GenerationID:  -1,
+	}
+}
+
+// Validate returns an error if the configuration cannot be used to manage
+// offsets.
+func (conf OffsetCoordinatorConf) Validate() error {
+	if conf.ConsumerGroup == "" {
+		return errors.New("invalid ConsumerGroup: must not be empty")
 	}
+	if conf.RetryErrLimit <= 0 {
+		return fmt.Errorf("invalid RetryErrLimit %d: must be positive", conf.RetryErrLimit)
+	}
+	return validateDurations(durationField{"RetryErrWait", conf.RetryErrWait})
 }
 
 type offsetCoordinator struct {
@@ -915,18 +3268,35 @@ type offsetCoordinator struct {
 // OffsetCoordinator returns offset management coordinator for single consumer
 // group, bound to broker.
 func (b *Broker) OffsetCoordinator(conf OffsetCoordinatorConf) (OffsetCoordinator, error) {
-	c := &offsetCoordinator{
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return b.offsetCoordinator(conf), nil
+}
+
+// BatchOffsetCoordinator works like OffsetCoordinator, but the returned
+// coordinator can also read offsets of many partitions at once.
+func (b *Broker) BatchOffsetCoordinator(conf OffsetCoordinatorConf) (BatchOffsetCoordinator, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return b.offsetCoordinator(conf), nil
+}
+
+func (b *Broker) offsetCoordinator(conf OffsetCoordinatorConf) *offsetCoordinator {
+	return &offsetCoordinator{
 		broker: b,
 		conf:   conf,
 	}
-	return c, nil
 }
 
 // Commit is saving offset information for given topic and partition.
 //
-// Commit can retry saving offset information on common errors. This behaviour
-// can be configured with with RetryErrLimit and RetryErrWait coordinator
-// configuration attributes.
+// Commit can retry saving offset information on common errors, including
+// proto.ErrGroupLoadInProgress right after a coordinator failover. This
+// behaviour can be configured with with RetryErrLimit and RetryErrWait
+// coordinator configuration attributes. Stale commits of a fenced group
+// member are not retried.
 func (c *offsetCoordinator) Commit(topic string, partition int32, offset int64) error {
 	return c.commit(topic, partition, offset, "")
 }
@@ -955,9 +3325,10 @@ func (c *offsetCoordinator) commit(
 	}
 
 	retry := &backoff.Backoff{Min: c.conf.RetryErrWait, Jitter: true}
+commitRetryLoop:
 	for try := 0; try < c.conf.RetryErrLimit; try++ {
 		if try != 0 {
-			time.Sleep(retry.Duration())
+			c.broker.clock.Sleep(retry.Duration())
 		}
 
 		// get a copy of our connection with the lock, this might establish a new
@@ -972,6 +3343,8 @@ func (c *offsetCoordinator) commit(
 		resp, err := conn.OffsetCommit(&proto.OffsetCommitReq{
 			ClientID:      c.broker.conf.ClientID,
 			ConsumerGroup: c.conf.ConsumerGroup,
+			GenerationID:  c.conf.GenerationID,
+			MemberID:      c.conf.MemberID,
 			Topics: []proto.OffsetCommitReqTopic{
 				{
 					Name: topic,
@@ -997,6 +3370,12 @@ func (c *offsetCoordinator) commit(
 							t.Name, p.ID)
 						continue
 					}
+					if p.Err == proto.ErrGroupLoadInProgress {
+						log.Debugf("cannot commit offset for %s yet: %s",
+							c.conf.ConsumerGroup, p.Err)
+						resErr = p.Err
+						continue commitRetryLoop
+					}
 					return p.Err
 				}
 			}
@@ -1009,17 +3388,19 @@ func (c *offsetCoordinator) commit(
 // Offset is returning last offset and metadata information committed for given
 // topic and partition.
 //
-// Offset can retry sending request on common errors. This behaviour can be
-// configured with with RetryErrLimit and RetryErrWait coordinator
-// configuration attributes.
+// Offset can retry sending request on common errors, including
+// proto.ErrGroupLoadInProgress right after a coordinator failover. This
+// behaviour can be configured with with RetryErrLimit and RetryErrWait
+// coordinator configuration attributes.
 func (c *offsetCoordinator) Offset(
 	topic string, partition int32) (
 	offset int64, metadata string, resErr error) {
 
 	retry := &backoff.Backoff{Min: c.conf.RetryErrWait, Jitter: true}
+offsetRetryLoop:
 	for try := 0; try < c.conf.RetryErrLimit; try++ {
 		if try != 0 {
-			time.Sleep(retry.Duration())
+			c.broker.clock.Sleep(retry.Duration())
 		}
 
 		// get a copy of our connection with the lock, this might establish a new
@@ -1057,6 +3438,12 @@ func (c *offsetCoordinator) Offset(
 						continue
 					}
 
+					if p.Err == proto.ErrGroupLoadInProgress {
+						log.Debugf("cannot fetch offset for %s yet: %s",
+							c.conf.ConsumerGroup, p.Err)
+						resErr = p.Err
+						continue offsetRetryLoop
+					}
 					if p.Err != nil {
 						return 0, "", p.Err
 					}
@@ -1078,6 +3465,302 @@ func (c *offsetCoordinator) Offset(
 	return 0, "", resErr
 }
 
+// Offsets returns the last offsets and metadata committed for given partitions
+// of a topic, reading all of them with a single request. Partitions without a
+// committed offset have their Err set to proto.ErrUnknownTopicOrPartition,
+// other errors of single partitions are reported in their OffsetMeta as
+// well. An error is returned only when the request fails as a whole.
+//
+// Offsets retries like Offset does, including when any of the partitions
+// reports proto.ErrGroupLoadInProgress.
+func (c *offsetCoordinator) Offsets(topic string, partitions []int32) (map[int32]OffsetMeta, error) {
+	offsets, err := c.broker.fetchOffsets(c.conf.ConsumerGroup,
+		map[string][]int32{topic: partitions}, c.conf.RetryErrLimit, c.conf.RetryErrWait)
+	if err != nil {
+		return nil, err
+	}
+	return offsets[topic], nil
+}
+
+// fetchOffsets reads the offsets committed by group for the given partitions
+// with a single OffsetFetch request to the group's coordinator. The request is
+// sent up to retryLimit times, waiting retryWait with a growing backoff in
+// between, while it fails or any partition reports
+// proto.ErrGroupLoadInProgress. Partitions without a committed offset or
+// missing from the response have their Err set to
+// proto.ErrUnknownTopicOrPartition, so every requested partition is in the
+// result.
+func (b *Broker) fetchOffsets(
+	group string, topicPartitions map[string][]int32, retryLimit int, retryWait time.Duration) (
+	map[string]map[int32]OffsetMeta, error) {
+
+	req := &proto.OffsetFetchReq{
+		ClientID:      b.conf.ClientID,
+		ConsumerGroup: group,
+		Topics:        make([]proto.OffsetFetchReqTopic, 0, len(topicPartitions)),
+	}
+	for topic, partitions := range topicPartitions {
+		req.Topics = append(req.Topics, proto.OffsetFetchReqTopic{
+			Name:       topic,
+			Partitions: partitions,
+		})
+	}
+
+	var resErr error
+	retry := &backoff.Backoff{Min: retryWait, Jitter: true}
+offsetsRetryLoop:
+	for try := 0; try < retryLimit; try++ {
+		if try != 0 {
+			b.clock.Sleep(retry.Duration())
+		}
+
+		conn, err := b.coordinatorConnection(group)
+		if conn == nil {
+			resErr = err
+			continue
+		}
+		defer func(lconn *connection) { go b.conns.Idle(lconn) }(conn)
+
+		resp, err := conn.OffsetFetch(req)
+		resErr = err
+
+		switch err {
+		case io.EOF, syscall.EPIPE:
+			log.Debugf("connection died while fetching offsets for %s: %s", group, err)
+			_ = conn.Close()
+
+		case nil:
+			offsets := make(map[string]map[int32]OffsetMeta, len(topicPartitions))
+			for _, t := range resp.Topics {
+				if _, ok := topicPartitions[t.Name]; !ok {
+					log.Warningf("offset response with unexpected topic %s", t.Name)
+					continue
+				}
+				if offsets[t.Name] == nil {
+					offsets[t.Name] = make(map[int32]OffsetMeta, len(topicPartitions[t.Name]))
+				}
+				for _, p := range t.Partitions {
+					if p.Err == proto.ErrGroupLoadInProgress {
+						log.Debugf("cannot fetch offsets for %s yet: %s", group, p.Err)
+						resErr = p.Err
+						continue offsetsRetryLoop
+					}
+					meta := OffsetMeta{Offset: p.Offset, Metadata: p.Metadata, Err: p.Err}
+					if meta.Err == nil && meta.Offset < 0 {
+						// nothing committed yet
+						meta.Err = proto.ErrUnknownTopicOrPartition
+					}
+					offsets[t.Name][p.ID] = meta
+				}
+			}
+			for topic, partitions := range topicPartitions {
+				if offsets[topic] == nil {
+					offsets[topic] = make(map[int32]OffsetMeta, len(partitions))
+				}
+				for _, partition := range partitions {
+					if _, ok := offsets[topic][partition]; !ok {
+						offsets[topic][partition] = OffsetMeta{Err: proto.ErrUnknownTopicOrPartition}
+					}
+				}
+			}
+			return offsets, nil
+		}
+	}
+
+	return nil, resErr
+}
+
+// OffsetMeta is the committed offset of a single partition, as returned by
+// FetchCommittedOffsets and OffsetCoordinator.Offsets.
+type OffsetMeta struct {
+	Offset   int64
+	Metadata string
+
+	// Err is set if the offset of this partition could not be read, in which
+	// case Offset and Metadata are meaningless.
+	Err error
+}
+
+// FetchCommittedOffsets returns the offsets committed by any consumer group
+// for the given partitions, mapped by topic and partition. The group's
+// coordinator is asked using a single OffsetFetch request, which is retried
+// like OffsetCoordinator.Offsets does with the default RetryErrLimit and
+// RetryErrWait of NewOffsetCoordinatorConf. An error is returned when the
+// request fails as a whole; errors of single partitions are reported in the
+// returned OffsetMeta instead, including proto.ErrUnknownTopicOrPartition for
+// partitions without a committed offset.
+func (b *Broker) FetchCommittedOffsets(
+	groupID string, topicPartitions map[string][]int32) (
+	map[string]map[int32]OffsetMeta, error) {
+
+	conf := NewOffsetCoordinatorConf(groupID)
+	return b.fetchOffsets(groupID, topicPartitions, conf.RetryErrLimit, conf.RetryErrWait)
+}
+
+// configConnection returns a connection to the broker that must handle
+// configuration requests for given resource. Broker resources are handled by
+// the broker itself, any broker handles the others. The caller must ensure
+// Idle is eventually called.
+func (b *Broker) configConnection(resourceType int8, name string) (*connection, error) {
+	if resourceType != proto.ConfigResourceBroker {
+		return b.anyConnection()
+	}
+	nodeID, err := strconv.ParseInt(name, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker ID: %q", name)
+	}
+	addr := b.cluster.GetNodeAddress(int32(nodeID))
+	if addr == "" {
+		return nil, fmt.Errorf("unknown broker ID: %d", nodeID)
+	}
+	return b.conns.GetConnectionByAddr(addr)
+}
+
+// configRequestGroups splits resources, given by their types and names, into
+// groups that have to be sent to the same broker. Every group is a list of
+// indexes of the resources. All non broker resources end up in a single group.
+func configRequestGroups(types []int8, names []string) [][]int {
+	var groups [][]int
+	byTarget := make(map[string]int)
+	for i := range types {
+		target := ""
+		if types[i] == proto.ConfigResourceBroker {
+			target = names[i]
+		}
+		gi, ok := byTarget[target]
+		if !ok {
+			gi = len(groups)
+			byTarget[target] = gi
+			groups = append(groups, nil)
+		}
+		groups[gi] = append(groups[gi], i)
+	}
+	return groups
+}
+
+// errNoConfigInfo is reported for resources missing from a response to a
+// configuration request.
+var errNoConfigInfo = errors.New("response does not contain config information")
+
+// sendConfigRequests sends a request for every group of resources, given by
+// their types and names, to the broker handling it, see configRequestGroups.
+// send is called with the connection and the indexes of the resources of a
+// group, and is expected to send the request and store its results. The
+// first error returned by send is returned without sending further requests.
+func (b *Broker) sendConfigRequests(
+	types []int8, names []string, send func(conn *connection, group []int) error) error {
+
+	for _, group := range configRequestGroups(types, names) {
+		conn, err := b.configConnection(types[group[0]], names[group[0]])
+		if err != nil {
+			return err
+		}
+		err = send(conn, group)
+		if err == io.EOF || err == syscall.EPIPE {
+			_ = conn.Close()
+		}
+		go b.conns.Idle(conn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configResponseIndex returns the index of the resource with given type and
+// name among the n resources of a response, or -1 if there is none.
+func configResponseIndex(n int, resource func(j int) (int8, string), resType int8, name string) int {
+	for j := 0; j < n; j++ {
+		if t, nm := resource(j); t == resType && nm == name {
+			return j
+		}
+	}
+	return -1
+}
+
+// DescribeConfigs returns the configuration of given topics or brokers, in
+// the order of resources. Brokers are asked for their own configuration, any
+// broker describes topics. Errors of single resources are reported through
+// their Err and ErrMessage fields, the returned error is only set when a
+// request could not be sent. This requires kafka 0.11 or newer.
+func (b *Broker) DescribeConfigs(
+	resources ...proto.DescribeConfigsReqResource) ([]proto.DescribeConfigsRespResource, error) {
+
+	types := make([]int8, len(resources))
+	names := make([]string, len(resources))
+	for i, res := range resources {
+		types[i], names[i] = res.Type, res.Name
+	}
+
+	results := make([]proto.DescribeConfigsRespResource, len(resources))
+	err := b.sendConfigRequests(types, names, func(conn *connection, group []int) error {
+		req := &proto.DescribeConfigsReq{ClientID: b.conf.ClientID}
+		for _, i := range group {
+			req.Resources = append(req.Resources, resources[i])
+		}
+		resp, err := conn.DescribeConfigs(req)
+		if err != nil {
+			return err
+		}
+		resource := func(j int) (int8, string) { return resp.Resources[j].Type, resp.Resources[j].Name }
+		for _, i := range group {
+			if j := configResponseIndex(len(resp.Resources), resource, types[i], names[i]); j >= 0 {
+				results[i] = resp.Resources[j]
+			} else {
+				results[i] = proto.DescribeConfigsRespResource{Err: errNoConfigInfo, Type: types[i], Name: names[i]}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// AlterConfigs sets the configuration of given topics or brokers, returning
+// the outcome for every resource in the order of resources. Configuration
+// entries missing from a resource are reset to their defaults. With
+// validateOnly set, the brokers only check the request. Routing and error
+// reporting work like in DescribeConfigs. This requires kafka 0.11 or newer.
+func (b *Broker) AlterConfigs(
+	validateOnly bool, resources ...proto.AlterConfigsReqResource) ([]proto.AlterConfigsRespResource, error) {
+
+	types := make([]int8, len(resources))
+	names := make([]string, len(resources))
+	for i, res := range resources {
+		types[i], names[i] = res.Type, res.Name
+	}
+
+	results := make([]proto.AlterConfigsRespResource, len(resources))
+	err := b.sendConfigRequests(types, names, func(conn *connection, group []int) error {
+		req := &proto.AlterConfigsReq{
+			ClientID:     b.conf.ClientID,
+			ValidateOnly: validateOnly,
+		}
+		for _, i := range group {
+			req.Resources = append(req.Resources, resources[i])
+		}
+		resp, err := conn.AlterConfigs(req)
+		if err != nil {
+			return err
+		}
+		resource := func(j int) (int8, string) { return resp.Resources[j].Type, resp.Resources[j].Name }
+		for _, i := range group {
+			if j := configResponseIndex(len(resp.Resources), resource, types[i], names[i]); j >= 0 {
+				results[i] = resp.Resources[j]
+			} else {
+				results[i] = proto.AlterConfigsRespResource{Err: errNoConfigInfo, Type: types[i], Name: names[i]}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
 // rndIntn adds locking around accessing the random number generator. This is required because
 // Go doesn't provide locking within the rand.Rand object.
 func rndIntn(n int) int {
@@ -1087,6 +3770,14 @@ func rndIntn(n int) int {
 	return rnd.Intn(n)
 }
 
+// rndFloat64 adds locking around using the random number generator.
+func rndFloat64() float64 {
+	rndmu.Lock()
+	defer rndmu.Unlock()
+
+	return rnd.Float64()
+}
+
 // rndPerm adds locking around using the random number generator.
 func rndPerm(n int) []int {
 	rndmu.Lock()
@@ -0,0 +1,48 @@
+package kafka
+
+import (
+	"context"
+	"time"
+)
+
+// clock is the source of time used by brokers, consumers, producers and
+// connection pools, so that time based behaviour can be tested without
+// actually waiting.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+	// SleepCtx works like Sleep, but returns the error of ctx as soon as it
+	// is done.
+	SleepCtx(ctx context.Context, d time.Duration) error
+}
+
+// realClock is the clock backed by the time package, used by default.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) SleepCtx(ctx context.Context, d time.Duration) error {
+	if ctx.Done() == nil {
+		time.Sleep(d)
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -3,6 +3,7 @@ package kafka
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,7 +15,7 @@ import (
 // Cluster maintains the metadata and connectionPools for a Kafka cluster.
 type Cluster struct {
 	// ConnectionPool with only one connection to use for metadata requests
-	metadataConnPool *connectionPool
+	metadataConnPool *ConnectionPool
 
 	// connectionPoolCache for all other requests
 	connPoolCache *connectionPoolCache
@@ -28,12 +29,61 @@ type Cluster struct {
 	epoch      *int64
 	timeout    time.Duration
 	created    time.Time
+	clusterID  string
 	nodes      NodeMap                  // node ID to address
+	racks      map[int32]string         // node ID to rack, if known
 	endpoints  map[topicPartition]int32 // partition to leader node ID
 	partitions map[string]int32         // topic to number of partitions
+	listeners  []*metadataListener
 }
 
-func newCluster(conf ClusterConnectionConf, pool *connectionPool, connPoolCache *connectionPoolCache) *Cluster {
+// BrokerInfo describes a broker of the cluster.
+type BrokerInfo struct {
+	NodeID int32
+	Addr   string
+	// Rack is only known with MetadataVersion set to 1 or higher, and
+	// only if the broker is configured with one.
+	Rack string
+}
+
+// metadataListener calls a callback registered with OnMetadataChange on its
+// own goroutine, so that a slow callback never delays metadata refreshes.
+type metadataListener struct {
+	fn   func(epoch int64)
+	next chan int64
+}
+
+func newMetadataListener(fn func(epoch int64)) *metadataListener {
+	l := &metadataListener{
+		fn:   fn,
+		next: make(chan int64, 1),
+	}
+	go func() {
+		for epoch := range l.next {
+			l.fn(epoch)
+		}
+	}()
+	return l
+}
+
+// notify hands the epoch to the callback without blocking. An epoch the
+// callback did not get to yet is replaced by the newer one. Must only be
+// called with refLock held, so that there is a single sender.
+func (l *metadataListener) notify(epoch int64) {
+	for {
+		select {
+		case l.next <- epoch:
+			return
+		default:
+		}
+		select {
+		case <-l.next:
+		default:
+		}
+	}
+}
+
+func newCluster(conf ClusterConnectionConf, pool *ConnectionPool, connPoolCache *connectionPoolCache) *Cluster {
 	result := &Cluster{
 		mu:               &sync.RWMutex{},
 		timeout:          conf.MetadataRefreshTimeout,
@@ -62,6 +112,9 @@ func newCluster(conf ClusterConnectionConf, pool *connectionPool, connPoolCache
 // NewCluster connects to a cluster from a given list of kafka addresses and after successful
 // metadata fetch, returns Cluster.
 func NewCluster(nodeAddresses []string, conf ClusterConnectionConf) (*Cluster, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
 	connPoolCache := newConnPoolCache()
 	metadataConnPool, err := connPoolCache.getOrCreateConnectionPool(
 		metadataCacheClientID, conf, nodeAddresses)
@@ -117,7 +170,9 @@ func (cm *Cluster) cache(resp *proto.MetadataResp) {
 	log.Debugf("Caching new metadata: %+v", resp)
 
 	cm.created = time.Now()
+	cm.clusterID = resp.ClusterID
 	cm.nodes = make(NodeMap)
+	cm.racks = make(map[int32]string)
 	cm.endpoints = make(map[topicPartition]int32)
 	cm.partitions = make(map[string]int32)
 
@@ -126,6 +181,7 @@ func (cm *Cluster) cache(resp *proto.MetadataResp) {
 		addr := fmt.Sprintf("%s:%d", node.Host, node.Port)
 		addrs = append(addrs, addr)
 		cm.nodes[node.NodeID] = addr
+		cm.racks[node.NodeID] = node.Rack
 	}
 	for _, topic := range resp.Topics {
 		for _, part := range topic.Partitions {
@@ -137,8 +193,52 @@ func (cm *Cluster) cache(resp *proto.MetadataResp) {
 	cm.connPoolCache.reinitializeAddrs(addrs)
 }
 
-// connectionPoolForClient returns the connectionPool to this cluster for the given client ID.
-func (cm *Cluster) connectionPoolForClient(clientID string, conf ClusterConnectionConf) (*connectionPool, error) {
+// cacheTopics updates internal metadata representation of the topics present
+// in given response, keeping everything else as is. Unlike cache, this can be
+// used with responses to metadata requests for given topics only.
+func (cm *Cluster) cacheTopics(resp *proto.MetadataResp) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	log.Debugf("Caching new topic metadata: %+v", resp)
+
+	if cm.nodes == nil {
+		cm.nodes = make(NodeMap)
+		cm.racks = make(map[int32]string)
+		cm.endpoints = make(map[topicPartition]int32)
+		cm.partitions = make(map[string]int32)
+	}
+	var nodesChanged bool
+	for _, node := range resp.Brokers {
+		addr := fmt.Sprintf("%s:%d", node.Host, node.Port)
+		if cm.nodes[node.NodeID] != addr {
+			nodesChanged = true
+		}
+		cm.nodes[node.NodeID] = addr
+		cm.racks[node.NodeID] = node.Rack
+	}
+	if nodesChanged {
+		// nodes that are not listed are kept, so pools keep their backends
+		addrs := make([]string, 0, len(cm.nodes))
+		for _, addr := range cm.nodes {
+			addrs = append(addrs, addr)
+		}
+		cm.connPoolCache.reinitializeAddrs(addrs)
+	}
+	for _, topic := range resp.Topics {
+		if topic.Err != nil {
+			log.Warningf("Cannot cache metadata of topic %s: %s", topic.Name, topic.Err)
+			continue
+		}
+		for _, part := range topic.Partitions {
+			cm.endpoints[topicPartition{topic.Name, part.ID}] = part.Leader
+		}
+		cm.partitions[topic.Name] = int32(len(topic.Partitions))
+	}
+}
+
+// connectionPoolForClient returns the ConnectionPool to this cluster for the given client ID.
+func (cm *Cluster) connectionPoolForClient(clientID string, conf ClusterConnectionConf) (*ConnectionPool, error) {
 	return cm.connPoolCache.getOrCreateConnectionPool(clientID, conf, cm.metadataConnPool.GetAllAddrs())
 }
 
@@ -166,10 +266,18 @@ func (cm *Cluster) RefreshMetadata() error {
 
 		// The counter has not updated, so it's on us to update metadata.
 		log.Debug("refreshing metadata")
-		if meta, err := cm.Fetch(metadataCacheClientID); err == nil {
+		meta, err := cm.FetchVersion(metadataCacheClientID, cm.conf.MetadataVersion)
+		if err == nil && len(meta.Brokers) == 0 {
+			// Caching this would leave the client without any broker to
+			// connect to, so the previous metadata is kept.
+			log.Errorf("Refusing to cache metadata without brokers: %+v", meta)
+			err = ErrNoBrokersInMetadata
+		}
+		if err == nil {
 			// Update metadata + update counter to be old value plus one.
 			cm.cache(meta)
 			atomic.StoreInt64(cm.epoch, ctr1+1)
+			cm.notifyListeners(ctr1 + 1)
 			updateChan <- nil
 		} else {
 			// An error, note we do not update the epoch. This means that the next person to
@@ -187,6 +295,59 @@ func (cm *Cluster) RefreshMetadata() error {
 	}
 }
 
+// OnMetadataChange registers fn to be called with the new epoch after every
+// successful RefreshMetadata, so that applications can react to topology
+// changes. Callbacks run on their own goroutine and never block the refresh.
+// Every callback is called with increasing epochs, but when it is slower
+// than refreshes, the epochs it did not get to are skipped.
+func (cm *Cluster) OnMetadataChange(fn func(epoch int64)) {
+	l := newMetadataListener(fn)
+	cm.mu.Lock()
+	cm.listeners = append(cm.listeners, l)
+	cm.mu.Unlock()
+}
+
+func (cm *Cluster) notifyListeners(epoch int64) {
+	cm.mu.RLock()
+	listeners := cm.listeners
+	cm.mu.RUnlock()
+	for _, l := range listeners {
+		l.notify(epoch)
+	}
+}
+
+// RefreshTopics is requesting metadata information of given topics only and
+// updates internal cached representation of them. Metadata of other topics is
+// left untouched.
+//
+// Topics the response lists on top of the requested ones are cached as well.
+// Requested topics missing from the response are removed from the cache and
+// proto.ErrUnknownTopicOrPartition is returned, after all listed topics have
+// been cached.
+func (cm *Cluster) RefreshTopics(topics ...string) error {
+	if len(topics) == 0 {
+		return nil
+	}
+	meta, err := cm.FetchVersion(metadataCacheClientID, cm.conf.MetadataVersion, topics...)
+	if err != nil {
+		return err
+	}
+	cm.cacheTopics(meta)
+
+	listed := make(map[string]bool, len(meta.Topics))
+	for _, topic := range meta.Topics {
+		listed[topic.Name] = true
+	}
+	for _, topic := range topics {
+		if !listed[topic] {
+			log.Warningf("Topic %s missing from metadata response", topic)
+			cm.forgetTopic(topic)
+			err = proto.ErrUnknownTopicOrPartition
+		}
+	}
+	return err
+}
+
 // Fetch is requesting metadata information from any node and return
 // protocol response if successful. This will attempt to talk to every node at
 // least once until one returns a successful response. We walk the nodes in
@@ -195,6 +356,12 @@ func (cm *Cluster) RefreshMetadata() error {
 // If "topics" are specified, only fetch metadata for those topics (can be
 // used to create a topic)
 func (cm *Cluster) Fetch(clientID string, topics ...string) (*proto.MetadataResp, error) {
+	return cm.FetchVersion(clientID, 0, topics...)
+}
+
+// FetchVersion works like Fetch, but sends the metadata request using the
+// given protocol version.
+func (cm *Cluster) FetchVersion(clientID string, version int16, topics ...string) (*proto.MetadataResp, error) {
 	// Get all addresses, then walk the array in permuted random order.
 	addrs := cm.metadataConnPool.GetAllAddrs()
 	log.Debugf("metadata fetch addrs: %s", addrs)
@@ -202,7 +369,7 @@ func (cm *Cluster) Fetch(clientID string, topics ...string) (*proto.MetadataResp
 	perBrokerTimeout := cm.getTimeout() / 2
 	for _, idx := range rndPerm(len(addrs)) {
 		// Directly connect, ignoring connection pool limits. This connection must be closed here.
-		conn, err := newTCPConnection(addrs[idx], perBrokerTimeout)
+		conn, err := newConnection(addrs[idx], cm.conf, perBrokerTimeout)
 		if err != nil {
 			log.Warningf("metadata fetch failed to connect to node %s: %s", addrs[idx], err)
 			continue
@@ -210,6 +377,7 @@ func (cm *Cluster) Fetch(clientID string, topics ...string) (*proto.MetadataResp
 		resp, err := conn.Metadata(&proto.MetadataReq{
 			ClientID: clientID,
 			Topics:   topics,
+			Version:  version,
 		})
 		_ = conn.Close()
 		if err != nil {
@@ -246,6 +414,37 @@ func (cm *Cluster) GetEndpoint(topic string, partition int32) (int32, error) {
 	return 0, errors.New("topic/partition not found in metadata")
 }
 
+// WaitForLeader returns the leader node ID of given topic/partition, refreshing
+// metadata with backoff until the partition has a leader (not -1) or timeout
+// elapses. This is useful during leader failover, when the partition is
+// temporarily without a leader.
+func (cm *Cluster) WaitForLeader(topic string, partition int32, timeout time.Duration) (int32, error) {
+	if nodeID, err := cm.GetEndpoint(topic, partition); err == nil && nodeID >= 0 {
+		return nodeID, nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	retry := &backoff.Backoff{Min: 10 * time.Millisecond, Max: time.Second, Jitter: true}
+	for {
+		if err := cm.RefreshMetadata(); err != nil {
+			log.Warningf("[WaitForLeader %s:%d] cannot refresh metadata: %s",
+				topic, partition, err)
+		} else if nodeID, err := cm.GetEndpoint(topic, partition); err == nil && nodeID >= 0 {
+			return nodeID, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return 0, fmt.Errorf("no leader for %s:%d after %s", topic, partition, timeout)
+		}
+		wait := retry.Duration()
+		if wait > remaining {
+			wait = remaining
+		}
+		time.Sleep(wait)
+	}
+}
+
 // ForgetEndpoint is used to remove an endpoint that doesn't see to lead to
 // a valid location.
 func (cm *Cluster) ForgetEndpoint(topic string, partition int32) {
@@ -255,6 +454,42 @@ func (cm *Cluster) ForgetEndpoint(topic string, partition int32) {
 	delete(cm.endpoints, topicPartition{topic, partition})
 }
 
+// ForgetTopicEndpoints removes the endpoints of all partitions of the given
+// topic, so that the next lookup refreshes metadata.
+func (cm *Cluster) ForgetTopicEndpoints(topic string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	for tp := range cm.endpoints {
+		if tp.topic == topic {
+			delete(cm.endpoints, tp)
+		}
+	}
+}
+
+// forgetTopic removes the partition count and the endpoints of all partitions
+// of the given topic.
+func (cm *Cluster) forgetTopic(topic string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	delete(cm.partitions, topic)
+	for tp := range cm.endpoints {
+		if tp.topic == topic {
+			delete(cm.endpoints, tp)
+		}
+	}
+}
+
+// ClusterID returns the ID of the cluster as reported by the last metadata
+// refresh. It is empty unless MetadataVersion is set to 2 or higher.
+func (cm *Cluster) ClusterID() string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	return cm.clusterID
+}
+
 // GetNodes returns a map of nodes that exist in the cluster.
 func (cm *Cluster) GetNodes() NodeMap {
 	cm.mu.RLock()
@@ -267,6 +502,20 @@ func (cm *Cluster) GetNodes() NodeMap {
 	return nodes
 }
 
+// Brokers returns the brokers of the cluster known from the last metadata
+// refresh, ordered by node ID.
+func (cm *Cluster) Brokers() []BrokerInfo {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	brokers := make([]BrokerInfo, 0, len(cm.nodes))
+	for nodeID, addr := range cm.nodes {
+		brokers = append(brokers, BrokerInfo{NodeID: nodeID, Addr: addr, Rack: cm.racks[nodeID]})
+	}
+	sort.Slice(brokers, func(i, j int) bool { return brokers[i].NodeID < brokers[j].NodeID })
+	return brokers
+}
+
 // GetNodeAddress returns the address to a node if we know it.
 func (cm *Cluster) GetNodeAddress(nodeID int32) string {
 	cm.mu.RLock()
@@ -9,5 +9,8 @@ import (
 
 func Test(t *testing.T) {
 	logging.SetLevel(logging.CRITICAL, "KafkaClient") // Suppress logs in tests.
+	// Tests reuse cluster names for different servers, so they only share
+	// metadata when they initialize the cache themselves.
+	uninitializeMetadataCache()
 	check.TestingT(t)
 }
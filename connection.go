@@ -3,8 +3,8 @@ package kafka
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
-	"fmt"
 	"io"
 	"math/rand"
 	"net"
@@ -14,8 +14,15 @@ import (
 	"github.com/discord/zorkian-kafka/proto"
 )
 
-// ErrClosed is returned as result of any request made using closed connection.
-var ErrClosed = errors.New("closed")
+var (
+	// ErrClosed is returned as result of any request made using closed connection.
+	ErrClosed = errors.New("closed")
+
+	// ErrCorrelationMismatch is returned when the correlation ID of a response
+	// does not match the request it was read for. The connection is closed, as
+	// responses can no longer be matched to requests.
+	ErrCorrelationMismatch = errors.New("response correlation ID mismatch")
+)
 
 type readResp struct {
 	bytes *bytes.Reader
@@ -32,25 +39,60 @@ type connection struct {
 	rnd       *rand.Rand
 	timeout   time.Duration
 	closed    *int32
+
+	// maxResponse and maxMetadata limit the size of responses, see
+	// ClusterConnectionConf.MaxResponseBytes and MaxMetadataBytes.
+	maxResponse int32
+	maxMetadata int32
 }
 
-// newConnection returns new, initialized connection or error
+// newTCPConnection returns new, initialized plain TCP connection or error.
 func newTCPConnection(address string, timeout time.Duration) (*connection, error) {
-	conn, err := net.DialTimeout("tcp", address, timeout)
+	return newConnection(address, ClusterConnectionConf{}, timeout)
+}
+
+// newConnection returns new, initialized connection or error. Connecting is
+// limited by conf.ConnectTimeout, which falls back to timeout when not set.
+// Timeout also limits every request sent over the connection.
+func newConnection(address string, conf ClusterConnectionConf, timeout time.Duration) (*connection, error) {
+	return newConnectionCtx(context.Background(), address, conf, timeout)
+}
+
+// newConnectionCtx works like newConnection, but gives up once ctx is done,
+// returning its error.
+func newConnectionCtx(ctx context.Context, address string, conf ClusterConnectionConf, timeout time.Duration) (*connection, error) {
+	connectTimeout := conf.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = timeout
+	}
+	dialer := net.Dialer{Timeout: connectTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
 		return nil, err
 	}
 
 	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
 
+	// zero limits make proto.ReadRespLimit apply its default
+	maxResponse := conf.MaxResponseBytes
+	maxMetadata := conf.MaxMetadataBytes
+	if maxMetadata <= 0 {
+		maxMetadata = maxResponse
+	}
+
 	c := &connection{
-		addr:      address,
-		rw:        conn,
-		rd:        bufio.NewReader(conn),
-		rnd:       rnd,
-		closed:    new(int32),
-		startTime: time.Now(),
-		timeout:   timeout,
+		addr:        address,
+		rw:          conn,
+		rd:          bufio.NewReader(conn),
+		rnd:         rnd,
+		closed:      new(int32),
+		startTime:   time.Now(),
+		timeout:     timeout,
+		maxResponse: maxResponse,
+		maxMetadata: maxMetadata,
 	}
 	return c, nil
 }
@@ -76,17 +118,49 @@ func (c *connection) Close() error {
 
 // sendRequest calls sendRequestHelper with timeout, closing the connection if it is hit.
 func (c *connection) sendRequest(req proto.Request, reqID int32) (*bytes.Reader, error) {
+	return c.sendRequestCtx(context.Background(), req, reqID, c.maxResponse)
+}
+
+// sendRequestLimit works like sendRequest, but fails with
+// proto.ErrInvalidResponseSize if the response is bigger than limit.
+func (c *connection) sendRequestLimit(req proto.Request, reqID int32, limit int32) (*bytes.Reader, error) {
+	return c.sendRequestCtx(context.Background(), req, reqID, limit)
+}
+
+// sendRequestCtx works like sendRequestLimit, but the deadline of ctx, if
+// any, is set as the read and write deadline of the connection for the time
+// of the request. Once ctx is done the connection is closed and the error of
+// ctx returned.
+func (c *connection) sendRequestCtx(ctx context.Context, req proto.Request, reqID int32, limit int32) (*bytes.Reader, error) {
+	deadline, hasDeadline := ctx.Deadline()
 	readRespChan := make(chan readResp, 1)
 	go func() {
-		bytes, err := c.sendRequestHelper(req, reqID)
+		if hasDeadline {
+			c.setDeadline(deadline)
+			defer c.setDeadline(time.Time{})
+		}
+		bytes, err := c.sendRequestHelper(req, reqID, limit)
 		readRespChan <- readResp{bytes, err}
 	}()
 	select {
 	case result := <-readRespChan:
 		if result.err != nil {
 			c.Close()
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if ne, ok := result.err.(net.Error); ok && ne.Timeout() && hasDeadline {
+				// the socket deadline was hit just before ctx noticed
+				return nil, context.DeadlineExceeded
+			}
 		}
 		return result.bytes, result.err
+	case <-ctx.Done():
+		// Closing the connection makes the pending read or write fail, so
+		// the connection is dropped instead of being reused with a response
+		// still waiting to be read.
+		_ = c.Close()
+		return nil, ctx.Err()
 	case <-time.After(2 * c.timeout):
 		_ = c.Close()
 		log.Warning("sendRequest hit timeout")
@@ -94,9 +168,17 @@ func (c *connection) sendRequest(req proto.Request, reqID int32) (*bytes.Reader,
 	}
 }
 
+// setDeadline sets the read and write deadline of the underlying network
+// connection. Zero time clears it.
+func (c *connection) setDeadline(t time.Time) {
+	if conn, ok := c.rw.(interface{ SetDeadline(time.Time) error }); ok {
+		_ = conn.SetDeadline(t)
+	}
+}
+
 // sendRequestHelper handles the raw material of sending a request up to Kafka and
 // receiving the response.
-func (c *connection) sendRequestHelper(req proto.Request, reqID int32) (
+func (c *connection) sendRequestHelper(req proto.Request, reqID int32, limit int32) (
 	*bytes.Reader, error) {
 
 	if _, err := req.WriteTo(c.rw); err != nil {
@@ -104,13 +186,14 @@ func (c *connection) sendRequestHelper(req proto.Request, reqID int32) (
 		return nil, err
 	}
 
-	if correlationID, b, err := proto.ReadResp(c.rd); err != nil {
+	if correlationID, b, err := proto.ReadRespLimit(c.rd, limit); err != nil {
 		return nil, err
 	} else {
 		if correlationID != reqID {
 			_ = c.Close()
-			return nil, fmt.Errorf("got unexpected correlation ID %d instead of %d",
-				correlationID, reqID)
+			log.Errorf("got unexpected correlation ID %d instead of %d from %s",
+				correlationID, reqID, c.addr)
+			return nil, ErrCorrelationMismatch
 		}
 		return bytes.NewReader(b), nil
 	}
@@ -123,10 +206,10 @@ func (c *connection) Metadata(req *proto.MetadataReq) (*proto.MetadataResp, erro
 	if req.CorrelationID == 0 {
 		req.CorrelationID = c.rnd.Int31()
 	}
-	if b, err := c.sendRequest(req, req.CorrelationID); err != nil {
+	if b, err := c.sendRequestLimit(req, req.CorrelationID, c.maxMetadata); err != nil {
 		return nil, err
 	} else {
-		return proto.ReadMetadataResp(b)
+		return proto.ReadVersionedMetadataResp(b, req.Version)
 	}
 }
 
@@ -135,6 +218,12 @@ func (c *connection) Metadata(req *proto.MetadataReq) (*proto.MetadataResp, erro
 // right after sending request, without waiting for response.
 // Calling this method on closed connection will always return ErrClosed.
 func (c *connection) Produce(req *proto.ProduceReq) (*proto.ProduceResp, error) {
+	return c.ProduceCtx(context.Background(), req)
+}
+
+// ProduceCtx works like Produce, but uses the deadline of ctx as the read and
+// write deadline of the connection. See sendRequestCtx.
+func (c *connection) ProduceCtx(ctx context.Context, req *proto.ProduceReq) (*proto.ProduceResp, error) {
 	if req.CorrelationID == 0 {
 		req.CorrelationID = c.rnd.Int31()
 	}
@@ -142,30 +231,46 @@ func (c *connection) Produce(req *proto.ProduceReq) (*proto.ProduceResp, error)
 	// This sad, dumb degenerate case is one where the server will never send us
 	// a response. We write blindly and return.
 	if req.RequiredAcks == proto.RequiredAcksNone {
+		if deadline, ok := ctx.Deadline(); ok {
+			c.setDeadline(deadline)
+			defer c.setDeadline(time.Time{})
+		}
 		_, err := req.WriteTo(c.rw)
 		return nil, err
 	}
 
 	// Normal workflow
-	if b, err := c.sendRequest(req, req.CorrelationID); err != nil {
+	if b, err := c.sendRequestCtx(ctx, req, req.CorrelationID, c.maxResponse); err != nil {
 		return nil, err
 	} else {
-		return proto.ReadProduceResp(b)
+		return proto.ReadVersionedProduceResp(b, req.Version)
 	}
 }
 
 // Fetch sends given fetch request to kafka node and returns related response.
 // Calling this method on closed connection will always return ErrClosed.
 func (c *connection) Fetch(req *proto.FetchReq) (*proto.FetchResp, error) {
+	return c.fetch(context.Background(), req, false)
+}
+
+// fetch works like Fetch, but malformed messages are skipped instead of
+// ending the message set if skipMalformed is set. The deadline of ctx is used
+// as the read and write deadline of the connection, see sendRequestCtx.
+func (c *connection) fetch(ctx context.Context, req *proto.FetchReq, skipMalformed bool) (*proto.FetchResp, error) {
 	var resp *proto.FetchResp
 
 	if req.CorrelationID == 0 {
 		req.CorrelationID = c.rnd.Int31()
 	}
-	if b, err := c.sendRequest(req, req.CorrelationID); err != nil {
+	if b, err := c.sendRequestCtx(ctx, req, req.CorrelationID, c.maxResponse); err != nil {
 		return nil, err
 	} else {
-		if resp, err = proto.ReadFetchResp(b); err != nil {
+		if skipMalformed {
+			resp, err = proto.ReadFetchRespSkipMalformed(b, req.Version)
+		} else {
+			resp, err = proto.ReadVersionedFetchResp(b, req.Version)
+		}
+		if err != nil {
 			return nil, err
 		}
 	}
@@ -193,6 +298,20 @@ func (c *connection) Fetch(req *proto.FetchReq) (*proto.FetchResp, error) {
 	return resp, nil
 }
 
+// fetchRaw works like fetch, but message sets are returned undecoded in
+// RawMessages, see proto.ReadFetchRespRaw. Entries before the requested
+// offset are not trimmed.
+func (c *connection) fetchRaw(ctx context.Context, req *proto.FetchReq) (*proto.FetchResp, error) {
+	if req.CorrelationID == 0 {
+		req.CorrelationID = c.rnd.Int31()
+	}
+	b, err := c.sendRequestCtx(ctx, req, req.CorrelationID, c.maxResponse)
+	if err != nil {
+		return nil, err
+	}
+	return proto.ReadFetchRespRaw(b, req.Version)
+}
+
 // Offset sends given offset request to kafka node and returns related response.
 // Calling this method on closed connection will always return ErrClosed.
 func (c *connection) Offset(req *proto.OffsetReq) (*proto.OffsetResp, error) {
@@ -207,7 +326,7 @@ func (c *connection) Offset(req *proto.OffsetReq) (*proto.OffsetResp, error) {
 	if b, err := c.sendRequest(req, req.CorrelationID); err != nil {
 		return nil, err
 	} else {
-		return proto.ReadOffsetResp(b)
+		return proto.ReadVersionedOffsetResp(b, req.Version)
 	}
 }
 
@@ -243,3 +362,25 @@ func (c *connection) OffsetFetch(req *proto.OffsetFetchReq) (*proto.OffsetFetchR
 		return proto.ReadOffsetFetchResp(b)
 	}
 }
+
+func (c *connection) DescribeConfigs(req *proto.DescribeConfigsReq) (*proto.DescribeConfigsResp, error) {
+	if req.CorrelationID == 0 {
+		req.CorrelationID = c.rnd.Int31()
+	}
+	if b, err := c.sendRequest(req, req.CorrelationID); err != nil {
+		return nil, err
+	} else {
+		return proto.ReadDescribeConfigsResp(b)
+	}
+}
+
+func (c *connection) AlterConfigs(req *proto.AlterConfigsReq) (*proto.AlterConfigsResp, error) {
+	if req.CorrelationID == 0 {
+		req.CorrelationID = c.rnd.Int31()
+	}
+	if b, err := c.sendRequest(req, req.CorrelationID); err != nil {
+		return nil, err
+	} else {
+		return proto.ReadAlterConfigsResp(b)
+	}
+}
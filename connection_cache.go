@@ -7,7 +7,7 @@ import (
 // connectionPoolCache caches connections to a single cluster by ClientID.
 type connectionPoolCache struct {
 	lock              sync.Mutex
-	connectionPoolMap map[string]*connectionPool
+	connectionPoolMap map[string]*ConnectionPool
 }
 
 // connectionPoolCache is a threadsafe cache of ConnectionPool by clientID.  One connectionPoolCache
@@ -17,7 +17,7 @@ type connectionPoolCache struct {
 func newConnPoolCache() *connectionPoolCache {
 	return &connectionPoolCache{
 		lock:              sync.Mutex{},
-		connectionPoolMap: make(map[string]*connectionPool),
+		connectionPoolMap: make(map[string]*ConnectionPool),
 	}
 
 }
@@ -26,7 +26,7 @@ func newConnPoolCache() *connectionPoolCache {
 // the given (serviceName, clientId) tuple.
 func (c *connectionPoolCache) getOrCreateConnectionPool(
 	clientID string, conf ClusterConnectionConf, nodeAddresses []string) (
-	*connectionPool, error) {
+	*ConnectionPool, error) {
 
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -37,7 +37,7 @@ func (c *connectionPoolCache) getOrCreateConnectionPool(
 	}
 	log.Infof("ConnectionPool for cluster %s being created.", nodeAddresses)
 
-	connPool := newConnectionPool(conf, nodeAddresses)
+	connPool := NewConnectionPool(conf, nodeAddresses)
 	c.connectionPoolMap[clientID] = connPool
 	return connPool, nil
 }
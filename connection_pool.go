@@ -1,8 +1,11 @@
 package kafka
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,12 +16,37 @@ func (NoConnectionsAvailable) Error() string {
 	return "[transient] Connection pool is full (did not attempt to create new connection)."
 }
 
+// Metrics receives events of the connection pools of a cluster, to be
+// reported by the application to its monitoring system. Methods must not
+// block, they are called while acquiring connections.
+type Metrics interface {
+	// IncConnectionPoolExhausted is called when a connection to the broker
+	// at addr is needed, but ConnectionLimit connections are already in use.
+	IncConnectionPoolExhausted(addr string)
+}
+
+// ConnectionPoolStats counts how often connections of a connection pool are
+// reused. Many misses and new connections compared to hits usually mean that
+// ConnectionLimit is too low for the load.
+type ConnectionPoolStats struct {
+	// IdleHits is the number of requests for a connection served by an
+	// already established, idle connection.
+	IdleHits int64
+	// IdleMisses is the number of requests for a connection that found no
+	// idle connection.
+	IdleMisses int64
+	// NewConnections is the number of connections established.
+	NewConnections int64
+}
+
 // backend stores information about a given backend. All access to this data should be done
 // through methods to ensure accurate counting and limiting.
 type backend struct {
 	conf    ClusterConnectionConf
 	addr    string
 	channel chan *connection
+	clock   clock
+	stats   *ConnectionPoolStats // shared with the pool, atomic access only
 
 	// Used for storing links to all connections we ever make, this is a debugging
 	// tool to try to help find leaks of connections. All access is protected by mu.
@@ -27,6 +55,11 @@ type backend struct {
 	counter        int
 	debugTime      time.Time
 	debugNumHitMax int
+
+	// affinity maps a topic to the connection last used for it, so that
+	// requests for partitions of the same topic led by this backend can go
+	// over the same connection. Protected by mu.
+	affinity map[string]*connection
 }
 
 // getIdleConnection returns a connection if and only if there is an active, idle connection
@@ -35,6 +68,7 @@ func (b *backend) GetIdleConnection() *connection {
 	for {
 		select {
 		case conn := <-b.channel:
+			conn = b.reorderIdle(conn)
 			if !conn.IsClosed() {
 				return conn
 			}
@@ -55,13 +89,20 @@ func (b *backend) GetIdleConnection() *connection {
 // If the error returned is NoConnectionsAvailable, the caller should treat it as transient
 // and not consider the backend/addr unhealthy.
 func (b *backend) GetConnection() (*connection, error) {
+	return b.GetConnectionCtx(context.Background())
+}
+
+// GetConnectionCtx works like GetConnection, but gives up waiting or dialing
+// once ctx is done, returning its error.
+func (b *backend) GetConnectionCtx(ctx context.Context) (*connection, error) {
 	// dialTimeout must be longer than the configured timeout from the user to
 	// differentiate the case where 'the pool is full' and 'the remote server is
 	// not responding'. Since the b.conf.DialTimeout is used by the underlying
 	// newTCPConnection method, we need to still be alive and waiting if it returns
 	// an error at that point -- hence waiting for twice the configured timeout
 	// in this method.
-	dialTimeout := time.After(2 * b.conf.DialTimeout)
+	dialTimeout := b.clock.After(2 * b.conf.DialTimeout)
+	exhausted := false
 	for {
 		select {
 		// Track the overall GetConnection timeout. This will fire when we've waited
@@ -69,12 +110,18 @@ func (b *backend) GetConnection() (*connection, error) {
 		// believe we're actually at the connection limit b/c if it was an unhealthy
 		// backend then getNewConnection would have returned an error.
 		case <-dialTimeout:
+			atomic.AddInt64(&b.stats.IdleMisses, 1)
 			return nil, &NoConnectionsAvailable{}
 
+		case <-ctx.Done():
+			return nil, ctx.Err()
+
 		// Optimal case: a connection is immediately available in the the channel
 		// where we keep idle connections.
 		case conn := <-b.channel:
+			conn = b.reorderIdle(conn)
 			if !conn.IsClosed() {
+				atomic.AddInt64(&b.stats.IdleHits, 1)
 				return conn, nil
 			}
 			b.removeConnection(conn)
@@ -82,13 +129,101 @@ func (b *backend) GetConnection() (*connection, error) {
 		// Wait a small amount of time for an idle connection. If nothing arrives,
 		// attempt to make a new connection. This might fail if we're at the connection
 		// limit, in which case we'll loop.
-		case <-time.After(time.Duration(rndIntn(int(b.conf.IdleConnectionWait)))):
-			conn, err := b.getNewConnection()
+		case <-b.clock.After(time.Duration(rndIntn(int(b.conf.IdleConnectionWait)))):
+			conn, err := b.getNewConnection(ctx)
 			if err != nil || conn != nil {
+				atomic.AddInt64(&b.stats.IdleMisses, 1)
 				return conn, err
 			}
+			// reported once per call, however long it keeps waiting
+			if !exhausted && b.conf.Metrics != nil {
+				b.conf.Metrics.IncConnectionPoolExhausted(b.addr)
+			}
+			exhausted = true
+		}
+	}
+}
+
+// reorderIdle applies the IdleReusePolicy to a connection just taken from
+// the idle connections, which is the one idle for the longest time. With
+// IdleReuseLIFO it is swapped for the most recently idle one instead, and all
+// others are put back in their order. This cannot block as the channel has
+// room for all connections of the backend.
+func (b *backend) reorderIdle(oldest *connection) *connection {
+	if b.conf.IdleReusePolicy != IdleReuseLIFO {
+		return oldest
+	}
+	newest := oldest
+	var others []*connection
+	for n := len(b.channel); n > 0; n-- {
+		select {
+		case conn := <-b.channel:
+			others = append(others, newest)
+			newest = conn
+		default:
+			n = 0
+		}
+	}
+	for _, conn := range others {
+		b.channel <- conn
+	}
+	return newest
+}
+
+// GetTopicConnection works like GetConnectionCtx, but prefers the connection
+// last used for the given topic if it is idle. Any other connection is
+// returned otherwise and becomes the preferred one for the topic.
+func (b *backend) GetTopicConnection(ctx context.Context, topic string) (*connection, error) {
+	if conn := b.getAffineConnection(topic); conn != nil {
+		atomic.AddInt64(&b.stats.IdleHits, 1)
+		return conn, nil
+	}
+
+	conn, err := b.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	if b.affinity == nil {
+		b.affinity = make(map[string]*connection)
+	}
+	b.affinity[topic] = conn
+	b.mu.Unlock()
+	return conn, nil
+}
+
+// getAffineConnection takes the connection preferred for the given topic out
+// of the idle connections. Returns nil if there is no such connection or it
+// is in use.
+func (b *backend) getAffineConnection(topic string) *connection {
+	b.mu.Lock()
+	preferred := b.affinity[topic]
+	b.mu.Unlock()
+	if preferred == nil || preferred.IsClosed() {
+		return nil
+	}
+
+	// Look through the connections idle right now. The ones we are not
+	// interested in are put back, which cannot block as the channel has room
+	// for all connections of the backend.
+	var found *connection
+	var others []*connection
+	for n := len(b.channel); n > 0 && found == nil; n-- {
+		select {
+		case conn := <-b.channel:
+			if conn == preferred {
+				found = conn
+			} else {
+				others = append(others, conn)
+			}
+		default:
+			n = 0
 		}
 	}
+	for _, conn := range others {
+		b.channel <- conn
+	}
+	return found
 }
 
 // debugHitMaxConnections will potentially do some debugging output to help diagnose situations
@@ -98,7 +233,7 @@ func (b *backend) debugHitMaxConnections() {
 	defer b.mu.Unlock()
 
 	b.debugNumHitMax++
-	now := time.Now()
+	now := b.clock.Now()
 	if now.Before(b.debugTime) {
 		return
 	}
@@ -116,7 +251,7 @@ func (b *backend) debugHitMaxConnections() {
 // it will return nil. If an error is returned, we failed to connect to the server and should
 // abort the flow. This takes a lock on the mutex which means we can only have a single new
 // connection request in-flight at one time. Takes the mutex.
-func (b *backend) getNewConnection() (*connection, error) {
+func (b *backend) getNewConnection(ctx context.Context) (*connection, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -144,10 +279,11 @@ func (b *backend) getNewConnection() (*connection, error) {
 		b.counter = len(newConns)
 	}
 
-	conn, err := newTCPConnection(b.addr, b.conf.DialTimeout)
+	conn, err := newConnectionCtx(ctx, b.addr, b.conf, b.conf.DialTimeout)
 	if err == nil {
 		b.counter++
 		b.conns = append(b.conns, conn)
+		atomic.AddInt64(&b.stats.NewConnections, 1)
 	}
 	return conn, err
 }
@@ -162,7 +298,12 @@ func (b *backend) removeConnection(conn *connection) {
 		if c == conn {
 			b.counter--
 			b.conns = append(b.conns[0:idx], b.conns[idx+1:]...)
-			return
+			break
+		}
+	}
+	for topic, c := range b.affinity {
+		if c == conn {
+			delete(b.affinity, topic)
 		}
 	}
 }
@@ -196,6 +337,30 @@ func (b *backend) NumOpenConnections() int {
 	return b.counter
 }
 
+// CloseConnections closes every connection we have open to this backend, both
+// idle and in use, and forgets about them. The backend stays usable and new
+// connections will be established on demand. Takes the mutex.
+func (b *backend) CloseConnections() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, conn := range b.conns {
+		_ = conn.Close()
+	}
+	// Drop the closed idle connections as well, so that the channel has room
+	// for all connections established from now on.
+	for drained := false; !drained; {
+		select {
+		case <-b.channel:
+		default:
+			drained = true
+		}
+	}
+	b.conns = nil
+	b.counter = 0
+	b.affinity = nil
+}
+
 // Close shuts down all connections.
 func (b *backend) Close() {
 	b.mu.Lock()
@@ -205,8 +370,24 @@ func (b *backend) Close() {
 		_ = conn.Close()
 	}
 	b.counter = 0
+	b.affinity = nil
 }
 
+// IdleReusePolicy controls the order in which idle connections to a broker
+// are reused.
+type IdleReusePolicy int
+
+const (
+	// IdleReuseFIFO reuses the connection idle for the longest time first,
+	// spreading requests over all connections.
+	IdleReuseFIFO IdleReusePolicy = iota
+
+	// IdleReuseLIFO reuses the most recently used connection first, so that
+	// under low load a small set of connections stays warm while the others
+	// are left idle.
+	IdleReuseLIFO
+)
+
 // ClusterConnectionConf is configuration for the cluster connection pool.
 type ClusterConnectionConf struct {
 	// ConnectionLimit sets a limit on how many outstanding connections may exist to a
@@ -227,12 +408,24 @@ type ClusterConnectionConf struct {
 	// Default is 200ms.
 	IdleConnectionWait time.Duration
 
+	// IdleReusePolicy controls which idle connection to a broker is handed
+	// out when there are several.
+	//
+	// Defaults to IdleReuseFIFO.
+	IdleReusePolicy IdleReusePolicy
+
 	// Any new connection dial timeout. This must be at least double the
 	// IdleConnectionWait.
 	//
 	// Default is 10 seconds.
 	DialTimeout time.Duration
 
+	// ConnectTimeout limits establishing the TCP connection of any new
+	// connection.
+	//
+	// Defaults to 0, which means DialTimeout is used.
+	ConnectTimeout time.Duration
+
 	// DialRetryLimit limits the number of connection attempts to every node in
 	// cluster before failing. Use DialRetryWait to control the wait time
 	// between retries.
@@ -261,6 +454,32 @@ type ClusterConnectionConf struct {
 	//
 	// Defaults to 0 which means disabled.
 	MetadataRefreshFrequency time.Duration
+
+	// MetadataVersion is the version of metadata requests used to refresh
+	// cluster metadata. Version 2 and higher (kafka 0.10.1 or newer) is
+	// required to learn the cluster ID.
+	//
+	// Defaults to 0.
+	MetadataVersion int16
+
+	// MaxResponseBytes limits the size of any response read from the
+	// cluster. Requests whose response announces a bigger size fail with
+	// proto.ErrInvalidResponseSize and their connection is closed, before any
+	// memory is allocated for the response.
+	//
+	// Defaults to 0, which means the limit of proto.ReadResp, 256MB.
+	MaxResponseBytes int32
+
+	// MaxMetadataBytes works like MaxResponseBytes for metadata responses,
+	// which are expected to be much smaller than fetch responses.
+	//
+	// Defaults to 0, which means MaxResponseBytes.
+	MaxMetadataBytes int32
+
+	// Metrics, if set, receives connection pool events.
+	//
+	// Defaults to nil.
+	Metrics Metrics
 }
 
 // NewClusterConnectionConf constructs a default configuration.
@@ -268,35 +487,81 @@ func NewClusterConnectionConf() ClusterConnectionConf {
 	return ClusterConnectionConf{
 		ConnectionLimit:          10,
 		IdleConnectionWait:       200 * time.Millisecond,
+		IdleReusePolicy:          IdleReuseFIFO,
 		DialTimeout:              10 * time.Second,
 		DialRetryLimit:           10,
 		DialRetryWait:            500 * time.Millisecond,
 		MetadataRefreshTimeout:   30 * time.Second,
 		MetadataRefreshFrequency: 0,
+		MetadataVersion:          0,
 	}
 }
 
+// Validate returns an error if the configuration cannot be used to connect
+// to a cluster.
+func (conf ClusterConnectionConf) Validate() error {
+	if conf.ConnectionLimit <= 0 {
+		return fmt.Errorf("invalid ConnectionLimit %d: must be positive", conf.ConnectionLimit)
+	}
+	switch conf.IdleReusePolicy {
+	case IdleReuseFIFO, IdleReuseLIFO:
+	default:
+		return fmt.Errorf("invalid IdleReusePolicy %d", conf.IdleReusePolicy)
+	}
+	if conf.DialTimeout <= 0 {
+		return fmt.Errorf("invalid DialTimeout %s: must be positive", conf.DialTimeout)
+	}
+	if conf.DialRetryLimit <= 0 {
+		return fmt.Errorf("invalid DialRetryLimit %d: must be positive", conf.DialRetryLimit)
+	}
+	if conf.MetadataRefreshTimeout <= 0 {
+		return fmt.Errorf("invalid MetadataRefreshTimeout %s: must be positive", conf.MetadataRefreshTimeout)
+	}
+	if conf.MetadataVersion < 0 {
+		return fmt.Errorf("invalid MetadataVersion %d: must not be negative", conf.MetadataVersion)
+	}
+	if conf.MaxResponseBytes < 0 {
+		return fmt.Errorf("invalid MaxResponseBytes %d: must not be negative", conf.MaxResponseBytes)
+	}
+	if conf.MaxMetadataBytes < 0 {
+		return fmt.Errorf("invalid MaxMetadataBytes %d: must not be negative", conf.MaxMetadataBytes)
+	}
+	return validateDurations(
+		durationField{"IdleConnectionWait", conf.IdleConnectionWait},
+		durationField{"ConnectTimeout", conf.ConnectTimeout},
+		durationField{"DialRetryWait", conf.DialRetryWait},
+		durationField{"MetadataRefreshFrequency", conf.MetadataRefreshFrequency},
+	)
+}
+
 // ConnectionPool is a way for us to manage multiple connections to a Kafka broker in a way
 // that balances out throughput with overall number of connections.
-type connectionPool struct {
+type ConnectionPool struct {
 	conf ClusterConnectionConf
 
 	// mu protects the below members of this struct. This mutex must only be used by
-	// connectionPool.
+	// ConnectionPool.
 	mu *sync.RWMutex
 	// The keys of this map is the set of valid connection destinations, as specified by
 	// InitializeAddrs. Adding an addr to this map does not initiate a connection.
 	// If an addr is removed, any active backend pointing to it will be closed and no further
 	// connections can be made.
 	backends map[string]*backend
+
+	clock clock
+	stats *ConnectionPoolStats
 }
 
-// newConnectionPool creates a connection pool and initializes it.
-func newConnectionPool(conf ClusterConnectionConf, nodes []string) *connectionPool {
-	connPool := connectionPool{
+// NewConnectionPool creates a connection pool to the given broker addresses
+// and initializes it. No connection is established until one is requested.
+// See BrokerConf.ConnectionPool for using it with a Broker.
+func NewConnectionPool(conf ClusterConnectionConf, nodes []string) *ConnectionPool {
+	connPool := ConnectionPool{
 		conf:     conf,
 		mu:       &sync.RWMutex{},
 		backends: make(map[string]*backend),
+		clock:    realClock{},
+		stats:    &ConnectionPoolStats{},
 	}
 
 	connPool.InitializeAddrs(nodes)
@@ -305,17 +570,19 @@ func newConnectionPool(conf ClusterConnectionConf, nodes []string) *connectionPo
 }
 
 // newBackend creates a new backend structure.
-func (cp *connectionPool) newBackend(addr string) *backend {
+func (cp *ConnectionPool) newBackend(addr string) *backend {
 	return &backend{
 		mu:      &sync.Mutex{},
 		conf:    cp.conf,
 		addr:    addr,
 		channel: make(chan *connection, cp.conf.ConnectionLimit),
+		clock:   cp.clock,
+		stats:   cp.stats,
 	}
 }
 
 // getBackend fetches a backend for a given address or nil if none exists.
-func (cp *connectionPool) getBackend(addr string) *backend {
+func (cp *ConnectionPool) getBackend(addr string) *backend {
 	cp.mu.RLock()
 	defer cp.mu.RUnlock()
 
@@ -324,7 +591,7 @@ func (cp *connectionPool) getBackend(addr string) *backend {
 
 // GetAllAddrs returns a slice of all addresses we've seen. Can be used for picking a random
 // address or iterating the known brokers.
-func (cp *connectionPool) GetAllAddrs() []string {
+func (cp *ConnectionPool) GetAllAddrs() []string {
 	cp.mu.RLock()
 	defer cp.mu.RUnlock()
 
@@ -340,7 +607,7 @@ func (cp *connectionPool) GetAllAddrs() []string {
 // InitializeAddrs takes in a set of addresses and just sets up the structures for them. This
 // doesn't start any connecting. This is done so that we have a set of addresses for other
 // parts of the system to use.
-func (cp *connectionPool) InitializeAddrs(addrs []string) {
+func (cp *ConnectionPool) InitializeAddrs(addrs []string) {
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
 
@@ -367,35 +634,88 @@ func (cp *connectionPool) InitializeAddrs(addrs []string) {
 
 // GetIdleConnection returns a random idle connection from the set of connections that we
 // happen to have open. If no connections are available or idle, this returns nil.
-func (cp *connectionPool) GetIdleConnection() *connection {
+func (cp *ConnectionPool) GetIdleConnection() *connection {
 	addrs := cp.GetAllAddrs()
 
 	for _, idx := range rndPerm(len(addrs)) {
 		if be := cp.getBackend(addrs[idx]); be != nil {
 			if conn := be.GetIdleConnection(); conn != nil {
+				atomic.AddInt64(&cp.stats.IdleHits, 1)
 				return conn
 			}
 		}
 	}
+	atomic.AddInt64(&cp.stats.IdleMisses, 1)
 	return nil
 }
 
+// Stats returns the connection reuse counters of all backends of the pool
+// since it was created.
+func (cp *ConnectionPool) Stats() ConnectionPoolStats {
+	return ConnectionPoolStats{
+		IdleHits:       atomic.LoadInt64(&cp.stats.IdleHits),
+		IdleMisses:     atomic.LoadInt64(&cp.stats.IdleMisses),
+		NewConnections: atomic.LoadInt64(&cp.stats.NewConnections),
+	}
+}
+
 // GetConnectionByAddr takes an address and returns a valid/open connection to this server.
 // We attempt to reuse connections if we can, but if a connection is not available within
 // IdleConnectionWait then we'll establish a new one. This can block a long time.
 //
 // See comments on GetConnection for details on the error returned.
-func (cp *connectionPool) GetConnectionByAddr(addr string) (*connection, error) {
+func (cp *ConnectionPool) GetConnectionByAddr(addr string) (*connection, error) {
+	return cp.GetConnectionByAddrCtx(context.Background(), addr)
+}
+
+// GetConnectionByAddrCtx works like GetConnectionByAddr, but gives up once
+// ctx is done, returning its error.
+func (cp *ConnectionPool) GetConnectionByAddrCtx(ctx context.Context, addr string) (*connection, error) {
+	if be := cp.getBackend(addr); be != nil {
+		return be.GetConnectionCtx(ctx)
+	}
+	return nil, errors.New("no backend for addr")
+}
+
+// GetTopicConnectionByAddr works like GetConnectionByAddrCtx, but prefers to
+// return the same connection for requests concerning the same topic. This way
+// partitions of a topic sharing a leader share a connection whenever it is
+// not busy with another request.
+func (cp *ConnectionPool) GetTopicConnectionByAddr(ctx context.Context, addr, topic string) (*connection, error) {
 	if be := cp.getBackend(addr); be != nil {
-		return be.GetConnection()
+		return be.GetTopicConnection(ctx, topic)
 	}
 	return nil, errors.New("no backend for addr")
 }
 
+// AnyReachable returns true if a new connection can be established to at least
+// one of the known addresses. Every address is dialed, so this can block up to
+// DialTimeout for each of them.
+func (cp *ConnectionPool) AnyReachable() bool {
+	for _, addr := range cp.GetAllAddrs() {
+		conn, err := newConnection(addr, cp.conf, cp.conf.DialTimeout)
+		if err == nil {
+			_ = conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// CloseConnectionsByAddr closes all connections, idle or in use, to the given
+// address. Later requests to this address will have to dial again.
+func (cp *ConnectionPool) CloseConnectionsByAddr(addr string) error {
+	if be := cp.getBackend(addr); be != nil {
+		be.CloseConnections()
+		return nil
+	}
+	return errors.New("no backend for addr")
+}
+
 // Idle takes a now idle connection and makes it available for other users. This should be
 // called in a goroutine so as not to block the original caller, as this function may take
 // some time to return.
-func (cp *connectionPool) Idle(conn *connection) {
+func (cp *ConnectionPool) Idle(conn *connection) {
 	if conn == nil {
 		return
 	}
@@ -1,6 +1,8 @@
 package kafka
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"github.com/discord/zorkian-kafka/proto"
@@ -25,7 +27,7 @@ func (s *ConnectionPoolSuite) TestConnectionLimit(c *C) {
 	conf.ClusterConnectionConf.ConnectionLimit = 2
 	conf.ClusterConnectionConf.DialTimeout = 1 * time.Second
 	addresses := []string{srv.Address()}
-	cp := newConnectionPool(conf.ClusterConnectionConf, addresses)
+	cp := NewConnectionPool(conf.ClusterConnectionConf, addresses)
 	cp.InitializeAddrs(addresses)
 	be := cp.getBackend(srv.Address())
 
@@ -84,6 +86,131 @@ func (s *ConnectionPoolSuite) TestConnectionLimit(c *C) {
 	c.Assert(be.NumOpenConnections(), Equals, 1)
 }
 
+func (s *ConnectionPoolSuite) TestIdleReusePolicy(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	for _, policy := range []IdleReusePolicy{IdleReuseFIFO, IdleReuseLIFO} {
+		conf := NewClusterConnectionConf()
+		conf.ConnectionLimit = 3
+		conf.DialTimeout = time.Second
+		conf.IdleReusePolicy = policy
+		addresses := []string{srv.Address()}
+		cp := NewConnectionPool(conf, addresses)
+		cp.InitializeAddrs(addresses)
+		be := cp.getBackend(srv.Address())
+
+		conns := make([]*connection, 3)
+		for i := range conns {
+			conn, err := be.GetConnection()
+			c.Assert(err, IsNil)
+			conns[i] = conn
+		}
+		// idled in order 0, 1, 2
+		for _, conn := range conns {
+			be.Idle(conn)
+		}
+
+		want := []*connection{conns[0], conns[1], conns[2]}
+		if policy == IdleReuseLIFO {
+			want = []*connection{conns[2], conns[1], conns[0]}
+		}
+		c.Assert(be.GetIdleConnection(), Equals, want[0])
+		conn, err := be.GetConnection()
+		c.Assert(err, IsNil)
+		c.Assert(conn, Equals, want[1])
+		c.Assert(be.GetIdleConnection(), Equals, want[2])
+		c.Assert(be.GetIdleConnection(), IsNil)
+
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+}
+
+func (s *ConnectionPoolSuite) TestConnectionReuseStats(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	conf := NewBrokerConf("foo")
+	conf.ClusterConnectionConf.ConnectionLimit = 2
+	conf.ClusterConnectionConf.DialTimeout = 1 * time.Second
+	addresses := []string{srv.Address()}
+	cp := NewConnectionPool(conf.ClusterConnectionConf, addresses)
+	c.Assert(cp.Stats(), DeepEquals, ConnectionPoolStats{})
+
+	// nothing idle yet, a new connection is established
+	c.Assert(cp.GetIdleConnection(), IsNil)
+	conn, err := cp.GetConnectionByAddr(srv.Address())
+	c.Assert(err, IsNil)
+	c.Assert(cp.Stats(), DeepEquals, ConnectionPoolStats{IdleMisses: 2, NewConnections: 1})
+
+	// idled connection is reused by both ways of getting one
+	cp.Idle(conn)
+	conn = cp.GetIdleConnection()
+	c.Assert(conn, NotNil)
+	cp.Idle(conn)
+	conn, err = cp.GetConnectionByAddr(srv.Address())
+	c.Assert(err, IsNil)
+	c.Assert(cp.Stats(), DeepEquals, ConnectionPoolStats{IdleHits: 2, IdleMisses: 2, NewConnections: 1})
+
+	// second connection has to be established, third is over the limit
+	conn2, err := cp.GetConnectionByAddr(srv.Address())
+	c.Assert(err, IsNil)
+	_, err = cp.GetConnectionByAddr(srv.Address())
+	c.Assert(err, NotNil)
+	c.Assert(cp.Stats(), DeepEquals, ConnectionPoolStats{IdleHits: 2, IdleMisses: 4, NewConnections: 2})
+
+	cp.Idle(conn)
+	cp.Idle(conn2)
+	c.Assert(cp.GetIdleConnection(), NotNil)
+	c.Assert(cp.GetIdleConnection(), NotNil)
+	c.Assert(cp.GetIdleConnection(), IsNil)
+	c.Assert(cp.Stats(), DeepEquals, ConnectionPoolStats{IdleHits: 4, IdleMisses: 5, NewConnections: 2})
+}
+
+type countingMetrics struct {
+	mu        sync.Mutex
+	exhausted []string
+}
+
+func (m *countingMetrics) IncConnectionPoolExhausted(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.exhausted = append(m.exhausted, addr)
+}
+
+func (s *ConnectionPoolSuite) TestConnectionPoolExhaustedMetrics(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	metrics := &countingMetrics{}
+	conf := NewClusterConnectionConf()
+	conf.ConnectionLimit = 1
+	conf.DialTimeout = 500 * time.Millisecond
+	conf.IdleConnectionWait = 50 * time.Millisecond
+	conf.Metrics = metrics
+
+	addresses := []string{srv.Address()}
+	cp := NewConnectionPool(conf, addresses)
+	cp.InitializeAddrs(addresses)
+
+	conn, err := cp.GetConnectionByAddr(srv.Address())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	c.Assert(metrics.exhausted, HasLen, 0)
+
+	_, err = cp.GetConnectionByAddr(srv.Address())
+	_, ok := err.(*NoConnectionsAvailable)
+	c.Assert(ok, Equals, true)
+	metrics.mu.Lock()
+	c.Assert(metrics.exhausted, DeepEquals, []string{srv.Address()})
+	metrics.mu.Unlock()
+}
+
 func (s *ConnectionPoolSuite) TestGetConnectionError(c *C) {
 	srv := NewServer()
 	srv.Start()
@@ -94,7 +221,7 @@ func (s *ConnectionPoolSuite) TestGetConnectionError(c *C) {
 	conf.IdleConnectionWait = 200 * time.Millisecond
 
 	addresses := []string{srv.Address()}
-	cp := newConnectionPool(conf, addresses)
+	cp := NewConnectionPool(conf, addresses)
 	cp.InitializeAddrs([]string{srv.Address()})
 	be := cp.getBackend(srv.Address())
 
@@ -130,9 +257,51 @@ func (s *ConnectionPoolSuite) TestGetConnectionError(c *C) {
 	c.Assert(conn3, IsNil)
 }
 
+func (s *ConnectionPoolSuite) TestCloseConnectionsDrainsIdle(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	conf := NewClusterConnectionConf()
+	conf.ConnectionLimit = 2
+	addresses := []string{srv.Address()}
+	cp := NewConnectionPool(conf, addresses)
+	be := cp.getBackend(srv.Address())
+
+	var conns []*connection
+	for i := 0; i < conf.ConnectionLimit; i++ {
+		conn, err := be.getNewConnection(context.Background())
+		c.Assert(err, IsNil)
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		be.Idle(conn)
+	}
+	c.Assert(len(be.channel), Equals, conf.ConnectionLimit)
+
+	be.CloseConnections()
+	c.Assert(len(be.channel), Equals, 0)
+
+	// the pool is filled again, and all connections fit back in
+	conns = conns[:0]
+	for i := 0; i < conf.ConnectionLimit; i++ {
+		conn, err := be.getNewConnection(context.Background())
+		c.Assert(err, IsNil)
+		c.Assert(conn, NotNil)
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		be.Idle(conn)
+		c.Assert(conn.IsClosed(), Equals, false)
+	}
+	c.Assert(len(be.channel), Equals, conf.ConnectionLimit)
+	c.Assert(be.NumOpenConnections(), Equals, conf.ConnectionLimit)
+	be.Close()
+}
+
 func (s *ConnectionPoolSuite) TestTrimDeadAddrs(c *C) {
 	addresses := []string{"foo", "bar", "baz"}
-	cp := newConnectionPool(NewClusterConnectionConf(), addresses)
+	cp := NewConnectionPool(NewClusterConnectionConf(), addresses)
 	cp.InitializeAddrs(addresses)
 	c.Assert(len(cp.GetAllAddrs()), Equals, 3)
 	c.Assert(cp.getBackend("foo"), NotNil)
@@ -142,3 +311,35 @@ func (s *ConnectionPoolSuite) TestTrimDeadAddrs(c *C) {
 	c.Assert(cp.getBackend("qux"), NotNil)
 	c.Assert(cp.getBackend("foo"), IsNil)
 }
+
+func (s *ConnectionPoolSuite) TestClusterConnectionConfValidate(c *C) {
+	c.Assert(NewClusterConnectionConf().Validate(), IsNil)
+
+	cases := []struct {
+		modify func(*ClusterConnectionConf)
+		err    string
+	}{
+		{func(conf *ClusterConnectionConf) { conf.ConnectionLimit = 0 }, "invalid ConnectionLimit 0: must be positive"},
+		{func(conf *ClusterConnectionConf) { conf.IdleReusePolicy = 7 }, "invalid IdleReusePolicy 7"},
+		{func(conf *ClusterConnectionConf) { conf.DialTimeout = 0 }, "invalid DialTimeout 0s: must be positive"},
+		{func(conf *ClusterConnectionConf) { conf.DialRetryLimit = 0 }, "invalid DialRetryLimit 0: must be positive"},
+		{func(conf *ClusterConnectionConf) { conf.MetadataRefreshTimeout = 0 }, "invalid MetadataRefreshTimeout 0s: must be positive"},
+		{func(conf *ClusterConnectionConf) { conf.MetadataVersion = -1 }, "invalid MetadataVersion -1: must not be negative"},
+		{func(conf *ClusterConnectionConf) { conf.MaxResponseBytes = -1 }, "invalid MaxResponseBytes -1: must not be negative"},
+		{func(conf *ClusterConnectionConf) { conf.MaxMetadataBytes = -1 }, "invalid MaxMetadataBytes -1: must not be negative"},
+		{func(conf *ClusterConnectionConf) { conf.IdleConnectionWait = -time.Second }, "invalid IdleConnectionWait -1s: must not be negative"},
+		{func(conf *ClusterConnectionConf) { conf.ConnectTimeout = -time.Second }, "invalid ConnectTimeout -1s: must not be negative"},
+		{func(conf *ClusterConnectionConf) { conf.DialRetryWait = -time.Second }, "invalid DialRetryWait -1s: must not be negative"},
+		{func(conf *ClusterConnectionConf) { conf.MetadataRefreshFrequency = -time.Second }, "invalid MetadataRefreshFrequency -1s: must not be negative"},
+	}
+	for _, tc := range cases {
+		conf := NewClusterConnectionConf()
+		tc.modify(&conf)
+		c.Assert(conf.Validate(), ErrorMatches, tc.err)
+	}
+
+	conf := NewClusterConnectionConf()
+	conf.DialRetryLimit = 0
+	_, err := NewCluster([]string{"localhost:1"}, conf)
+	c.Assert(err, ErrorMatches, "invalid DialRetryLimit 0: must be positive")
+}
@@ -1,9 +1,14 @@
 package kafka
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -111,6 +116,57 @@ func testServer3() (net.Listener, error) {
 	return ln, nil
 }
 
+// testChunkedServer works like testServer, but writes every response in
+// chunks of chunkSize bytes with a short pause in between, so that the reader
+// sees the response split across multiple TCP segments.
+func testChunkedServer(chunkSize int, messages ...serializableMessage) (net.Listener, error) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	responses := make([][]byte, len(messages))
+	for i, m := range messages {
+		b, err := m.Bytes()
+		if err != nil {
+			_ = ln.Close()
+			return nil, err
+		}
+		responses[i] = b
+	}
+
+	go func() {
+		for {
+			cli, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer func() { _ = conn.Close() }()
+
+				if tc, ok := conn.(*net.TCPConn); ok {
+					_ = tc.SetNoDelay(true)
+				}
+				for _, resp := range responses {
+					for len(resp) > 0 {
+						n := chunkSize
+						if n > len(resp) {
+							n = len(resp)
+						}
+						if _, err := conn.Write(resp[:n]); err != nil {
+							return
+						}
+						resp = resp[n:]
+						time.Sleep(time.Millisecond)
+					}
+				}
+			}(cli)
+		}
+	}()
+	return ln, nil
+}
+
 func (s *ConnectionSuite) TestConnectionMetadata(c *C) {
 	resp1 := &proto.MetadataResp{
 		CorrelationID: 1,
@@ -358,6 +414,133 @@ func (s *ConnectionSuite) TestConnectionFetch(c *C) {
 	}
 }
 
+func (s *ConnectionSuite) TestConnectionFetchChunkedResponse(c *C) {
+	messages := make([]*proto.Message, 0, 50)
+	for i := 0; i < 50; i++ {
+		m := &proto.Message{
+			Offset:    int64(i),
+			Key:       []byte(fmt.Sprintf("key-%d", i)),
+			Value:     []byte(strings.Repeat("v", 100+i)),
+			TipOffset: 50,
+		}
+		m.Crc = proto.ComputeCrc(m, proto.CompressionNone)
+		messages = append(messages, m)
+	}
+
+	resp1 := &proto.FetchResp{
+		CorrelationID: 1,
+		Topics: []proto.FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []proto.FetchRespPartition{
+					{
+						ID:        0,
+						TipOffset: 50,
+						Messages:  messages,
+					},
+				},
+			},
+		},
+	}
+	ln, err := testChunkedServer(7, resp1)
+	if err != nil {
+		c.Fatalf("test server error: %s", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	if err != nil {
+		c.Fatalf("could not connect to test server: %s", err)
+	}
+	resp, err := conn.Fetch(&proto.FetchReq{
+		CorrelationID: 1,
+		ClientID:      "tester",
+		Topics: []proto.FetchReqTopic{
+			{
+				Name: "foo",
+				Partitions: []proto.FetchReqPartition{
+					{
+						ID:          0,
+						FetchOffset: 0,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		c.Fatalf("could not fetch response: %s", err)
+	}
+
+	for _, m := range messages {
+		m.Topic = "foo"
+		m.Partition = 0
+	}
+	if !reflect.DeepEqual(resp, resp1) {
+		c.Fatalf("expected different response %#v", resp)
+	}
+}
+
+func (s *ConnectionSuite) TestConnectionResponseSizeGuard(c *C) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		c.Fatalf("test server error: %s", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	go func() {
+		cli, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = cli.Close() }()
+
+		// Corrupt size prefix claiming a ~2GB response, followed by the
+		// correlation ID the client is waiting for.
+		_, _ = cli.Write([]byte{0x7f, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x1})
+		_, _ = cli.Read(make([]byte, 1024))
+	}()
+
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	if err != nil {
+		c.Fatalf("could not connect to test server: %s", err)
+	}
+	_, err = conn.Metadata(&proto.MetadataReq{
+		CorrelationID: 1,
+		ClientID:      "tester",
+	})
+	c.Assert(err, Equals, proto.ErrInvalidResponseSize)
+	c.Assert(conn.IsClosed(), Equals, true)
+}
+
+func (s *ConnectionSuite) TestConnectionMaxMetadataBytes(c *C) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer func() { _ = ln.Close() }()
+
+	go func() {
+		cli, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = cli.Close() }()
+
+		// size prefix of a 100MB response, which is below the default limit
+		_, _ = cli.Write([]byte{0x06, 0x40, 0x00, 0x00, 0x0, 0x0, 0x0, 0x1})
+		_, _ = cli.Read(make([]byte, 1024))
+	}()
+
+	conf := NewClusterConnectionConf()
+	conf.MaxMetadataBytes = 1024 * 1024
+	conn, err := newConnection(ln.Addr().String(), conf, time.Second)
+	c.Assert(err, IsNil)
+	_, err = conn.Metadata(&proto.MetadataReq{
+		CorrelationID: 1,
+		ClientID:      "tester",
+	})
+	c.Assert(err, Equals, proto.ErrInvalidResponseSize)
+	c.Assert(conn.IsClosed(), Equals, true)
+}
+
 func (s *ConnectionSuite) TestConnectionOffset(c *C) {
 	resp1 := &proto.OffsetResp{
 		CorrelationID: 1,
@@ -405,6 +588,51 @@ func (s *ConnectionSuite) TestConnectionOffset(c *C) {
 	}
 }
 
+func (s *ConnectionSuite) TestConnectionCorrelationMismatch(c *C) {
+	resp1 := &proto.OffsetResp{
+		CorrelationID: 2,
+		Topics: []proto.OffsetRespTopic{
+			{
+				Name: "test",
+				Partitions: []proto.OffsetRespPartition{
+					{ID: 0, Offsets: []int64{92, 0}},
+				},
+			},
+		},
+	}
+	ln, err := testServer(resp1)
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	addr := ln.Addr().String()
+	conf := NewBrokerConf("tester")
+	pool := NewConnectionPool(conf.ClusterConnectionConf, []string{addr})
+	be := pool.getBackend(addr)
+	conn, err := pool.GetConnectionByAddr(addr)
+	c.Assert(err, IsNil)
+	c.Assert(be.NumOpenConnections(), Equals, 1)
+
+	_, err = conn.Offset(&proto.OffsetReq{
+		CorrelationID: 1,
+		ClientID:      "tester",
+		Topics: []proto.OffsetReqTopic{
+			{
+				Name: "test",
+				Partitions: []proto.OffsetReqPartition{
+					{ID: 0, TimeMs: -2, MaxOffsets: 2},
+				},
+			},
+		},
+	})
+	c.Assert(err, Equals, ErrCorrelationMismatch)
+	c.Assert(conn.IsClosed(), Equals, true)
+
+	// the pool discards the connection instead of reusing it
+	pool.Idle(conn)
+	c.Assert(be.NumOpenConnections(), Equals, 0)
+	c.Assert(pool.GetIdleConnection(), IsNil)
+}
+
 func (s *ConnectionSuite) TestConnectionProduceNoAck(c *C) {
 	ln, err := testServer()
 	if err != nil {
@@ -567,3 +795,106 @@ func (s *ConnectionSuite) TestConnectionReaderAfterEOF(c *C) {
 		c.Fatal("fetching from closed connection succeeded")
 	}
 }
+
+// deadlineConn records the deadlines set on the connection it wraps.
+type deadlineConn struct {
+	net.Conn
+
+	mu        sync.Mutex
+	deadlines []time.Time
+}
+
+func (d *deadlineConn) SetDeadline(t time.Time) error {
+	d.mu.Lock()
+	d.deadlines = append(d.deadlines, t)
+	d.mu.Unlock()
+	return d.Conn.SetDeadline(t)
+}
+
+func (d *deadlineConn) recorded() []time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]time.Time(nil), d.deadlines...)
+}
+
+func (s *ConnectionSuite) TestConnectionContextDeadline(c *C) {
+	// server reading requests, but never answering them
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+	go func() {
+		for {
+			cli, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				_, _ = io.Copy(ioutil.Discard, conn)
+			}(cli)
+		}
+	}()
+
+	conn, err := newTCPConnection(ln.Addr().String(), 5*time.Second)
+	c.Assert(err, IsNil)
+	rec := &deadlineConn{Conn: conn.rw.(net.Conn)}
+	conn.rw = rec
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	start := time.Now()
+	_, err = conn.ProduceCtx(ctx, &proto.ProduceReq{
+		ClientID:     "tester",
+		RequiredAcks: proto.RequiredAcksAll,
+		Timeout:      5 * time.Second,
+		Topics: []proto.ProduceReqTopic{
+			{
+				Name: "first",
+				Partitions: []proto.ProduceReqPartition{
+					{ID: 0, Messages: []*proto.Message{{Value: []byte("value")}}},
+				},
+			},
+		},
+	})
+	elapsed := time.Since(start)
+	c.Assert(err, Equals, context.DeadlineExceeded)
+	c.Assert(elapsed < time.Second, Equals, true, Commentf("failed after %s", elapsed))
+	c.Assert(conn.IsClosed(), Equals, true)
+
+	deadlines := rec.recorded()
+	c.Assert(len(deadlines) > 0, Equals, true)
+	c.Assert(deadlines[0].Equal(deadline), Equals, true,
+		Commentf("deadline %s, expected %s", deadlines[0], deadline))
+}
+
+func (s *ConnectionSuite) TestConnectionConnectTimeout(c *C) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	conf := NewClusterConnectionConf()
+	conf.ConnectTimeout = time.Nanosecond
+	_, err = newConnection(ln.Addr().String(), conf, 5*time.Second)
+	c.Assert(err, NotNil)
+	ne, ok := err.(net.Error)
+	c.Assert(ok && ne.Timeout(), Equals, true, Commentf("error %#v", err))
+
+	// connecting falls back to the dial timeout
+	conf.ConnectTimeout = 0
+	conn, err := newConnection(ln.Addr().String(), conf, 5*time.Second)
+	c.Assert(err, IsNil)
+	_ = conn.Close()
+}
+
+func (s *ConnectionSuite) TestConnectionDialCancel(c *C) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = newConnectionCtx(ctx, ln.Addr().String(), NewClusterConnectionConf(), 5*time.Second)
+	c.Assert(err, Equals, context.Canceled)
+}
@@ -0,0 +1,68 @@
+package kafka
+
+import (
+	"container/list"
+	"time"
+)
+
+// keyDeduper remembers the keys of recently delivered messages, so that
+// messages with the same key delivered again within the window can be
+// dropped. At most size keys are remembered; the least recently delivered
+// ones are forgotten first.
+type keyDeduper struct {
+	window time.Duration
+	size   int
+	clock  clock
+
+	order *list.List // of *dedupeEntry, most recently delivered first
+	keys  map[string]*list.Element
+}
+
+type dedupeEntry struct {
+	key       string
+	delivered time.Time
+}
+
+// newKeyDeduper returns a deduper for given window and number of keys,
+// measuring time using given clock. Zero or negative window or size disables
+// deduplication, in which case nil is returned; duplicate is a no-op on a nil
+// deduper.
+func newKeyDeduper(window time.Duration, size int, clk clock) *keyDeduper {
+	if window <= 0 || size <= 0 {
+		return nil
+	}
+	return &keyDeduper{
+		window: window,
+		size:   size,
+		clock:  clk,
+		order:  list.New(),
+		keys:   make(map[string]*list.Element),
+	}
+}
+
+// duplicate reports whether a message with given key was delivered within
+// the window. Otherwise the key is recorded as delivered now. Messages
+// without a key are never duplicates.
+func (d *keyDeduper) duplicate(key []byte) bool {
+	if d == nil || key == nil {
+		return false
+	}
+	now := d.clock.Now()
+	if el, ok := d.keys[string(key)]; ok {
+		entry := el.Value.(*dedupeEntry)
+		if now.Sub(entry.delivered) < d.window {
+			return true
+		}
+		entry.delivered = now
+		d.order.MoveToFront(el)
+		return false
+	}
+
+	d.keys[string(key)] = d.order.PushFront(&dedupeEntry{key: string(key), delivered: now})
+	if d.order.Len() > d.size {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.keys, oldest.Value.(*dedupeEntry).key)
+	}
+	return false
+}
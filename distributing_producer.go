@@ -1,8 +1,10 @@
 package kafka
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"math/rand"
 	"sync"
 	"sync/atomic"
@@ -14,14 +16,55 @@ import (
 
 var ErrNoPartitionsAvailable = errors.New("all partitions suspended due to previous failures, refusing to produce")
 
+// ErrNoPartitions is returned when writing to a topic that reports no
+// partitions, which happens for a short time while the topic is created.
+var ErrNoPartitions = errors.New("topic has no partitions")
+
+// ErrDistributeTimeout is returned for messages that could not be written
+// within the DistributeTimeout of an errorAverseRRProducer. Messages of a
+// produce request already sent when the time ran out may still have been
+// written by the broker.
+var ErrDistributeTimeout = errors.New("distribute timeout exceeded")
+
+// ErrProducerClosed is returned when writing with a Producer or
+// DistributingProducer that was already closed.
+var ErrProducerClosed = errors.New("producer closed")
+
 // DistributingProducer is the interface similar to Producer, but never require
 // to explicitly specify partition.
 //
 // Distribute writes messages to the given topic, automatically choosing
 // partition, returning the post-commit offset and any error encountered. The
 // offset of each message is also updated accordingly.
+//
+// Close writes any messages accumulated by the producer and stops its
+// background work. It returns nil right away for producers that do not
+// accumulate messages.
 type DistributingProducer interface {
 	Distribute(topic string, messages ...*proto.Message) (partition int32, offset int64, err error)
+	Close() error
+}
+
+// DistributeResult is the outcome of writing a part of a batch to a single
+// partition. Offset is the offset of the first message and is only set when
+// Err is nil.
+type DistributeResult struct {
+	Partition int32
+	Offset    int64
+	Messages  []*proto.Message
+	Err       error
+}
+
+// BatchDistributingProducer is a DistributingProducer that can also spread a
+// single batch of messages over multiple partitions.
+//
+// DistributeBatch splits messages into one part per partition of the topic
+// and writes every part to a different partition. Failure to write one part
+// does not affect the others. The result contains an entry for each part, in
+// the order of messages, so that only the failed messages can be retried.
+type BatchDistributingProducer interface {
+	DistributingProducer
+	DistributeBatch(topic string, messages ...*proto.Message) []DistributeResult
 }
 
 // PartitionCountSource lets a DistributingProducer determine how many
@@ -31,6 +74,18 @@ type PartitionCountSource interface {
 	PartitionCount(topic string) (count int32, err error)
 }
 
+// HashPartition returns the partition in [0, partitions) a message with given
+// key is routed to when partitioning by key hash, using the 32 bit FNV-1a
+// hash of the key.
+func HashPartition(key []byte, partitions int32) int32 {
+	if partitions <= 0 {
+		return 0
+	}
+	hasher := fnv.New32a()
+	_, _ = hasher.Write(key)
+	return int32(hasher.Sum32() % uint32(partitions))
+}
+
 // ErrorAverseRRProducerOpts controls the behavior of errorAverseRRProducer.
 // PartitionCountSource: required
 // Producer: required
@@ -39,11 +94,27 @@ type PartitionCountSource interface {
 // PartitionFetchTimeout: optional. Controls how long Distribute will wait
 // to get a partition in the case where they are all unavailable due to
 // error averse backoff.
+// DistributeTimeout: optional. Bounds the total time of a single Distribute
+// or DistributeBatch call, shared by the produce retries of all partitions
+// written. Messages not written in time fail with ErrDistributeTimeout. Zero
+// means no limit.
+// PartitionSelector: optional. Returns the order in which the partitions of a
+// topic are first written, given the partition count. Defaults to a random
+// permutation; tests can set a fixed order to make the rotation predictable.
+// PartitionByKey: optional. Makes DistributeBatch write every message with a
+// key to the partition HashPartition computes for it, so that a batch of
+// mixed keys is scattered over their partitions. Messages without a key are
+// still spread round robin. Those partitions are written even while
+// suspended after errors, as keyed messages cannot go anywhere else.
+// Distribute is not affected.
 type errorAverseRRProducerConf struct {
 	PartitionCountSource  PartitionCountSource
 	Producer              Producer
 	ErrorAverseBackoff    *backoff.Backoff
 	PartitionFetchTimeout time.Duration
+	DistributeTimeout     time.Duration
+	PartitionSelector     func(partitionCount int32) []int32
+	PartitionByKey        bool
 }
 
 func NewErrorAverseRRProducerConf() *errorAverseRRProducerConf {
@@ -57,7 +128,20 @@ func NewErrorAverseRRProducerConf() *errorAverseRRProducerConf {
 			Jitter: true,
 		},
 		PartitionFetchTimeout: time.Duration(10 * time.Second),
+		DistributeTimeout:     0,
+		PartitionSelector:     randomPartitionOrder,
+		PartitionByKey:        false,
+	}
+}
+
+// randomPartitionOrder returns the partitions in random order, to decorrelate
+// publish partitions when many producers are restarted at once.
+func randomPartitionOrder(partitionCount int32) []int32 {
+	order := make([]int32, partitionCount)
+	for i, p := range rand.Perm(int(partitionCount)) {
+		order[i] = int32(p)
 	}
+	return order
 }
 
 // errorAverseRRProducer writes to a topic's partitions in order sequentially
@@ -67,48 +151,224 @@ type errorAverseRRProducer struct {
 	partitionCountSource PartitionCountSource
 	producer             Producer
 	partitionManager     *partitionManager
+	distributeTimeout    time.Duration
+	partitionByKey       bool
+	clock                clock
 }
 
-func NewErrorAverseRRProducer(conf *errorAverseRRProducerConf) DistributingProducer {
+func NewErrorAverseRRProducer(conf *errorAverseRRProducerConf) BatchDistributingProducer {
 	return &errorAverseRRProducer{
 		partitionCountSource: conf.PartitionCountSource,
 		producer:             conf.Producer,
+		distributeTimeout:    conf.DistributeTimeout,
+		partitionByKey:       conf.PartitionByKey,
+		clock:                realClock{},
 		partitionManager: &partitionManager{
 			availablePartitions: make(map[string]chan *partitionData),
 			lock:                &sync.RWMutex{},
 			sharedRetry:         conf.ErrorAverseBackoff,
 			getTimeout:          conf.PartitionFetchTimeout,
+			selector:            conf.PartitionSelector,
 		}}
 }
 
 func (d *errorAverseRRProducer) Distribute(topic string, messages ...*proto.Message) (int32, int64, error) {
+	deadline := d.deadline()
+	if _, err := d.updatePartitionCount(topic); err != nil {
+		return 0, 0, err
+	}
 
-	if count, err := d.partitionCountSource.PartitionCount(topic); err == nil {
-		d.partitionManager.SetPartitionCount(topic, count)
-	} else {
+	partition, offset, err := d.distribute(topic, deadline, messages...)
+	if err != nil {
+		return 0, 0, err
+	}
+	return partition, offset, nil
+}
+
+func (d *errorAverseRRProducer) DistributeBatch(topic string, messages ...*proto.Message) []DistributeResult {
+	deadline := d.deadline()
+	count, err := d.updatePartitionCount(topic)
+	if err != nil {
+		return []DistributeResult{{Partition: -1, Messages: messages, Err: err}}
+	}
+
+	if d.partitionByKey {
+		return d.distributeByKey(topic, count, deadline, messages)
+	}
+	return d.distributeEvenly(topic, count, deadline, messages)
+}
+
+// distributeEvenly splits messages into one part per partition and writes
+// every part to the next available partition.
+func (d *errorAverseRRProducer) distributeEvenly(topic string, count int32, deadline time.Time, messages []*proto.Message) []DistributeResult {
+	parts := int(count)
+	if parts > len(messages) {
+		parts = len(messages)
+	}
+	results := make([]DistributeResult, 0, parts)
+	for i := 0; i < parts; i++ {
+		// spread messages evenly, keeping their order
+		start := i * len(messages) / parts
+		end := (i + 1) * len(messages) / parts
+		chunk := messages[start:end]
+
+		partition, offset, err := d.distribute(topic, deadline, chunk...)
+		results = append(results, DistributeResult{
+			Partition: partition,
+			Offset:    offset,
+			Messages:  chunk,
+			Err:       err,
+		})
+	}
+	return results
+}
+
+// distributeByKey writes messages with a key to their hashed partition, one
+// part per partition in the order the partitions first appear in messages.
+// Messages without a key are distributed evenly, after the keyed parts.
+func (d *errorAverseRRProducer) distributeByKey(topic string, count int32, deadline time.Time, messages []*proto.Message) []DistributeResult {
+	var order []int32
+	byPartition := make(map[int32][]*proto.Message)
+	var unkeyed []*proto.Message
+	for _, msg := range messages {
+		if msg.Key == nil {
+			unkeyed = append(unkeyed, msg)
+			continue
+		}
+		partition := HashPartition(msg.Key, count)
+		if _, ok := byPartition[partition]; !ok {
+			order = append(order, partition)
+		}
+		byPartition[partition] = append(byPartition[partition], msg)
+	}
+
+	results := make([]DistributeResult, 0, len(order)+1)
+	for _, partition := range order {
+		chunk := byPartition[partition]
+		offset, err := d.distributeTo(topic, partition, deadline, chunk...)
+		results = append(results, DistributeResult{
+			Partition: partition,
+			Offset:    offset,
+			Messages:  chunk,
+			Err:       err,
+		})
+	}
+	if len(unkeyed) > 0 {
+		results = append(results, d.distributeEvenly(topic, count, deadline, unkeyed)...)
+	}
+	return results
+}
+
+// Close does nothing, messages are written before Distribute returns.
+func (d *errorAverseRRProducer) Close() error {
+	return nil
+}
+
+// updatePartitionCount refreshes the partition count of the topic known to the
+// partition manager and returns it. A topic without partitions is not ready to
+// be written to yet, and ErrNoPartitions is returned for it.
+func (d *errorAverseRRProducer) updatePartitionCount(topic string) (int32, error) {
+	count, err := d.partitionCountSource.PartitionCount(topic)
+	if err != nil {
 		// This topic doesn't exist, so we pretend it has one partition for now.
-		d.partitionManager.SetPartitionCount(topic, 1)
+		count = 1
+	} else if count <= 0 {
+		return 0, ErrNoPartitions
+	}
+	d.partitionManager.SetPartitionCount(topic, count)
+	return count, nil
+}
+
+// deadline returns the time by which the current distribute call must be
+// done, or zero time if there is no limit.
+func (d *errorAverseRRProducer) deadline() time.Time {
+	if d.distributeTimeout <= 0 {
+		return time.Time{}
+	}
+	return d.clock.Now().Add(d.distributeTimeout)
+}
+
+// expired returns true if deadline is set and has passed.
+func (d *errorAverseRRProducer) expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !d.clock.Now().Before(deadline)
+}
+
+// produce writes messages to the given partition, giving up at deadline
+// unless it is zero. Once the time is up the producer's error is replaced by
+// ErrDistributeTimeout. The write is done when produce returns, so the
+// messages can be retried right away.
+func (d *errorAverseRRProducer) produce(topic string, partition int32, deadline time.Time, messages ...*proto.Message) (int64, error) {
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
 	}
+	offset, err := d.producer.ProduceCtx(ctx, topic, partition, messages...)
+	if err != nil && (ctx.Err() != nil || d.expired(deadline)) {
+		log.Errorf("Timed out producing [%s:%d]: %s", topic, partition, err)
+		return 0, ErrDistributeTimeout
+	}
+	return offset, err
+}
 
-	partitionData, err := d.partitionManager.GetPartition(topic)
+// distribute writes messages to the next available partition. The partition
+// is returned even if writing fails, or -1 if no partition was available.
+// When deadline is not zero, distribute gives up at that time and returns
+// ErrDistributeTimeout.
+func (d *errorAverseRRProducer) distribute(topic string, deadline time.Time, messages ...*proto.Message) (int32, int64, error) {
+	getTimeout := d.partitionManager.getTimeout
+	if !deadline.IsZero() {
+		remaining := deadline.Sub(d.clock.Now())
+		if remaining <= 0 {
+			return -1, 0, ErrDistributeTimeout
+		}
+		if remaining < getTimeout {
+			getTimeout = remaining
+		}
+	}
+	partitionData, err := d.partitionManager.getPartition(topic, getTimeout)
 	if err != nil {
 		log.Error(err.Error())
-		return 0, 0, ErrNoPartitionsAvailable
+		if d.expired(deadline) {
+			return -1, 0, ErrDistributeTimeout
+		}
+		return -1, 0, ErrNoPartitionsAvailable
 	}
 
 	// We are now obligated to call Success or Failure on partitionData.
-	var offset int64
-	offset, err = d.producer.Produce(topic, partitionData.Partition, messages...)
+	offset, err := d.produce(topic, partitionData.Partition, deadline, messages...)
 	if err != nil {
-		log.Errorf("Failed to produce [%s:%d]: %s", topic, partitionData.Partition, err)
-		partitionData.Failure()
-		return 0, 0, err
+		if err != ErrDistributeTimeout {
+			log.Errorf("Failed to produce [%s:%d]: %s", topic, partitionData.Partition, err)
+		}
+		if err != proto.ErrMessageSizeTooLarge {
+			// Messages too large to be written say nothing about the health
+			// of the partition, so it is not suspended for them.
+			partitionData.Failure()
+		}
+		return partitionData.Partition, 0, err
 	}
-
 	partitionData.Success()
 	return partitionData.Partition, offset, nil
 }
 
+// distributeTo writes messages to the given partition, whether it is
+// suspended or not.
+func (d *errorAverseRRProducer) distributeTo(topic string, partition int32, deadline time.Time, messages ...*proto.Message) (int64, error) {
+	if d.expired(deadline) {
+		return 0, ErrDistributeTimeout
+	}
+	offset, err := d.produce(topic, partition, deadline, messages...)
+	if err != nil {
+		if err != ErrDistributeTimeout {
+			log.Errorf("Failed to produce [%s:%d]: %s", topic, partition, err)
+		}
+		return 0, err
+	}
+	return offset, nil
+}
+
 // partitionData wraps a retry tracker and the partitionManager's chan for
 // a particular partition. We have a pointer to the chan instead of the
 // partitionManager because the partitionManager will throw away and rebuild
@@ -192,6 +452,7 @@ type partitionManager struct {
 	lock                *sync.RWMutex
 	sharedRetry         *backoff.Backoff
 	getTimeout          time.Duration
+	selector            func(partitionCount int32) []int32
 }
 
 // GetPartitionCount returns the size of a topic's availablePartitions chan.
@@ -226,10 +487,13 @@ func (p *partitionManager) SetPartitionCount(topic string, partitionCount int32)
 			topic, cap(availablePartitions), partitionCount)
 
 		availablePartitions = make(chan *partitionData, partitionCount)
-		// Randomize the order of partitions to decorrelate publish partitions when many producers are restarted at once
-		for _, i := range rand.Perm(int(partitionCount)) {
+		selector := p.selector
+		if selector == nil {
+			selector = randomPartitionOrder
+		}
+		for _, i := range selector(partitionCount) {
 			availablePartitions <- &partitionData{
-				Partition:           int32(i),
+				Partition:           i,
 				reset:               make(chan struct{}, 1),
 				sharedRetry:         p.sharedRetry,
 				availablePartitions: availablePartitions,
@@ -243,6 +507,11 @@ func (p *partitionManager) SetPartitionCount(topic string, partitionCount int32)
 // GetPartition fetches the next available partitionData object for the
 // given topic. The caller must call Success or Failure on this partitionData.
 func (p *partitionManager) GetPartition(topic string) (*partitionData, error) {
+	return p.getPartition(topic, p.getTimeout)
+}
+
+// getPartition works like GetPartition, but waits at most the given timeout.
+func (p *partitionManager) getPartition(topic string, timeout time.Duration) (*partitionData, error) {
 	p.lock.RLock()
 	defer p.lock.RUnlock()
 
@@ -259,7 +528,160 @@ func (p *partitionManager) GetPartition(topic string) (*partitionData, error) {
 		}
 		defer partitionData.reEnqueue()
 		return partitionData, nil
-	case <-time.After(p.getTimeout):
+	case <-time.After(timeout):
 		return nil, fmt.Errorf(fmt.Sprintf("Timeout waiting for partition for %s.", topic))
 	}
 }
+
+// BatchingProducerConf controls the behavior of the producer returned by
+// NewBatchingProducer.
+// Producer: required. Accumulated messages are written using its Distribute
+// method, so every flush results in a single produce request.
+// Linger: optional. Controls how long messages are accumulated before they
+// are written.
+// MaxMessages: optional. Accumulated messages are written as soon as there
+// is at least this many of them.
+type BatchingProducerConf struct {
+	Producer    DistributingProducer
+	Linger      time.Duration
+	MaxMessages int
+}
+
+func NewBatchingProducerConf() *BatchingProducerConf {
+	return &BatchingProducerConf{
+		Producer:    nil,
+		Linger:      10 * time.Millisecond,
+		MaxMessages: 1000,
+	}
+}
+
+// batchingProducer accumulates messages of several Distribute calls for the
+// same topic and writes them all at once, so that they end up compressed
+// together. Every Distribute call blocks until its messages are written.
+type batchingProducer struct {
+	producer    DistributingProducer
+	linger      time.Duration
+	maxMessages int
+
+	mu      sync.Mutex
+	batches map[string]*pendingBatch
+	closed  bool
+
+	// writes tracks flushes in progress, so that Close can wait for them.
+	writes sync.WaitGroup
+}
+
+// pendingBatch are messages waiting to be written to a topic. Every
+// Distribute call waiting for the batch is notified through its own channel.
+type pendingBatch struct {
+	messages []*proto.Message
+	waiters  []chan distributeResult
+	timer    *time.Timer
+}
+
+type distributeResult struct {
+	partition int32
+	offset    int64
+	err       error
+}
+
+// NewBatchingProducer returns a DistributingProducer that accumulates
+// messages for up to Linger or until MaxMessages are collected, and then
+// writes them with a single Distribute call of the wrapped producer. Callers
+// get the partition and offset of their own messages back.
+func NewBatchingProducer(conf *BatchingProducerConf) DistributingProducer {
+	return &batchingProducer{
+		producer:    conf.Producer,
+		linger:      conf.Linger,
+		maxMessages: conf.MaxMessages,
+		batches:     make(map[string]*pendingBatch),
+	}
+}
+
+func (p *batchingProducer) Distribute(topic string, messages ...*proto.Message) (int32, int64, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return 0, 0, ErrProducerClosed
+	}
+	if len(messages) == 0 {
+		p.mu.Unlock()
+		return p.producer.Distribute(topic)
+	}
+
+	done := make(chan distributeResult, 1)
+	batch, ok := p.batches[topic]
+	if !ok {
+		batch = &pendingBatch{}
+		p.batches[topic] = batch
+		batch.timer = time.AfterFunc(p.linger, func() { p.flush(topic, batch) })
+	}
+	start := len(batch.messages)
+	batch.messages = append(batch.messages, messages...)
+	batch.waiters = append(batch.waiters, done)
+	full := p.maxMessages > 0 && len(batch.messages) >= p.maxMessages
+	p.mu.Unlock()
+
+	if full {
+		p.flush(topic, batch)
+	}
+
+	res := <-done
+	if res.err != nil {
+		return 0, 0, res.err
+	}
+	return res.partition, res.offset + int64(start), nil
+}
+
+// Close writes all accumulated messages and waits until they are written.
+// Distribute calls made after Close fail with ErrProducerClosed. The wrapped
+// producer is not closed.
+func (p *batchingProducer) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	batches := p.batches
+	p.batches = make(map[string]*pendingBatch)
+	for _, batch := range batches {
+		batch.timer.Stop()
+	}
+	p.writes.Add(len(batches))
+	p.mu.Unlock()
+
+	for topic, batch := range batches {
+		go p.write(topic, batch)
+	}
+	p.writes.Wait()
+	return nil
+}
+
+// flush writes the batch, unless it was already written by a concurrent call.
+func (p *batchingProducer) flush(topic string, batch *pendingBatch) {
+	p.mu.Lock()
+	if p.batches[topic] != batch {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.batches, topic)
+	batch.timer.Stop()
+	p.writes.Add(1)
+	p.mu.Unlock()
+
+	p.write(topic, batch)
+}
+
+// write writes the batch and notifies all its waiters.
+func (p *batchingProducer) write(topic string, batch *pendingBatch) {
+	defer p.writes.Done()
+
+	partition, offset, err := p.producer.Distribute(topic, batch.messages...)
+	if err != nil {
+		log.Errorf("Failed to flush %d messages to %s: %s", len(batch.messages), topic, err)
+	}
+	for _, done := range batch.waiters {
+		done <- distributeResult{partition: partition, offset: offset, err: err}
+	}
+}
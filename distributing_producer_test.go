@@ -1,8 +1,11 @@
 package kafka
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -50,6 +53,7 @@ type recordingProducer struct {
 	msgs               []*proto.Message
 	disabledPartitions map[int32]struct{}
 	disabledWrites     int
+	inFlight           int32
 }
 
 func newRecordingProducer(disabledPartitions map[int32]struct{}) *recordingProducer {
@@ -60,11 +64,21 @@ func newRecordingProducer(disabledPartitions map[int32]struct{}) *recordingProdu
 }
 
 func (p *recordingProducer) Produce(topic string, part int32, msgs ...*proto.Message) (int64, error) {
+	return p.ProduceCtx(context.Background(), topic, part, msgs...)
+}
+
+func (p *recordingProducer) ProduceCtx(ctx context.Context, topic string, part int32, msgs ...*proto.Message) (int64, error) {
+	atomic.AddInt32(&p.inFlight, 1)
+	defer atomic.AddInt32(&p.inFlight, -1)
 	p.Lock()
 	defer p.Unlock()
 
 	// This is sort of horrible, but we are in a race with partitionData.reEnqueue
-	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-time.After(100 * time.Millisecond):
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
 
 	if _, ok := p.disabledPartitions[part]; ok {
 		p.disabledWrites++
@@ -82,6 +96,39 @@ func (p *recordingProducer) Produce(topic string, part int32, msgs ...*proto.Mes
 	return int64(len(p.msgs)), nil
 }
 
+func (p *recordingProducer) ProduceWithResult(topic string, part int32, msgs ...*proto.Message) (ProduceResult, error) {
+	offset, err := p.Produce(topic, part, msgs...)
+	if err != nil {
+		return ProduceResult{}, err
+	}
+	return newProduceResult(offset, msgs), nil
+}
+
+func (p *recordingProducer) ProduceOne(topic string, part int32, key, value []byte) (int64, error) {
+	return p.Produce(topic, part, &proto.Message{Key: key, Value: value})
+}
+
+func (p *recordingProducer) ProduceRecord(topic string, part int32, msg *proto.Message) (RecordMetadata, error) {
+	offset, err := p.Produce(topic, part, msg)
+	if err != nil {
+		return RecordMetadata{}, err
+	}
+	return RecordMetadata{Topic: topic, Partition: part, Offset: offset}, nil
+}
+
+func (p *recordingProducer) Validate(topic string, part int32) error {
+	if _, ok := p.disabledPartitions[part]; ok {
+		return ErrTestPartitionDisabled
+	}
+	return nil
+}
+
+func (p *recordingProducer) InvalidateLeaderCache(topic string) {}
+
+func (p *recordingProducer) Close() error {
+	return nil
+}
+
 type dummyPartitionCountSource struct {
 	impl func(string) (int32, error)
 }
@@ -90,8 +137,16 @@ func (p *dummyPartitionCountSource) PartitionCount(topic string) (int32, error)
 	return p.impl(topic)
 }
 
-/* This test is currently disabled. Partition ordering is randomized, so result
-// order can't be anticipated.
+// sequentialPartitionOrder makes the round robin start at partition 0, so
+// that the partition written by every call can be anticipated.
+func sequentialPartitionOrder(partitionCount int32) []int32 {
+	order := make([]int32, partitionCount)
+	for i := range order {
+		order[i] = int32(i)
+	}
+	return order
+}
+
 func (s *DistProducerSuite) TestErrorAverseRRProducerBasics(c *C) {
 	rec := newRecordingProducer(nil)
 	conf := NewErrorAverseRRProducerConf()
@@ -100,6 +155,7 @@ func (s *DistProducerSuite) TestErrorAverseRRProducerBasics(c *C) {
 	}
 	conf.Producer = rec
 	conf.PartitionFetchTimeout = time.Second
+	conf.PartitionSelector = sequentialPartitionOrder
 	p := NewErrorAverseRRProducer(conf)
 
 	for i, values := range testMessageData {
@@ -133,10 +189,7 @@ func (s *DistProducerSuite) TestErrorAverseRRProducerBasics(c *C) {
 	}
 	c.Assert(rec.disabledWrites, Equals, 0)
 }
-*/
 
-/* This test is currently disabled. Partition ordering is randomized, so result
-// order can't be anticipated.
 func (s *DistProducerSuite) TestErrorAverseRRProducerDeadPartition(c *C) {
 	rec := newRecordingProducer(map[int32]struct{}{
 		1: struct{}{},
@@ -147,6 +200,7 @@ func (s *DistProducerSuite) TestErrorAverseRRProducerDeadPartition(c *C) {
 	}
 	conf.Producer = rec
 	conf.PartitionFetchTimeout = time.Second
+	conf.PartitionSelector = sequentialPartitionOrder
 	p := NewErrorAverseRRProducer(conf)
 
 	for i, values := range testMessageData {
@@ -185,10 +239,7 @@ func (s *DistProducerSuite) TestErrorAverseRRProducerDeadPartition(c *C) {
 	}
 	c.Assert(rec.disabledWrites, Equals, 2)
 }
-*/
 
-/* This test is currently disabled. Partition ordering is randomized, so result
-// order can't be anticipated.
 func (s *DistProducerSuite) TestErrorAverseRRProducerDeadPartitions(c *C) {
 	rec := newRecordingProducer(map[int32]struct{}{
 		0: struct{}{},
@@ -200,6 +251,7 @@ func (s *DistProducerSuite) TestErrorAverseRRProducerDeadPartitions(c *C) {
 	}
 	conf.Producer = rec
 	conf.PartitionFetchTimeout = time.Second
+	conf.PartitionSelector = sequentialPartitionOrder
 	p := NewErrorAverseRRProducer(conf)
 
 	for i, values := range testMessageData {
@@ -252,7 +304,6 @@ func (s *DistProducerSuite) TestErrorAverseRRProducerDeadPartitions(c *C) {
 	}
 	c.Assert(rec.disabledWrites, Equals, 4)
 }
-*/
 
 func (s *DistProducerSuite) TestErrorAverseRRProducerAllDeadPartitions(c *C) {
 	rec := newRecordingProducer(map[int32]struct{}{
@@ -283,8 +334,307 @@ func (s *DistProducerSuite) TestErrorAverseRRProducerAllDeadPartitions(c *C) {
 	c.Assert(rec.disabledWrites, Equals, 6)
 }
 
-/* This test is currently disabled. Partition ordering is randomized, so result
-// order can't be anticipated.
+func (s *DistProducerSuite) TestErrorAverseRRProducerDistributeBatch(c *C) {
+	rec := newRecordingProducer(map[int32]struct{}{
+		1: struct{}{},
+	})
+	conf := NewErrorAverseRRProducerConf()
+	conf.PartitionCountSource = &dummyPartitionCountSource{
+		impl: func(string) (int32, error) { return 3, nil },
+	}
+	conf.Producer = rec
+	conf.PartitionFetchTimeout = time.Second
+	p := NewErrorAverseRRProducer(conf)
+
+	msgs := make([]*proto.Message, 0)
+	for _, values := range testMessageData {
+		for _, value := range values {
+			msgs = append(msgs, &proto.Message{Value: value})
+		}
+	}
+
+	results := p.DistributeBatch("test-topic", msgs...)
+	c.Assert(len(results), Equals, 3)
+
+	// partition ordering is randomized, so only check that every partition
+	// was written once and that the disabled one reported its messages
+	seen := make(map[int32]struct{})
+	var delivered, failed []*proto.Message
+	for i, res := range results {
+		seen[res.Partition] = struct{}{}
+		c.Assert(res.Messages, DeepEquals, msgs[i*len(msgs)/3:(i+1)*len(msgs)/3])
+		if res.Partition == 1 {
+			c.Assert(res.Err, Equals, ErrTestPartitionDisabled)
+			failed = append(failed, res.Messages...)
+			continue
+		}
+		c.Assert(res.Err, IsNil)
+		for _, msg := range res.Messages {
+			c.Assert(msg.Partition, Equals, res.Partition)
+		}
+		delivered = append(delivered, res.Messages...)
+	}
+	c.Assert(len(seen), Equals, 3)
+	c.Assert(len(failed) > 0, Equals, true)
+	c.Assert(len(failed)+len(delivered), Equals, len(msgs))
+	c.Assert(rec.msgs, DeepEquals, delivered)
+	c.Assert(rec.disabledWrites, Equals, 1)
+}
+
+func (s *DistProducerSuite) TestErrorAverseRRProducerPartitionByKey(c *C) {
+	rec := newRecordingProducer(nil)
+	conf := NewErrorAverseRRProducerConf()
+	conf.PartitionCountSource = &dummyPartitionCountSource{
+		impl: func(string) (int32, error) { return 3, nil },
+	}
+	conf.Producer = rec
+	conf.PartitionFetchTimeout = time.Second
+	conf.PartitionSelector = sequentialPartitionOrder
+	conf.PartitionByKey = true
+	p := NewErrorAverseRRProducer(conf)
+
+	msgs := []*proto.Message{
+		{Key: []byte("key-1"), Value: []byte("1")},
+		{Key: []byte("key-2"), Value: []byte("2")},
+		{Key: []byte("key-3"), Value: []byte("3")},
+		{Key: []byte("key-1"), Value: []byte("4")},
+		{Value: []byte("no key")},
+	}
+	results := p.DistributeBatch("test-topic", msgs...)
+	c.Assert(results, HasLen, 4)
+
+	// keyed parts come first, in the order their partitions appear
+	seen := make(map[int32]struct{})
+	for i, key := range []string{"key-1", "key-2", "key-3"} {
+		res := results[i]
+		c.Assert(res.Err, IsNil)
+		c.Assert(res.Partition, Equals, HashPartition([]byte(key), 3))
+		seen[res.Partition] = struct{}{}
+		for _, msg := range res.Messages {
+			c.Assert(string(msg.Key), Equals, key)
+			c.Assert(msg.Partition, Equals, res.Partition)
+		}
+	}
+	c.Assert(seen, HasLen, 3)
+	c.Assert(results[0].Messages, DeepEquals, []*proto.Message{msgs[0], msgs[3]})
+
+	// messages without key are spread round robin
+	c.Assert(results[3].Err, IsNil)
+	c.Assert(results[3].Messages, DeepEquals, []*proto.Message{msgs[4]})
+	c.Assert(results[3].Partition, Equals, int32(0))
+	c.Assert(rec.msgs, HasLen, len(msgs))
+}
+
+func (s *DistProducerSuite) TestErrorAverseRRProducerDistributeTimeout(c *C) {
+	disabled := make(map[int32]struct{})
+	for i := int32(0); i < 10; i++ {
+		disabled[i] = struct{}{}
+	}
+	// every produce takes 100ms, so writing to all partitions would take a
+	// second without the budget
+	rec := newRecordingProducer(disabled)
+	conf := NewErrorAverseRRProducerConf()
+	conf.PartitionCountSource = &dummyPartitionCountSource{
+		impl: func(string) (int32, error) { return 10, nil },
+	}
+	conf.Producer = rec
+	conf.PartitionFetchTimeout = time.Second
+	conf.DistributeTimeout = 350 * time.Millisecond
+	p := NewErrorAverseRRProducer(conf)
+
+	msgs := make([]*proto.Message, 10)
+	for i := range msgs {
+		msgs[i] = &proto.Message{Value: []byte(fmt.Sprintf("msg %d", i))}
+	}
+
+	start := time.Now()
+	results := p.DistributeBatch("test-topic", msgs...)
+	elapsed := time.Since(start)
+	c.Assert(elapsed < conf.DistributeTimeout+100*time.Millisecond, Equals, true,
+		Commentf("distribute took %s", elapsed))
+	// nothing is left writing to the messages after a timeout
+	c.Assert(atomic.LoadInt32(&rec.inFlight), Equals, int32(0))
+
+	c.Assert(len(results), Equals, 10)
+	var failed, timedOut int
+	for _, res := range results {
+		switch res.Err {
+		case ErrTestPartitionDisabled:
+			failed++
+		case ErrDistributeTimeout:
+			timedOut++
+		default:
+			c.Errorf("unexpected result: %+v", res)
+		}
+	}
+	c.Assert(failed > 0, Equals, true)
+	c.Assert(timedOut > 0, Equals, true)
+	c.Assert(failed+timedOut, Equals, 10)
+
+	// a new call gets a fresh budget
+	start = time.Now()
+	_, _, err := p.Distribute("test-topic", msgs[0])
+	c.Assert(err, NotNil)
+	c.Assert(time.Since(start) < conf.DistributeTimeout+100*time.Millisecond, Equals, true)
+	c.Assert(atomic.LoadInt32(&rec.inFlight), Equals, int32(0))
+}
+
+func (s *DistProducerSuite) TestHashPartition(c *C) {
+	seen := make(map[int32]struct{})
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key %d", i))
+		part := HashPartition(key, 7)
+		c.Assert(part >= 0 && part < 7, Equals, true)
+		c.Assert(HashPartition(key, 7), Equals, part)
+		seen[part] = struct{}{}
+	}
+	c.Assert(len(seen), Equals, 7)
+	c.Assert(HashPartition([]byte("key"), 0), Equals, int32(0))
+}
+
+func (s *DistProducerSuite) TestBatchingProducer(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+
+	var mu sync.Mutex
+	var requests []*proto.ProduceReq
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		mu.Lock()
+		requests = append(requests, req)
+		offset := int64(100 * len(requests))
+		mu.Unlock()
+		part := req.Topics[0].Partitions[0]
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: part.ID, Offset: offset},
+					},
+				},
+			},
+		}
+	})
+
+	brokerConf := NewBrokerConf("tester")
+	brokerConf.ClusterConnectionConf.DialTimeout = 400 * time.Millisecond
+	broker, err := NewBroker("test-cluster-batching-producer", []string{srv.Address()}, brokerConf)
+	c.Assert(err, IsNil)
+
+	prodConf := NewProducerConf()
+	prodConf.Compression = proto.CompressionGzip
+	rrConf := NewErrorAverseRRProducerConf()
+	rrConf.PartitionCountSource = broker
+	rrConf.Producer = broker.Producer(prodConf)
+	conf := NewBatchingProducerConf()
+	conf.Producer = NewErrorAverseRRProducer(rrConf)
+	conf.Linger = 200 * time.Millisecond
+	conf.MaxMessages = 6
+	p := NewBatchingProducer(conf)
+
+	// distribute concurrently, what fits within the size trigger goes into a
+	// single request
+	distribute := func(n int) ([]int64, [][]*proto.Message) {
+		var wg sync.WaitGroup
+		offsets := make([]int64, n)
+		msgs := make([][]*proto.Message, n)
+		for i := 0; i < n; i++ {
+			msgs[i] = []*proto.Message{
+				{Value: []byte(fmt.Sprintf("%d-1", i))},
+				{Value: []byte(fmt.Sprintf("%d-2", i))},
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, offset, err := p.Distribute("test", msgs[i]...)
+				c.Check(err, IsNil)
+				offsets[i] = offset
+			}(i)
+		}
+		wg.Wait()
+		return offsets, msgs
+	}
+
+	// size trigger
+	offsets, msgs := distribute(3)
+	mu.Lock()
+	c.Assert(len(requests), Equals, 1)
+	c.Assert(len(requests[0].Topics[0].Partitions[0].Messages), Equals, 6)
+	mu.Unlock()
+	for i := range offsets {
+		c.Assert(offsets[i], Equals, msgs[i][0].Offset)
+		c.Assert(msgs[i][1].Offset, Equals, offsets[i]+1)
+		c.Assert(offsets[i] >= 100 && offsets[i] < 106, Equals, true)
+	}
+
+	// linger trigger
+	start := time.Now()
+	offsets, msgs = distribute(2)
+	c.Assert(time.Since(start) >= conf.Linger, Equals, true)
+	mu.Lock()
+	c.Assert(len(requests), Equals, 2)
+	c.Assert(len(requests[1].Topics[0].Partitions[0].Messages), Equals, 4)
+	mu.Unlock()
+	for i := range offsets {
+		c.Assert(offsets[i], Equals, msgs[i][0].Offset)
+		c.Assert(offsets[i] >= 200 && offsets[i] < 204, Equals, true)
+	}
+}
+
+func (s *DistProducerSuite) TestBatchingProducerClose(c *C) {
+	rec := newRecordingProducer(nil)
+	rrConf := NewErrorAverseRRProducerConf()
+	rrConf.PartitionCountSource = &dummyPartitionCountSource{
+		impl: func(string) (int32, error) { return 1, nil },
+	}
+	rrConf.Producer = rec
+	conf := NewBatchingProducerConf()
+	conf.Producer = NewErrorAverseRRProducer(rrConf)
+	conf.Linger = time.Hour
+	conf.MaxMessages = 0
+	p := NewBatchingProducer(conf)
+
+	var wg sync.WaitGroup
+	for _, topic := range []string{"a", "a", "b"} {
+		wg.Add(1)
+		go func(topic string) {
+			defer wg.Done()
+			_, _, err := p.Distribute(topic, &proto.Message{Value: []byte(topic)})
+			c.Check(err, IsNil)
+		}(topic)
+	}
+
+	// wait until all messages are accumulated
+	bp := p.(*batchingProducer)
+	for {
+		bp.mu.Lock()
+		n := 0
+		for _, batch := range bp.batches {
+			n += len(batch.messages)
+		}
+		bp.mu.Unlock()
+		if n == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	c.Assert(p.Close(), IsNil)
+	rec.Lock()
+	c.Assert(rec.msgs, HasLen, 3)
+	rec.Unlock()
+	wg.Wait()
+
+	_, _, err := p.Distribute("a", &proto.Message{Value: []byte("late")})
+	c.Assert(err, Equals, ErrProducerClosed)
+	c.Assert(p.Close(), IsNil)
+}
+
 func (s *DistProducerSuite) TestErrorAverseRRProducerIncreasePartitionCount(c *C) {
 	rec := newRecordingProducer(nil)
 	conf := NewErrorAverseRRProducerConf()
@@ -294,6 +644,7 @@ func (s *DistProducerSuite) TestErrorAverseRRProducerIncreasePartitionCount(c *C
 	}
 	conf.Producer = rec
 	conf.PartitionFetchTimeout = time.Second
+	conf.PartitionSelector = sequentialPartitionOrder
 	p := NewErrorAverseRRProducer(conf)
 
 	for i, values := range testMessageData {
@@ -349,4 +700,75 @@ func (s *DistProducerSuite) TestErrorAverseRRProducerIncreasePartitionCount(c *C
 	}
 	c.Assert(rec.disabledWrites, Equals, 0)
 }
-*/
+
+func (s *DistProducerSuite) TestErrorAverseRRProducerPartitionsAddedOnLeaderChange(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	host, port := srv.HostPort()
+	var mu sync.Mutex
+	partitions := 2
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		mu.Lock()
+		count := partitions
+		mu.Unlock()
+		if count > 2 {
+			// slow enough for a refresh in the background to lose the race
+			// with the next Distribute call
+			time.Sleep(50 * time.Millisecond)
+		}
+		topic := proto.MetadataRespTopic{Name: "test"}
+		for id := 0; id < count; id++ {
+			topic.Partitions = append(topic.Partitions, proto.MetadataRespPartition{
+				ID: int32(id), Leader: 1, Replicas: []int32{1}, Isrs: []int32{1},
+			})
+		}
+		return &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Brokers:       []proto.MetadataRespBroker{{NodeID: 1, Host: host, Port: int32(port)}},
+			Topics:        []proto.MetadataRespTopic{topic},
+		}
+	})
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		part := proto.ProduceRespPartition{ID: req.Topics[0].Partitions[0].ID}
+		mu.Lock()
+		if partitions == 2 {
+			// partitions were added while the leader moved
+			partitions = 4
+			part.Err = proto.ErrNotLeaderForPartition
+		}
+		mu.Unlock()
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{Name: "test", Partitions: []proto.ProduceRespPartition{part}},
+			},
+		}
+	})
+
+	brokerConf := NewBrokerConf("tester")
+	brokerConf.ClusterConnectionConf.DialTimeout = 400 * time.Millisecond
+	broker, err := NewBroker("test-cluster-partitions-added", []string{srv.Address()}, brokerConf)
+	c.Assert(err, IsNil)
+
+	conf := NewErrorAverseRRProducerConf()
+	conf.PartitionCountSource = broker
+	conf.Producer = broker.Producer(NewProducerConf())
+	conf.PartitionSelector = sequentialPartitionOrder
+	p := NewErrorAverseRRProducer(conf)
+
+	_, _, err = p.Distribute("test", &proto.Message{Value: []byte("first")})
+	c.Assert(err, Equals, proto.ErrNotLeaderForPartition)
+
+	// the partition count was refreshed before Distribute returned
+	var written []int32
+	for i := 0; i < 4; i++ {
+		partition, _, err := p.Distribute("test", &proto.Message{Value: []byte("next")})
+		c.Assert(err, IsNil)
+		written = append(written, partition)
+	}
+	c.Assert(written, DeepEquals, []int32{0, 1, 2, 3})
+}
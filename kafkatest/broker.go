@@ -1,8 +1,10 @@
 package kafkatest
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"sync"
 	"time"
 
@@ -155,6 +157,21 @@ func (c *Consumer) Consume() (*proto.Message, error) {
 	}
 }
 
+// ConsumeCtx works like Consume, but returns the error of ctx once it is
+// done.
+func (c *Consumer) ConsumeCtx(ctx context.Context) (*proto.Message, error) {
+	select {
+	case msg := <-c.Messages:
+		msg.Topic = c.conf.Topic
+		msg.Partition = c.conf.Partition
+		return msg, nil
+	case err := <-c.Errors:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // SeekToLatest discards all messages currently enqueued, unless an error is available first.
 func (c *Consumer) SeekToLatest() error {
 	select {
@@ -171,6 +188,60 @@ func (c *Consumer) SeekToLatest() error {
 	}
 }
 
+// TailN is not supported by the mock and always returns ErrNotImplemented.
+func (c *Consumer) TailN(n int) ([]*proto.Message, error) {
+	return nil, ErrNotImplemented
+}
+
+// ConsumeRange is not supported by the mock and always returns
+// ErrNotImplemented.
+func (c *Consumer) ConsumeRange(start, end int64) ([]*proto.Message, error) {
+	return nil, ErrNotImplemented
+}
+
+// ConsumeTimeRange is not supported by the mock and always returns
+// ErrNotImplemented.
+func (c *Consumer) ConsumeTimeRange(from, to time.Time) ([]*proto.Message, error) {
+	return nil, ErrNotImplemented
+}
+
+// LogStartOffset is not tracked by the mock and always returns -1.
+func (c *Consumer) LogStartOffset() int64 {
+	return -1
+}
+
+// Pause is not supported by the mock and does nothing.
+func (c *Consumer) Pause() {}
+
+// Resume is not supported by the mock and does nothing.
+func (c *Consumer) Resume() {}
+
+// StartFromCommittedPlus is not supported by the mock and always returns
+// ErrNotImplemented.
+func (c *Consumer) StartFromCommittedPlus(coord kafka.OffsetCoordinator, skip int64) error {
+	return ErrNotImplemented
+}
+
+// Reassign makes the messages returned by Consume report partition. The
+// offset is ignored, as messages are only ever read from the Messages
+// channel.
+func (c *Consumer) Reassign(partition int32, startOffset int64) error {
+	c.conf.Partition = partition
+	return nil
+}
+
+// ConsumeBytes is not supported by the mock and always returns
+// ErrNotImplemented.
+func (c *Consumer) ConsumeBytes(maxBytes int) ([]*proto.Message, error) {
+	return nil, ErrNotImplemented
+}
+
+// StreamRaw is not supported by the mock and always returns
+// ErrNotImplemented.
+func (c *Consumer) StreamRaw(w io.Writer, from, to int64) (int64, error) {
+	return 0, ErrNotImplemented
+}
+
 // Producer mocks kafka's producer.
 type Producer struct {
 	Broker *Broker
@@ -182,6 +253,9 @@ type Producer struct {
 	// ResponseError if set, force Produce method call to instantly return
 	// error, without publishing messages. By default nil.
 	ResponseError error
+
+	mu     sync.Mutex
+	closed bool
 }
 
 // ProducedMessages represents all arguments used for single Produce method
@@ -196,6 +270,12 @@ type ProducedMessages struct {
 // passed arguments to broker. Produce call is blocking until pushed message
 // will be read with broker's ReadProduces.
 func (p *Producer) Produce(topic string, partition int32, messages ...*proto.Message) (int64, error) {
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		return 0, kafka.ErrProducerClosed
+	}
 	if p.ResponseError != nil {
 		return 0, p.ResponseError
 	}
@@ -215,6 +295,66 @@ func (p *Producer) Produce(topic string, partition int32, messages ...*proto.Mes
 	return off, nil
 }
 
+// ProduceWithResult works like Produce, returning the offsets of the first and
+// the last message.
+func (p *Producer) ProduceWithResult(topic string, partition int32, messages ...*proto.Message) (kafka.ProduceResult, error) {
+	off, err := p.Produce(topic, partition, messages...)
+	if err != nil {
+		return kafka.ProduceResult{}, err
+	}
+	result := kafka.ProduceResult{BaseOffset: off, LastOffset: off}
+	if len(messages) > 0 {
+		result.LastOffset = messages[len(messages)-1].Offset
+	}
+	return result, nil
+}
+
+// ProduceOne works like Produce, writing a single message with given key and
+// value.
+func (p *Producer) ProduceOne(topic string, partition int32, key, value []byte) (int64, error) {
+	return p.Produce(topic, partition, &proto.Message{Key: key, Value: value})
+}
+
+// ProduceRecord works like Produce, writing a single message and returning
+// its topic, partition and offset.
+func (p *Producer) ProduceRecord(topic string, partition int32, msg *proto.Message) (kafka.RecordMetadata, error) {
+	offset, err := p.Produce(topic, partition, msg)
+	if err != nil {
+		return kafka.RecordMetadata{}, err
+	}
+	return kafka.RecordMetadata{
+		Topic:     topic,
+		Partition: partition,
+		Offset:    offset,
+		Timestamp: msg.Timestamp,
+	}, nil
+}
+
+// ProduceCtx works like Produce, unless ctx is already done, in which case
+// its error is returned.
+func (p *Producer) ProduceCtx(ctx context.Context, topic string, partition int32, messages ...*proto.Message) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return p.Produce(topic, partition, messages...)
+}
+
+// InvalidateLeaderCache does nothing, there is no leader cache to invalidate.
+func (p *Producer) InvalidateLeaderCache(topic string) {}
+
+// Validate returns ResponseError, which is nil by default.
+func (p *Producer) Validate(topic string, partition int32) error {
+	return p.ResponseError
+}
+
+// Close makes all following Produce calls fail with kafka.ErrProducerClosed.
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	return nil
+}
+
 type OffsetCoordinator struct {
 	conf   kafka.OffsetCoordinatorConf
 	Broker *Broker
@@ -4,5 +4,7 @@ Package kafkatest provides mock objects for high level kafka interface.
 
 Use NewBroker function to create mock broker object and standard methods to create producers and consumers.
 
+Use NewServer function to create in memory kafka server that real kafka.Broker can connect to. Server handles produce, fetch, metadata and offset requests using its local state. Use Handle method to replace processing of chosen request kind, for example to simulate errors.
+
 */
 package kafkatest
@@ -110,3 +110,71 @@ func ExampleServer() {
 
 	// connect to server using broker and fetch/write messages
 }
+
+func ExampleServer_Handle() {
+	server := NewServer()
+	server.MustSpawn()
+	defer func() {
+		_ = server.Close()
+	}()
+
+	server.AddMessages("my-topic", 0,
+		&proto.Message{Value: []byte("first")})
+	server.AddMessages("big-topic", 0)
+
+	// reject all messages written to "big-topic", any other request is
+	// processed using in memory server state
+	server.Handle(proto.ProduceReqKind, func(nodeID int32, request proto.Request) Response {
+		req := request.(*proto.ProduceReq)
+		if req.Topics[0].Name != "big-topic" {
+			return nil
+		}
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "big-topic",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: 0, Err: proto.ErrMessageSizeTooLarge},
+					},
+				},
+			},
+		}
+	})
+
+	broker, err := kafka.NewBroker("my-cluster", []string{server.Addr()}, kafka.NewBrokerConf("test"))
+	if err != nil {
+		panic(fmt.Sprintf("cannot connect: %s", err))
+	}
+
+	producer := broker.Producer(kafka.NewProducerConf())
+	_, err = producer.Produce("big-topic", 0, &proto.Message{Value: []byte("huge")})
+	fmt.Printf("Error: %s\n", err)
+
+	offset, err := producer.Produce("my-topic", 0, &proto.Message{Value: []byte("second")})
+	if err != nil {
+		panic(fmt.Sprintf("cannot produce: %s", err))
+	}
+	fmt.Printf("Offset: %d\n", offset)
+
+	conf := kafka.NewConsumerConf("my-topic", 0)
+	conf.StartOffset = kafka.StartOffsetOldest
+	consumer, err := broker.Consumer(conf)
+	if err != nil {
+		panic(fmt.Sprintf("cannot create consumer: %s", err))
+	}
+	for i := 0; i < 2; i++ {
+		msg, err := consumer.Consume()
+		if err != nil {
+			panic(fmt.Sprintf("cannot consume: %s", err))
+		}
+		fmt.Printf("Value: %s\n", msg.Value)
+	}
+
+	// output:
+	//
+	// Error: message size too large (10)
+	// Offset: 1
+	// Value: first
+	// Value: second
+}
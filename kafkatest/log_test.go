@@ -39,6 +39,10 @@ func (l *logTestBackend) Log(lvl logging.Level, cd int, rec *logging.Record) err
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	// examples run outside of any test suite
+	if l.c == nil {
+		return nil
+	}
 	l.c.Log(rec.Formatted(cd))
 	return nil
 }
@@ -27,6 +27,7 @@ type Server struct {
 	offsets     map[string]map[int32]map[string]*topicOffset
 	ln          net.Listener
 	middlewares []Middleware
+	handlers    map[int16]RequestHandler
 	started     bool
 	stopped     bool
 }
@@ -36,6 +37,11 @@ type Server struct {
 // nil or kafka response message.
 type Middleware func(nodeID int32, requestKind int16, content []byte) Response
 
+// RequestHandler is function that is called with decoded request of the kind
+// it was registered for using Handle. Returning nil response falls back to
+// the default in-memory processing of the request.
+type RequestHandler func(nodeID int32, request proto.Request) Response
+
 // Response is any kafka response as defined in kafka/proto package
 type Response interface {
 	Bytes() ([]byte, error)
@@ -53,11 +59,29 @@ func NewServer(middlewares ...Middleware) *Server {
 		topics:      make(map[string]map[int32][]*proto.Message),
 		offsets:     make(map[string]map[int32]map[string]*topicOffset),
 		middlewares: middlewares,
+		handlers:    make(map[int16]RequestHandler),
 		mu:          &sync.RWMutex{},
 	}
 	return s
 }
 
+// Handle registers handler for given request kind, for example
+// proto.ProduceReqKind. Handler is called after all middlewares, with the
+// request already decoded, and before the default processing handler. This
+// allows to simulate broker errors for chosen requests while keeping the in
+// memory produce, fetch, metadata and offset handling for everything else.
+// Passing nil handler removes previously registered one.
+func (s *Server) Handle(requestKind int16, handler RequestHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if handler == nil {
+		delete(s.handlers, requestKind)
+		return
+	}
+	s.handlers[requestKind] = handler
+}
+
 // Addr return server instance address or empty string if not running.
 func (s *Server) Addr() string {
 	s.mu.RLock()
@@ -290,61 +314,58 @@ func (s *Server) handleClient(nodeID int32, conn net.Conn) {
 			}
 		}
 
+		// decode the request, unless a middleware already handled it
+		var req proto.Request
 		if resp == nil {
 			switch kind {
 			case proto.ProduceReqKind:
-				req, err := proto.ReadProduceReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse produce request: %s\n%s", err, b)
-					return
-				}
-				resp = s.handleProduceRequest(nodeID, conn, req)
+				req, err = proto.ReadProduceReq(bytes.NewBuffer(b))
 			case proto.FetchReqKind:
-				req, err := proto.ReadFetchReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse fetch request: %s\n%s", err, b)
-					return
-				}
-				resp = s.handleFetchRequest(nodeID, conn, req)
+				req, err = proto.ReadFetchReq(bytes.NewBuffer(b))
 			case proto.OffsetReqKind:
-				req, err := proto.ReadOffsetReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse offset request: %s\n%s", err, b)
-					return
-				}
-				resp = s.handleOffsetRequest(nodeID, conn, req)
+				req, err = proto.ReadOffsetReq(bytes.NewBuffer(b))
 			case proto.MetadataReqKind:
-				req, err := proto.ReadMetadataReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse metadata request: %s\n%s", err, b)
-					return
-				}
-				resp = s.handleMetadataRequest(nodeID, conn, req)
+				req, err = proto.ReadMetadataReq(bytes.NewBuffer(b))
 			case proto.OffsetCommitReqKind:
-				req, err := proto.ReadOffsetCommitReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse offset commit request: %s\n%s", err, b)
-					return
-				}
-				resp = s.handleOffsetCommitRequest(nodeID, conn, req)
+				req, err = proto.ReadOffsetCommitReq(bytes.NewBuffer(b))
 			case proto.OffsetFetchReqKind:
-				req, err := proto.ReadOffsetFetchReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse offset fetch request: %s\n%s", err, b)
-					return
-				}
-				resp = s.handleOffsetFetchRequest(nodeID, conn, req)
+				req, err = proto.ReadOffsetFetchReq(bytes.NewBuffer(b))
 			case proto.GroupCoordinatorReqKind:
-				req, err := proto.ReadGroupCoordinatorReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse consumer metadata request: %s\n%s", err, b)
-					return
-				}
-				resp = s.handleGroupCoordinatorRequest(nodeID, conn, req)
+				req, err = proto.ReadGroupCoordinatorReq(bytes.NewBuffer(b))
 			default:
 				log.Errorf("unknown request: %d\n%s", kind, b)
 				return
 			}
+			if err != nil {
+				log.Errorf("cannot parse %d request: %s\n%s", kind, err, b)
+				return
+			}
+
+			s.mu.RLock()
+			handler := s.handlers[kind]
+			s.mu.RUnlock()
+			if handler != nil {
+				resp = handler(nodeID, req)
+			}
+		}
+
+		if resp == nil {
+			switch req := req.(type) {
+			case *proto.ProduceReq:
+				resp = s.handleProduceRequest(nodeID, conn, req)
+			case *proto.FetchReq:
+				resp = s.handleFetchRequest(nodeID, conn, req)
+			case *proto.OffsetReq:
+				resp = s.handleOffsetRequest(nodeID, conn, req)
+			case *proto.MetadataReq:
+				resp = s.handleMetadataRequest(nodeID, conn, req)
+			case *proto.OffsetCommitReq:
+				resp = s.handleOffsetCommitRequest(nodeID, conn, req)
+			case *proto.OffsetFetchReq:
+				resp = s.handleOffsetFetchRequest(nodeID, conn, req)
+			case *proto.GroupCoordinatorReq:
+				resp = s.handleGroupCoordinatorRequest(nodeID, conn, req)
+			}
 		}
 
 		if resp == nil {
@@ -418,6 +439,7 @@ func (s *Server) handleFetchRequest(
 
 	resp := &proto.FetchResp{
 		CorrelationID: req.CorrelationID,
+		Version:       req.Version,
 		Topics:        make([]proto.FetchRespTopic, len(req.Topics)),
 	}
 	for ti, topic := range req.Topics {
@@ -426,6 +448,7 @@ func (s *Server) handleFetchRequest(
 		resp.Topics[ti].Partitions = respParts
 		for pi, part := range topic.Partitions {
 			respParts[pi].ID = part.ID
+			respParts[pi].PreferredReadReplica = -1
 
 			partitions, ok := s.topics[topic.Name]
 			if !ok {
@@ -461,6 +484,7 @@ func (s *Server) handleOffsetRequest(
 	defer s.mu.RUnlock()
 
 	resp := &proto.OffsetResp{
+		Version:       req.Version,
 		CorrelationID: req.CorrelationID,
 		Topics:        make([]proto.OffsetRespTopic, len(req.Topics)),
 	}
@@ -488,7 +512,9 @@ func (s *Server) handleOffsetRequest(
 
 			// Now if they've asked for fewer, cut some off -- unclear if this
 			// is correct but it seems so given what we support right now
-			respPart[pi].Offsets = respPart[pi].Offsets[0:part.MaxOffsets]
+			if req.Version == 0 {
+				respPart[pi].Offsets = respPart[pi].Offsets[0:part.MaxOffsets]
+			}
 		}
 	}
 	return resp
@@ -603,6 +629,7 @@ func (s *Server) handleMetadataRequest(
 
 	resp := &proto.MetadataResp{
 		CorrelationID: req.CorrelationID,
+		Version:       req.Version,
 		Topics:        make([]proto.MetadataRespTopic, 0, len(s.topics)),
 		Brokers:       s.brokers,
 	}
@@ -12,11 +12,18 @@ const (
 var globalMetadataCacheLock sync.Mutex
 var globalMetadataCache *MetadataCache
 
+// globalMetadataCacheDisabled makes every broker fetch its own metadata. Only
+// set by internal tests.
+var globalMetadataCacheDisabled bool
+
 // InitializeMetadataCache will make Kafka connections will be cached globally.
+// This happens on the first call to NewBroker anyway, calling it again drops
+// the metadata cached so far.
 func InitializeMetadataCache() {
 	globalMetadataCacheLock.Lock()
 	defer globalMetadataCacheLock.Unlock()
 	globalMetadataCache = newMetadataCache()
+	globalMetadataCacheDisabled = false
 }
 
 // Only useful for internal tests.
@@ -24,6 +31,7 @@ func uninitializeMetadataCache() {
 	globalMetadataCacheLock.Lock()
 	defer globalMetadataCacheLock.Unlock()
 	globalMetadataCache = nil
+	globalMetadataCacheDisabled = true
 }
 
 func getMetadataCache() *MetadataCache {
@@ -32,8 +40,13 @@ func getMetadataCache() *MetadataCache {
 	if globalMetadataCache != nil {
 		return globalMetadataCache
 	}
-	log.Infof("Creating metadata without using cache.")
-	return newMetadataCache()
+	if globalMetadataCacheDisabled {
+		log.Infof("Creating metadata without using cache.")
+		return newMetadataCache()
+	}
+	log.Infof("Initializing metadata cache.")
+	globalMetadataCache = newMetadataCache()
+	return globalMetadataCache
 }
 
 // MetadataCache is a threadsafe cache of ClusterMetadata by clusterName.  Entries are never removed
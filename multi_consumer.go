@@ -0,0 +1,301 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/discord/zorkian-kafka/proto"
+	"github.com/jpillora/backoff"
+)
+
+// MultiConsumer reads messages from several partitions of a topic. Unlike
+// TopicConsumer, which fetches every partition on its own, all partitions led
+// by the same node are fetched with a single request, which saves round
+// trips when consuming many partitions.
+//
+// Partitions with different leaders are fetched in turn, one leader per
+// fetch. The messages of a fetch are returned interleaved, taking one of
+// every partition in turn.
+type MultiConsumer struct {
+	broker     *Broker
+	conf       ConsumerConf
+	partitions []int32
+
+	// mu protects the following and serializes Consume calls.
+	mu      sync.Mutex
+	offsets map[int32]int64 // offset of next NOT consumed message
+	msgbuf  []*proto.Message
+	next    int // index of the leader to fetch from next
+}
+
+// MultiConsumer creates a consumer reading the given partitions of topic,
+// each starting at conf.StartOffset. conf.Topic and conf.Partition are
+// ignored.
+//
+// conf.RetryLimit and conf.RetryWait apply to all partitions: Consume returns
+// ErrNoData once no partition returned messages after RetryLimit rounds of
+// fetching all of them. conf.RetryErrLimit and conf.RetryErrWait apply to
+// every fetch request.
+//
+// RackID, AdaptiveFetchSize, DedupeWindow, MaxMessagesPerSecond,
+// CommitEveryMessage and ConsumeDeadline are not supported, an error is
+// returned if any of them is set.
+func (b *Broker) MultiConsumer(topic string, partitions []int32, conf ConsumerConf) (*MultiConsumer, error) {
+	conf.Topic = topic
+	conf.Partition = 0
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	unsupported := []struct {
+		name string
+		set  bool
+	}{
+		{"RackID", conf.RackID != ""},
+		{"AdaptiveFetchSize", conf.AdaptiveFetchSize},
+		{"DedupeWindow", conf.DedupeWindow > 0},
+		{"MaxMessagesPerSecond", conf.MaxMessagesPerSecond > 0},
+		{"CommitEveryMessage", conf.CommitEveryMessage},
+		{"ConsumeDeadline", conf.ConsumeDeadline > 0},
+	}
+	for _, opt := range unsupported {
+		if opt.set {
+			return nil, fmt.Errorf("invalid %s: not supported by MultiConsumer", opt.name)
+		}
+	}
+	if len(partitions) == 0 {
+		return nil, ErrNoPartitions
+	}
+
+	mc := &MultiConsumer{
+		broker:     b,
+		conf:       conf,
+		partitions: make([]int32, 0, len(partitions)),
+		offsets:    make(map[int32]int64, len(partitions)),
+	}
+	for _, partition := range partitions {
+		if _, ok := mc.offsets[partition]; ok {
+			return nil, fmt.Errorf("partition %d given more than once", partition)
+		}
+		var offset int64
+		var err error
+		if conf.StartOffset == StartFromRelative {
+			offset, err = b.relativeOffset(topic, partition, conf.RelativeOffset)
+		} else {
+			offset, err = b.startOffset(topic, partition, conf.StartOffset)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot consume partition %d: %s", partition, err)
+		}
+		mc.partitions = append(mc.partitions, partition)
+		mc.offsets[partition] = offset
+	}
+	return mc, nil
+}
+
+// Consume returns the next message of any of the partitions. The Partition
+// field of the message tells which partition it was read from.
+func (mc *MultiConsumer) Consume() (*proto.Message, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	for retry := 0; len(mc.msgbuf) == 0; retry++ {
+		leaders, err := mc.leaders()
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < len(leaders) && len(mc.msgbuf) == 0; i++ {
+			leader := leaders[mc.next%len(leaders)]
+			mc.next = (mc.next + 1) % len(leaders)
+			msgs, err := mc.fetch(leader.nodeID, leader.partitions)
+			if err != nil {
+				return nil, err
+			}
+			mc.msgbuf = interleave(msgs)
+		}
+		if len(mc.msgbuf) > 0 {
+			break
+		}
+
+		if mc.conf.RetryLimit != -1 && retry >= mc.conf.RetryLimit {
+			return nil, ErrNoData
+		}
+		if mc.conf.RetryWait > 0 {
+			mc.broker.clock.Sleep(mc.conf.RetryWait)
+		}
+	}
+
+	msg := mc.msgbuf[0]
+	mc.msgbuf[0] = nil
+	mc.msgbuf = mc.msgbuf[1:]
+	mc.offsets[msg.Partition] = msg.Offset + 1
+	return msg, nil
+}
+
+// Offsets returns the offset of the next message to consume from every
+// partition.
+func (mc *MultiConsumer) Offsets() map[int32]int64 {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	offsets := make(map[int32]int64, len(mc.offsets))
+	for partition, offset := range mc.offsets {
+		offsets[partition] = offset
+	}
+	return offsets
+}
+
+// partitionLeader is a node and the partitions of the consumer it leads.
+type partitionLeader struct {
+	nodeID     int32
+	partitions []int32
+}
+
+// leaders groups the partitions by their leader, ordered by node ID so that
+// the leaders are fetched from in the same order every round.
+func (mc *MultiConsumer) leaders() ([]partitionLeader, error) {
+	byNode := make(map[int32][]int32)
+	for _, partition := range mc.partitions {
+		nodeID, err := mc.broker.cluster.GetEndpoint(mc.conf.Topic, partition)
+		if err != nil {
+			if err := mc.broker.cluster.RefreshMetadata(); err != nil {
+				return nil, err
+			}
+			if nodeID, err = mc.broker.cluster.GetEndpoint(mc.conf.Topic, partition); err != nil {
+				return nil, fmt.Errorf("cannot find leader of partition %d: %s", partition, err)
+			}
+		}
+		byNode[nodeID] = append(byNode[nodeID], partition)
+	}
+	leaders := make([]partitionLeader, 0, len(byNode))
+	for nodeID, partitions := range byNode {
+		leaders = append(leaders, partitionLeader{nodeID: nodeID, partitions: partitions})
+	}
+	sort.Slice(leaders, func(i, j int) bool { return leaders[i].nodeID < leaders[j].nodeID })
+	return leaders, nil
+}
+
+// fetch sends a single fetch request for the given partitions to their
+// leader and returns the messages of every partition, retrying like
+// consumer.fetch does. Partitions that moved to another leader are left out;
+// the metadata is refreshed so that the next round fetches them from the new
+// one. Other errors of partitions are returned as *MultiError.
+func (mc *MultiConsumer) fetch(nodeID int32, partitions []int32) ([][]*proto.Message, error) {
+	reqPartitions := make([]proto.FetchReqPartition, len(partitions))
+	for i, partition := range partitions {
+		reqPartitions[i] = proto.FetchReqPartition{
+			ID:          partition,
+			FetchOffset: mc.offsets[partition],
+			MaxBytes:    mc.conf.MaxFetchSize,
+		}
+	}
+	req := proto.FetchReq{
+		ClientID:    mc.broker.conf.ClientID,
+		MaxWaitTime: mc.conf.RequestTimeout,
+		MinBytes:    mc.conf.MinFetchSize,
+		Topics: []proto.FetchReqTopic{
+			{Name: mc.conf.Topic, Partitions: reqPartitions},
+		},
+	}
+	var version int16
+	if mc.conf.IsolationLevel == proto.IsolationLevelReadCommitted {
+		// isolation level is supported starting with version 4
+		version = 4
+	}
+	req.Version = mc.broker.apiVersion(proto.FetchReqKind, version)
+	if req.Version >= 3 {
+		maxBytes := int64(mc.conf.MaxFetchSize) * int64(len(partitions))
+		if maxBytes > math.MaxInt32 {
+			maxBytes = math.MaxInt32
+		}
+		req.MaxBytes = int32(maxBytes)
+	}
+	if req.Version >= 4 {
+		req.IsolationLevel = mc.conf.IsolationLevel
+	}
+
+	var resErr error
+	retry := &backoff.Backoff{Min: mc.conf.RetryErrWait, Jitter: true}
+	for try := 0; try < mc.conf.RetryErrLimit; try++ {
+		if try != 0 {
+			mc.broker.clock.Sleep(retry.Duration())
+		}
+
+		addr := mc.broker.cluster.GetNodeAddress(nodeID)
+		if addr == "" {
+			return nil, fmt.Errorf("unknown broker ID %d", nodeID)
+		}
+		conn, err := mc.broker.conns.GetConnectionByAddr(addr)
+		if err != nil {
+			resErr = err
+			continue
+		}
+		defer func(lconn *connection) { go mc.broker.conns.Idle(lconn) }(conn)
+
+		resp, err := conn.fetch(context.Background(), &req, mc.conf.SkipMalformed)
+		if err != nil {
+			log.Debugf("cannot fetch messages of %s from node %d (try %d): %s",
+				mc.conf.Topic, nodeID, try, err)
+			_ = conn.Close()
+			resErr = err
+			continue
+		}
+
+		var msgs [][]*proto.Message
+		var errs MultiError
+		var moved bool
+		for _, t := range resp.Topics {
+			for _, p := range t.Partitions {
+				if t.Name != mc.conf.Topic {
+					log.Warningf("fetch response with unexpected data for %s:%d",
+						t.Name, p.ID)
+					continue
+				}
+				switch p.Err {
+				case nil:
+					if len(p.Messages) > 0 {
+						msgs = append(msgs, p.Messages)
+					}
+				case proto.ErrLeaderNotAvailable, proto.ErrNotLeaderForPartition,
+					proto.ErrBrokerNotAvailable, proto.ErrUnknownTopicOrPartition:
+					log.Warningf("cannot fetch messages of %s:%d from node %d: %s",
+						t.Name, p.ID, nodeID, p.Err)
+					moved = true
+				default:
+					errs.Add(t.Name, p.ID, p.Err)
+				}
+			}
+		}
+		if err := errs.ErrorOrNil(); err != nil {
+			return nil, err
+		}
+		if moved {
+			if err := mc.broker.cluster.RefreshMetadata(); err != nil {
+				log.Warningf("cannot refresh metadata: %s", err)
+			}
+		}
+		return msgs, nil
+	}
+
+	return nil, resErr
+}
+
+// interleave merges the messages of several partitions, taking one of each
+// partition in turn.
+func interleave(partitions [][]*proto.Message) []*proto.Message {
+	var total int
+	for _, msgs := range partitions {
+		total += len(msgs)
+	}
+	merged := make([]*proto.Message, 0, total)
+	for i := 0; len(merged) < total; i++ {
+		for _, msgs := range partitions {
+			if i < len(msgs) {
+				merged = append(merged, msgs[i])
+			}
+		}
+	}
+	return merged
+}
@@ -0,0 +1,229 @@
+package kafka
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+var _ = Suite(&MultiConsumerSuite{})
+
+type MultiConsumerSuite struct{}
+
+func (s *MultiConsumerSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+func (s *MultiConsumerSuite) TestConsumeGroupedByLeader(c *C) {
+	srv1 := NewServer()
+	srv1.Start()
+	defer srv1.Close()
+	srv2 := NewServer()
+	srv2.Start()
+	defer srv2.Close()
+
+	host1, port1 := srv1.HostPort()
+	host2, port2 := srv2.HostPort()
+	srv1.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		return &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: host1, Port: int32(port1)},
+				{NodeID: 2, Host: host2, Port: int32(port2)},
+			},
+			Topics: []proto.MetadataRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.MetadataRespPartition{
+						{ID: 0, Leader: 1, Replicas: []int32{1, 2}, Isrs: []int32{1, 2}},
+						{ID: 1, Leader: 2, Replicas: []int32{1, 2}, Isrs: []int32{1, 2}},
+						{ID: 2, Leader: 1, Replicas: []int32{1, 2}, Isrs: []int32{1, 2}},
+					},
+				},
+			},
+		}
+	})
+
+	// every partition holds offsets 0 to 2, fetched two at a time
+	const size = 3
+	var mu sync.Mutex
+	var fetches []string
+	fetchHandler := func(name string) RequestHandler {
+		return func(request Serializable) Serializable {
+			req := request.(*proto.FetchReq)
+			resp := &proto.FetchResp{
+				CorrelationID: req.CorrelationID,
+				Version:       req.Version,
+				Topics:        []proto.FetchRespTopic{{Name: "test"}},
+			}
+			requested := name
+			for _, part := range req.Topics[0].Partitions {
+				requested += fmt.Sprintf(" %d@%d", part.ID, part.FetchOffset)
+				var messages []*proto.Message
+				for offset := part.FetchOffset; offset < size && len(messages) < 2; offset++ {
+					messages = append(messages, &proto.Message{
+						Offset: offset,
+						Value:  []byte(fmt.Sprintf("%d-%d", part.ID, offset)),
+					})
+				}
+				resp.Topics[0].Partitions = append(resp.Topics[0].Partitions, proto.FetchRespPartition{
+					ID: part.ID, TipOffset: size, Messages: messages,
+				})
+			}
+			mu.Lock()
+			fetches = append(fetches, requested)
+			mu.Unlock()
+			return resp
+		}
+	}
+	srv1.Handle(FetchRequest, fetchHandler("srv1"))
+	srv2.Handle(FetchRequest, fetchHandler("srv2"))
+
+	broker, err := NewBroker("test-cluster-multi-consumer", []string{srv1.Address()}, NewBrokerConf("tester"))
+	c.Assert(err, IsNil)
+
+	conf := NewConsumerConf("ignored", 5)
+	conf.StartOffset = 0
+	conf.RetryLimit = 0
+	_, err = broker.MultiConsumer("test", nil, conf)
+	c.Assert(err, Equals, ErrNoPartitions)
+	_, err = broker.MultiConsumer("test", []int32{0, 0}, conf)
+	c.Assert(err, NotNil)
+
+	mc, err := broker.MultiConsumer("test", []int32{0, 1, 2}, conf)
+	c.Assert(err, IsNil)
+
+	var values []string
+	for {
+		msg, err := mc.Consume()
+		if err == ErrNoData {
+			break
+		}
+		c.Assert(err, IsNil)
+		c.Assert(string(msg.Value), Equals, fmt.Sprintf("%d-%d", msg.Partition, msg.Offset))
+		values = append(values, string(msg.Value))
+	}
+
+	// partitions of the same leader share a fetch, leaders take turns
+	c.Assert(values, DeepEquals, []string{
+		"0-0", "2-0", "0-1", "2-1",
+		"1-0", "1-1",
+		"0-2", "2-2",
+		"1-2",
+	})
+	c.Assert(fetches, DeepEquals, []string{
+		"srv1 0@0 2@0",
+		"srv2 1@0",
+		"srv1 0@2 2@2",
+		"srv2 1@2",
+		"srv1 0@3 2@3",
+		"srv2 1@3",
+	})
+	c.Assert(mc.Offsets(), DeepEquals, map[int32]int64{0: size, 1: size, 2: size})
+}
+
+func (s *MultiConsumerSuite) TestConsumePartitionError(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 0, TipOffset: 1, Messages: []*proto.Message{{Offset: 0, Value: []byte("first")}}},
+						{ID: 1, TipOffset: -1, Err: proto.ErrOffsetOutOfRange},
+					},
+				},
+			},
+		}
+	})
+
+	broker, err := NewBroker("test-cluster-multi-consumer-error", []string{srv.Address()}, NewBrokerConf("tester"))
+	c.Assert(err, IsNil)
+
+	conf := NewConsumerConf("test", 0)
+	conf.StartOffset = 0
+	mc, err := broker.MultiConsumer("test", []int32{0, 1}, conf)
+	c.Assert(err, IsNil)
+
+	_, err = mc.Consume()
+	merr, ok := err.(*MultiError)
+	c.Assert(ok, Equals, true, Commentf("error %#v", err))
+	c.Assert(merr.Errors, DeepEquals, map[string]map[int32]error{"test": {1: proto.ErrOffsetOutOfRange}})
+	c.Assert(mc.Offsets(), DeepEquals, map[int32]int64{0: 0, 1: 0})
+}
+
+func (s *MultiConsumerSuite) TestConsumeMaxBytesClamped(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+	maxBytes := make(chan int32, 1)
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		maxBytes <- req.MaxBytes
+		resp := &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Version:       req.Version,
+			Topics:        []proto.FetchRespTopic{{Name: "test"}},
+		}
+		for _, part := range req.Topics[0].Partitions {
+			resp.Topics[0].Partitions = append(resp.Topics[0].Partitions,
+				proto.FetchRespPartition{ID: part.ID, TipOffset: 0})
+		}
+		return resp
+	})
+
+	brokerConf := NewBrokerConf("tester")
+	brokerConf.ForceAPIVersions = map[int16]int16{proto.FetchReqKind: 4}
+	broker, err := NewBroker("test-cluster-multi-consumer-max-bytes", []string{srv.Address()}, brokerConf)
+	c.Assert(err, IsNil)
+
+	conf := NewConsumerConf("test", 0)
+	conf.StartOffset = 0
+	conf.RetryLimit = 0
+	conf.MaxFetchSize = math.MaxInt32 - 1
+	mc, err := broker.MultiConsumer("test", []int32{0, 1}, conf)
+	c.Assert(err, IsNil)
+
+	_, err = mc.Consume()
+	c.Assert(err, Equals, ErrNoData)
+	c.Assert(<-maxBytes, Equals, int32(math.MaxInt32))
+}
+
+func (s *MultiConsumerSuite) TestUnsupportedOptions(c *C) {
+	broker := &Broker{}
+	cases := []struct {
+		modify func(*ConsumerConf)
+		err    string
+	}{
+		{func(conf *ConsumerConf) { conf.RackID = "rack" }, "invalid RackID: not supported by MultiConsumer"},
+		{func(conf *ConsumerConf) { conf.AdaptiveFetchSize = true }, "invalid AdaptiveFetchSize: not supported by MultiConsumer"},
+		{func(conf *ConsumerConf) { conf.DedupeWindow = time.Second }, "invalid DedupeWindow: not supported by MultiConsumer"},
+		{func(conf *ConsumerConf) { conf.MaxMessagesPerSecond = 10 }, "invalid MaxMessagesPerSecond: not supported by MultiConsumer"},
+		{func(conf *ConsumerConf) {
+			conf.CommitEveryMessage = true
+			conf.Coordinator = &staticOffsetCoordinator{}
+		}, "invalid CommitEveryMessage: not supported by MultiConsumer"},
+		{func(conf *ConsumerConf) { conf.ConsumeDeadline = time.Second }, "invalid ConsumeDeadline: not supported by MultiConsumer"},
+	}
+	for _, tc := range cases {
+		conf := NewConsumerConf("test", 0)
+		tc.modify(&conf)
+		_, err := broker.MultiConsumer("test", []int32{0}, conf)
+		c.Assert(err, ErrorMatches, tc.err)
+	}
+}
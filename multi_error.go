@@ -0,0 +1,96 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MultiError is returned by operations touching many partitions when some of
+// them fail. It maps topic and partition to the error of that partition;
+// partitions that succeeded are not present.
+//
+// errors.Is and errors.As match a MultiError if they match any of its
+// errors.
+type MultiError struct {
+	Errors map[string]map[int32]error
+}
+
+// Add records the error of a single partition.
+func (e *MultiError) Add(topic string, partition int32, err error) {
+	if e.Errors == nil {
+		e.Errors = make(map[string]map[int32]error)
+	}
+	if e.Errors[topic] == nil {
+		e.Errors[topic] = make(map[int32]error)
+	}
+	e.Errors[topic][partition] = err
+}
+
+// Len returns the number of partitions that failed.
+func (e *MultiError) Len() int {
+	var n int
+	for _, partitions := range e.Errors {
+		n += len(partitions)
+	}
+	return n
+}
+
+// ErrorOrNil returns e, or nil if no partition failed, so that the result
+// can be returned as error without being a non-nil interface holding an
+// empty MultiError.
+func (e *MultiError) ErrorOrNil() error {
+	if e == nil || e.Len() == 0 {
+		return nil
+	}
+	return e
+}
+
+// Error lists the errors of all failed partitions, ordered by topic and
+// partition.
+func (e *MultiError) Error() string {
+	var tps []topicPartition
+	for topic, partitions := range e.Errors {
+		for partition := range partitions {
+			tps = append(tps, topicPartition{topic: topic, partition: partition})
+		}
+	}
+	sort.Slice(tps, func(i, j int) bool {
+		if tps[i].topic != tps[j].topic {
+			return tps[i].topic < tps[j].topic
+		}
+		return tps[i].partition < tps[j].partition
+	})
+
+	msgs := make([]string, len(tps))
+	for i, tp := range tps {
+		msgs[i] = fmt.Sprintf("%s: %s", tp, e.Errors[tp.topic][tp.partition])
+	}
+	return fmt.Sprintf("%d partitions failed: %s", len(tps), strings.Join(msgs, "; "))
+}
+
+// Is reports whether any of the partition errors matches target.
+func (e *MultiError) Is(target error) bool {
+	for _, partitions := range e.Errors {
+		for _, err := range partitions {
+			if errors.Is(err, target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// As finds the first partition error matching target, in no particular
+// order, and sets target to it.
+func (e *MultiError) As(target interface{}) bool {
+	for _, partitions := range e.Errors {
+		for _, err := range partitions {
+			if errors.As(err, target) {
+				return true
+			}
+		}
+	}
+	return false
+}
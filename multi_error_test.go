@@ -0,0 +1,32 @@
+package kafka
+
+import (
+	"errors"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+var _ = Suite(&MultiErrorSuite{})
+
+type MultiErrorSuite struct{}
+
+func (s *MultiErrorSuite) TestMultiError(c *C) {
+	var errs MultiError
+	c.Assert(errs.ErrorOrNil(), IsNil)
+
+	errs.Add("foo", 3, proto.ErrNotLeaderForPartition)
+	errs.Add("bar", 1, &NoConnectionsAvailable{})
+	errs.Add("foo", 1, errors.New("boom"))
+	err := errs.ErrorOrNil()
+	c.Assert(err, NotNil)
+	c.Assert(errs.Len(), Equals, 3)
+	c.Assert(err, ErrorMatches, `3 partitions failed: bar:1: \[transient\] Connection pool is full.*; foo:1: boom; foo:3: .*not leader.*`)
+
+	c.Assert(errors.Is(err, proto.ErrNotLeaderForPartition), Equals, true)
+	c.Assert(errors.Is(err, proto.ErrOffsetOutOfRange), Equals, false)
+	var noConns *NoConnectionsAvailable
+	c.Assert(errors.As(err, &noConns), Equals, true)
+	c.Assert(noConns, NotNil)
+}
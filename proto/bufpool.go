@@ -0,0 +1,71 @@
+package proto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math/bits"
+	"sync"
+)
+
+// Decompressed message sets are only needed until the messages are decoded
+// from them, as decoding copies keys and values. Their buffers are pooled by
+// capacity, in powers of two, so that fetches of similar size reuse memory.
+const (
+	minPooledBufferBits = 10 // 1KB, smaller buffers are allocated as needed
+	maxPooledBufferBits = 26 // 64MB, bigger buffers are never pooled
+)
+
+var (
+	bufferPools [maxPooledBufferBits - minPooledBufferBits + 1]sync.Pool
+
+	gzipReaderPool sync.Pool
+)
+
+// getBuffer returns an empty buffer with capacity for at least size bytes.
+func getBuffer(size int) []byte {
+	shift := minPooledBufferBits
+	if size > 1<<minPooledBufferBits {
+		shift = bits.Len(uint(size - 1))
+	}
+	if shift > maxPooledBufferBits {
+		return make([]byte, 0, size)
+	}
+	if b, ok := bufferPools[shift-minPooledBufferBits].Get().(*[]byte); ok {
+		return (*b)[:0]
+	}
+	return make([]byte, 0, 1<<shift)
+}
+
+// putBuffer makes b available to getBuffer. The content of b must not be
+// used afterwards.
+func putBuffer(b []byte) {
+	shift := bits.Len(uint(cap(b))) - 1
+	if shift < minPooledBufferBits || shift > maxPooledBufferBits {
+		return
+	}
+	b = b[:0]
+	bufferPools[shift-minPooledBufferBits].Put(&b)
+}
+
+// gunzip decompresses val into a buffer of size hint or bigger, taken from
+// the pool. The result must be released with putBuffer.
+func gunzip(val []byte, hint int) ([]byte, error) {
+	var err error
+	cr, ok := gzipReaderPool.Get().(*gzip.Reader)
+	if ok {
+		err = cr.Reset(bytes.NewReader(val))
+	} else {
+		cr, err = gzip.NewReader(bytes.NewReader(val))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReaderPool.Put(cr)
+
+	buf := bytes.NewBuffer(getBuffer(hint))
+	if _, err := buf.ReadFrom(cr); err != nil {
+		putBuffer(buf.Bytes())
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
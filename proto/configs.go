@@ -0,0 +1,370 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+/*
+
+DescribeConfigs and AlterConfigs requests (version 0) as described in
+https://kafka.apache.org/protocol#The_Messages_DescribeConfigs
+
+Both require kafka 0.11 or newer.
+
+*/
+
+const (
+	DescribeConfigsReqKind = 32
+	AlterConfigsReqKind    = 33
+
+	// Types of resources whose configuration can be described or altered.
+	ConfigResourceTopic  = 2
+	ConfigResourceBroker = 4
+)
+
+type DescribeConfigsReq struct {
+	CorrelationID int32
+	ClientID      string
+	Resources     []DescribeConfigsReqResource
+}
+
+type DescribeConfigsReqResource struct {
+	Type int8
+	Name string
+
+	// ConfigNames to describe. All configuration entries of the resource are
+	// returned if nil.
+	ConfigNames []string
+}
+
+func ReadDescribeConfigsReq(r io.Reader) (*DescribeConfigsReq, error) {
+	var req DescribeConfigsReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.Resources = make([]DescribeConfigsReqResource, dec.DecodeArrayLen())
+	for ri := range req.Resources {
+		var res = &req.Resources[ri]
+		res.Type = dec.DecodeInt8()
+		res.Name = dec.DecodeString()
+		if n := dec.DecodeArrayLen(); n >= 0 {
+			res.ConfigNames = make([]string, n)
+			for ci := range res.ConfigNames {
+				res.ConfigNames[ci] = dec.DecodeString()
+			}
+		}
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *DescribeConfigsReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(DescribeConfigsReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.EncodeArrayLen(len(r.Resources))
+	for _, res := range r.Resources {
+		enc.Encode(res.Type)
+		enc.Encode(res.Name)
+		if res.ConfigNames == nil {
+			enc.EncodeArrayLen(-1)
+			continue
+		}
+		enc.EncodeArrayLen(len(res.ConfigNames))
+		for _, name := range res.ConfigNames {
+			enc.Encode(name)
+		}
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *DescribeConfigsReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+type DescribeConfigsResp struct {
+	CorrelationID int32
+	ThrottleTime  int32 // milliseconds
+	Resources     []DescribeConfigsRespResource
+}
+
+type DescribeConfigsRespResource struct {
+	Err           error
+	ErrMessage    string
+	Type          int8
+	Name          string
+	ConfigEntries []ConfigEntry
+}
+
+// ConfigEntry is a single configuration entry of a described resource.
+type ConfigEntry struct {
+	Name      string
+	Value     string
+	ReadOnly  bool
+	Default   bool
+	Sensitive bool // Value is not returned for sensitive entries
+}
+
+func ReadDescribeConfigsResp(r io.Reader) (*DescribeConfigsResp, error) {
+	var resp DescribeConfigsResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.ThrottleTime = dec.DecodeInt32()
+	resp.Resources = make([]DescribeConfigsRespResource, dec.DecodeArrayLen())
+	for ri := range resp.Resources {
+		var res = &resp.Resources[ri]
+		res.Err = errFromNo(dec.DecodeInt16())
+		res.ErrMessage = dec.DecodeString()
+		res.Type = dec.DecodeInt8()
+		res.Name = dec.DecodeString()
+		res.ConfigEntries = make([]ConfigEntry, dec.DecodeArrayLen())
+		for ei := range res.ConfigEntries {
+			var entry = &res.ConfigEntries[ei]
+			entry.Name = dec.DecodeString()
+			entry.Value = dec.DecodeString()
+			entry.ReadOnly = dec.DecodeInt8() != 0
+			entry.Default = dec.DecodeInt8() != 0
+			entry.Sensitive = dec.DecodeInt8() != 0
+		}
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *DescribeConfigsResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ThrottleTime)
+	enc.EncodeArrayLen(len(r.Resources))
+	for _, res := range r.Resources {
+		enc.EncodeError(res.Err)
+		enc.Encode(res.ErrMessage)
+		enc.Encode(res.Type)
+		enc.Encode(res.Name)
+		enc.EncodeArrayLen(len(res.ConfigEntries))
+		for _, entry := range res.ConfigEntries {
+			enc.Encode(entry.Name)
+			enc.Encode(entry.Value)
+			enc.Encode(encodeBool(entry.ReadOnly))
+			enc.Encode(encodeBool(entry.Default))
+			enc.Encode(encodeBool(entry.Sensitive))
+		}
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+type AlterConfigsReq struct {
+	CorrelationID int32
+	ClientID      string
+	Resources     []AlterConfigsReqResource
+
+	// ValidateOnly makes the broker check the request without applying it.
+	ValidateOnly bool
+}
+
+// AlterConfigsReqResource holds the configuration entries to set on a
+// resource. Entries that are not part of the request are reset to their
+// default values.
+type AlterConfigsReqResource struct {
+	Type          int8
+	Name          string
+	ConfigEntries []AlterConfigsReqEntry
+}
+
+type AlterConfigsReqEntry struct {
+	Name  string
+	Value string
+}
+
+func ReadAlterConfigsReq(r io.Reader) (*AlterConfigsReq, error) {
+	var req AlterConfigsReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.Resources = make([]AlterConfigsReqResource, dec.DecodeArrayLen())
+	for ri := range req.Resources {
+		var res = &req.Resources[ri]
+		res.Type = dec.DecodeInt8()
+		res.Name = dec.DecodeString()
+		res.ConfigEntries = make([]AlterConfigsReqEntry, dec.DecodeArrayLen())
+		for ei := range res.ConfigEntries {
+			var entry = &res.ConfigEntries[ei]
+			entry.Name = dec.DecodeString()
+			entry.Value = dec.DecodeString()
+		}
+	}
+	req.ValidateOnly = dec.DecodeInt8() != 0
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *AlterConfigsReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(AlterConfigsReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.EncodeArrayLen(len(r.Resources))
+	for _, res := range r.Resources {
+		enc.Encode(res.Type)
+		enc.Encode(res.Name)
+		enc.EncodeArrayLen(len(res.ConfigEntries))
+		for _, entry := range res.ConfigEntries {
+			enc.Encode(entry.Name)
+			enc.Encode(entry.Value)
+		}
+	}
+	enc.Encode(encodeBool(r.ValidateOnly))
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *AlterConfigsReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+type AlterConfigsResp struct {
+	CorrelationID int32
+	ThrottleTime  int32 // milliseconds
+	Resources     []AlterConfigsRespResource
+}
+
+type AlterConfigsRespResource struct {
+	Err        error
+	ErrMessage string
+	Type       int8
+	Name       string
+}
+
+func ReadAlterConfigsResp(r io.Reader) (*AlterConfigsResp, error) {
+	var resp AlterConfigsResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.ThrottleTime = dec.DecodeInt32()
+	resp.Resources = make([]AlterConfigsRespResource, dec.DecodeArrayLen())
+	for ri := range resp.Resources {
+		var res = &resp.Resources[ri]
+		res.Err = errFromNo(dec.DecodeInt16())
+		res.ErrMessage = dec.DecodeString()
+		res.Type = dec.DecodeInt8()
+		res.Name = dec.DecodeString()
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *AlterConfigsResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ThrottleTime)
+	enc.EncodeArrayLen(len(r.Resources))
+	for _, res := range r.Resources {
+		enc.EncodeError(res.Err)
+		enc.Encode(res.ErrMessage)
+		enc.Encode(res.Type)
+		enc.Encode(res.Name)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func encodeBool(v bool) int8 {
+	if v {
+		return 1
+	}
+	return 0
+}
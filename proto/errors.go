@@ -35,6 +35,17 @@ var (
 	ErrInvalidCommitOffsetSize                 = &KafkaError{28, "offset data size is not valid"}
 	ErrAuthorizationFailed                     = &KafkaError{29, "not authorized"}
 	ErrRebalanceInProgress                     = &KafkaError{30, "group is rebalancing, rejoin is needed"}
+	ErrInvalidConfig                           = &KafkaError{40, "configuration is invalid"}
+
+	// ErrGroupLoadInProgress is the name newer kafka versions use for
+	// ErrOffsetLoadInProgress, returned by a coordinator still loading the
+	// group after a failover.
+	ErrGroupLoadInProgress = ErrOffsetLoadInProgress
+
+	// ErrUnknownMemberID is the name newer kafka versions use for
+	// ErrUnknownConsumerID, returned for requests of members that are not
+	// part of the group, for example after being removed by a rebalance.
+	ErrUnknownMemberID = ErrUnknownConsumerID
 
 	errnoToErr = map[int16]error{
 		-1: ErrUnknown,
@@ -67,6 +78,20 @@ var (
 		28: ErrInvalidCommitOffsetSize,
 		29: ErrAuthorizationFailed,
 		30: ErrRebalanceInProgress,
+		40: ErrInvalidConfig,
+	}
+
+	// retryable are the errors marked as transient, for IsRetryable
+	retryable = map[*KafkaError]bool{
+		ErrUnknownTopicOrPartition:      true,
+		ErrLeaderNotAvailable:           true,
+		ErrNotLeaderForPartition:        true,
+		ErrRequestTimeout:               true,
+		ErrOffsetLoadInProgress:         true,
+		ErrNoCoordinator:                true,
+		ErrNotCoordinator:               true,
+		ErrNotEnoughReplicas:            true,
+		ErrNotEnoughReplicasAfterAppend: true,
 	}
 )
 
@@ -93,3 +118,12 @@ func errFromNo(errno int16) error {
 	}
 	return err
 }
+
+// IsRetryable returns true if err is a transient error returned by kafka, so
+// that sending the same request again, possibly after refreshing metadata,
+// might succeed. Note that retrying a produce request failed with
+// ErrNotEnoughReplicasAfterAppend writes the messages again.
+func IsRetryable(err error) bool {
+	kerr, ok := err.(*KafkaError)
+	return ok && retryable[kerr]
+}
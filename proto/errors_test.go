@@ -0,0 +1,23 @@
+package proto
+
+import (
+	"errors"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ErrorsSuite{})
+
+type ErrorsSuite struct{}
+
+func (s *ErrorsSuite) TestIsRetryable(c *C) {
+	for errno, err := range errnoToErr {
+		transient := strings.HasPrefix(err.(*KafkaError).message, "[transient]")
+		c.Assert(IsRetryable(err), Equals, transient, Commentf("error %d", errno))
+	}
+	c.Assert(IsRetryable(errFromNo(5)), Equals, true)
+	c.Assert(IsRetryable(errFromNo(1000)), Equals, false)
+	c.Assert(IsRetryable(errors.New("[transient] not a kafka error")), Equals, false)
+	c.Assert(IsRetryable(nil), Equals, false)
+}
@@ -0,0 +1,43 @@
+package proto
+
+import "sort"
+
+// Header is a single key value pair attached to a record. Keys do not have to
+// be unique within a record.
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// InjectHeaders sets the headers of the message to the entries of carrier,
+// replacing any header with the same key. Other headers are kept. New headers
+// are added in key order, so that the result does not depend on map
+// iteration.
+func InjectHeaders(carrier map[string][]byte, msg *Message) {
+	headers := msg.Headers[:0:0]
+	for _, h := range msg.Headers {
+		if _, ok := carrier[h.Key]; !ok {
+			headers = append(headers, h)
+		}
+	}
+
+	keys := make([]string, 0, len(carrier))
+	for key := range carrier {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		headers = append(headers, Header{Key: key, Value: carrier[key]})
+	}
+	msg.Headers = headers
+}
+
+// ExtractHeaders returns the headers of the message mapped by key. If a key
+// is used by several headers, the value of the last one is returned.
+func ExtractHeaders(msg *Message) map[string][]byte {
+	carrier := make(map[string][]byte, len(msg.Headers))
+	for _, h := range msg.Headers {
+		carrier[h.Key] = h.Value
+	}
+	return carrier
+}
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
-	"io/ioutil"
 	"time"
 
 	"github.com/golang/snappy"
@@ -38,18 +37,51 @@ const (
 	// return you a single element.
 	OffsetReqTimeEarliest = -2
 
+	// Fetch all messages, including those of aborted and not yet committed
+	// transactions.
+	IsolationLevelReadUncommitted = 0
+
+	// Fetch only messages of committed transactions. Requires fetch request
+	// version 4 or higher.
+	IsolationLevelReadCommitted = 1
+)
+
+// defaultMaxResponseSize is the largest response size prefix ReadResp will
+// accept. Anything bigger is assumed to be a corrupt or misframed stream.
+const defaultMaxResponseSize int32 = 256 * 1024 * 1024
+
+// ErrInvalidResponseSize is returned by ReadResp and ReadRespLimit when the
+// size prefix of a response is negative, too small to hold a correlation ID
+// or larger than the size limit.
+var ErrInvalidResponseSize = errors.New("invalid response size")
+
+// RequiredAcks tells the broker how many replicas have to acknowledge a
+// produce request before sending a response.
+type RequiredAcks int16
+
+const (
 	// Server will not send any response.
-	RequiredAcksNone = 0
+	RequiredAcksNone RequiredAcks = 0
 
 	// Server will block until the message is committed by all in sync replicas
 	// before sending a response.
-	RequiredAcksAll = -1
+	RequiredAcksAll RequiredAcks = -1
 
 	// Server will wait the data is written to the local log before sending a
 	// response.
-	RequiredAcksLocal = 1
+	RequiredAcksLocal RequiredAcks = 1
 )
 
+// Valid returns true if the value is one of RequiredAcksNone, RequiredAcksAll
+// or RequiredAcksLocal, the only values accepted by current brokers.
+func (a RequiredAcks) Valid() bool {
+	switch a {
+	case RequiredAcksNone, RequiredAcksAll, RequiredAcksLocal:
+		return true
+	}
+	return false
+}
+
 type Compression int8
 
 const (
@@ -86,13 +118,30 @@ func ReadReq(r io.Reader) (requestKind int16, b []byte, err error) {
 // including 4 bytes of message size itself.
 // Byte representation returned by ReadResp can be parsed by all response
 // reeaders to transform it into specialized response structure.
+//
+// The size prefix is checked against a limit of 256MB before any buffer is
+// allocated, so a corrupt prefix results in ErrInvalidResponseSize instead of
+// a huge allocation.
 func ReadResp(r io.Reader) (correlationID int32, b []byte, err error) {
+	return ReadRespLimit(r, 0)
+}
+
+// ReadRespLimit works like ReadResp, but checks the size prefix against the
+// given limit instead. A limit of 0 or less means the default of ReadResp.
+func ReadRespLimit(r io.Reader, limit int32) (correlationID int32, b []byte, err error) {
+	if limit <= 0 {
+		limit = defaultMaxResponseSize
+	}
 	dec := NewDecoder(r)
 	msgSize := dec.DecodeInt32()
 	correlationID = dec.DecodeInt32()
 	if err := dec.Err(); err != nil {
 		return 0, nil, err
 	}
+	// message size includes the correlation ID we've already read
+	if msgSize < 4 || msgSize > limit {
+		return 0, nil, ErrInvalidResponseSize
+	}
 	// size of the message + size of the message itself
 	b = make([]byte, msgSize+4)
 	binary.BigEndian.PutUint32(b, uint32(msgSize))
@@ -110,6 +159,16 @@ type Message struct {
 	Topic     string // set when fetching, ignored when producing
 	Partition int32  // set when fetching, ignored when producing
 	TipOffset int64  // set when fetching, ignored when processing
+
+	// Timestamp is set when fetching messages stored in message format v1
+	// or newer, zero otherwise. When producing it is only written by produce
+	// requests of version 3 and higher.
+	Timestamp time.Time
+
+	// Headers are set when fetching messages stored in message format v2.
+	// When producing they are only written by produce requests of version 3
+	// and higher, older versions use the legacy format which has no headers.
+	Headers []Header
 }
 
 // ComputeCrc returns crc32 hash for given message content.
@@ -236,17 +295,75 @@ func (w *slicewriter) Slice() []byte {
 // off part of the last message. This also means that the last message can be
 // shorter than the header is saying. In such case just ignore the last
 // malformed message from the set and returned earlier data.
+//
+// Control records of transactional producers are never returned.
 func readMessageSet(r io.Reader, size int32) ([]*Message, error) {
+	return readMessageSetSkip(r, size, nil)
+}
+
+// readMessageSetSkip works like readMessageSet, but skips malformed messages
+// when skipped is not nil, see readMessageBatches.
+func readMessageSetSkip(r io.Reader, size int32, skipped *[]int64) ([]*Message, error) {
+	batches, err := readMessageBatches(r, size, skipped)
+	if err != nil {
+		return nil, err
+	}
+	set := make([]*Message, 0, 256)
+	for _, batch := range batches {
+		if !batch.control {
+			set = append(set, batch.messages...)
+		}
+	}
+	return set, nil
+}
+
+// readMessageBatches works like readMessageSet, but keeps messages grouped
+// by the record batch they were read from, so that transactional state can be
+// applied to them. Consecutive messages in legacy formats are grouped into a
+// single batch.
+//
+// Reading stops at the first message with an invalid crc or returns an error
+// if a message cannot be decoded. If skipped is not nil, such messages are
+// skipped instead and their offsets appended to skipped. A message with an
+// invalid length always ends the set, as the following messages cannot be
+// found.
+//
+// Compressed legacy messages are decompressed and replaced by the messages
+// they wrap, see readWrappedMessages.
+func readMessageBatches(r io.Reader, size int32, skipped *[]int64) ([]*messageBatch, error) {
+	return readNestedMessageBatches(r, size, skipped, 0)
+}
+
+// maxCompressionDepth limits how deep compressed message sets can be nested in
+// each other.
+const maxCompressionDepth = 4
+
+// readNestedMessageBatches works like readMessageBatches, reading a message
+// set wrapped by depth compressed messages. The wrapping message's crc covers
+// the whole set, so a message with an invalid crc, or cut off, in a wrapped
+// set is corrupted rather than truncated by the broker, and is reported as an
+// error unless skipped is not nil.
+func readNestedMessageBatches(r io.Reader, size int32, skipped *[]int64, depth int) ([]*messageBatch, error) {
 	rd := io.LimitReader(r, int64(size))
 	dec := NewDecoder(rd)
-	set := make([]*Message, 0, 256)
+	batches := make([]*messageBatch, 0, 4)
+
+	// legacy returns the batch legacy format messages should be added to
+	legacy := func() *messageBatch {
+		if n := len(batches); n > 0 && batches[n-1].legacy {
+			return batches[n-1]
+		}
+		b := &messageBatch{producerID: -1, legacy: true, messages: make([]*Message, 0, 256)}
+		batches = append(batches, b)
+		return b
+	}
 
 	var buf []byte
 	for {
 		offset := dec.DecodeInt64()
 		if err := dec.Err(); err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				return set, nil
+				return batches, nil
 			}
 			return nil, err
 		}
@@ -254,11 +371,15 @@ func readMessageSet(r io.Reader, size int32) ([]*Message, error) {
 		size := dec.DecodeInt32()
 		if err := dec.Err(); err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				return set, nil
+				return batches, nil
 			}
 			return nil, err
 		}
 
+		if size < 0 {
+			return batches, nil
+		}
+
 		// read message to buffer to compute its content crc
 		if int(size) > len(buf) {
 			// allocate a bit more than needed
@@ -268,10 +389,41 @@ func readMessageSet(r io.Reader, size int32) ([]*Message, error) {
 
 		if _, err := io.ReadFull(rd, msgbuf); err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				return set, nil
+				if depth > 0 && skipped == nil {
+					return nil, fmt.Errorf("compressed message set cut off at offset %d", offset)
+				}
+				return batches, nil
 			}
 			return nil, err
 		}
+		if len(msgbuf) < 5 {
+			return batches, nil
+		}
+
+		// magic byte is at the same position in all message formats
+		if msgbuf[4] == messageMagicV2 {
+			if len(msgbuf) < recordBatchHeaderSize ||
+				binary.BigEndian.Uint32(msgbuf[5:9]) != crc32.Checksum(msgbuf[9:], castagnoliTable) {
+				if skipped != nil {
+					*skipped = append(*skipped, offset)
+					continue
+				}
+				// same as with legacy messages, stop at the first
+				// corrupted batch
+				return batches, nil
+			}
+			batch, err := readRecordBatch(offset, msgbuf)
+			if err != nil {
+				if skipped != nil {
+					*skipped = append(*skipped, offset)
+					continue
+				}
+				return nil, fmt.Errorf("cannot decode record batch: %s", err)
+			}
+			batches = append(batches, batch)
+			continue
+		}
+
 		msgdec := NewDecoder(bytes.NewBuffer(msgbuf))
 
 		msg := &Message{
@@ -280,63 +432,140 @@ func readMessageSet(r io.Reader, size int32) ([]*Message, error) {
 		}
 
 		if msg.Crc != crc32.ChecksumIEEE(msgbuf[4:]) {
+			if skipped != nil {
+				*skipped = append(*skipped, offset)
+				continue
+			}
+			if depth > 0 {
+				return nil, fmt.Errorf("invalid crc of compressed message at offset %d", offset)
+			}
 			// ignore this message and because we want to have constant
 			// history, do not process anything more
-			return set, nil
+			return batches, nil
 		}
 
-		// magic byte
-		_ = msgdec.DecodeInt8()
-
+		magic := msgdec.DecodeInt8()
 		attributes := msgdec.DecodeInt8()
+		if magic == messageMagicV1 {
+			msg.Timestamp = timestampFromMillis(msgdec.DecodeInt64())
+		}
 		switch compression := Compression(attributes & 3); compression {
 		case CompressionNone:
 			msg.Key = msgdec.DecodeBytes()
 			msg.Value = msgdec.DecodeBytes()
 			if err := msgdec.Err(); err != nil {
+				if skipped != nil {
+					*skipped = append(*skipped, offset)
+					continue
+				}
 				return nil, fmt.Errorf("cannot decode message: %s", err)
 			}
-			set = append(set, msg)
+			b := legacy()
+			b.messages = append(b.messages, msg)
 		case CompressionGzip, CompressionSnappy:
 			_ = msgdec.DecodeBytes() // ignore key
 			val := msgdec.DecodeBytes()
 			if err := msgdec.Err(); err != nil {
-				return nil, fmt.Errorf("cannot decode message: %s", err)
-			}
-			var decoded []byte
-			switch compression {
-			case CompressionGzip:
-				cr, err := gzip.NewReader(bytes.NewReader(val))
-				if err != nil {
-					return nil, fmt.Errorf("error decoding gzip message: %s", err)
-				}
-				decoded, err = ioutil.ReadAll(cr)
-				if err != nil {
-					return nil, fmt.Errorf("error decoding gzip message: %s", err)
-				}
-				_ = cr.Close()
-			case CompressionSnappy:
-				var err error
-				decoded, err = snappyDecode(val)
-				if err != nil {
-					return nil, fmt.Errorf("error decoding snappy message: %s", err)
+				if skipped != nil {
+					*skipped = append(*skipped, offset)
+					continue
 				}
+				return nil, fmt.Errorf("cannot decode message: %s", err)
 			}
-			msgs, err := readMessageSet(bytes.NewReader(decoded), int32(len(decoded)))
+			msgs, err := readWrappedMessages(msg.Offset, magic, compression, val, skipped, depth)
 			if err != nil {
+				if skipped != nil {
+					*skipped = append(*skipped, offset)
+					continue
+				}
 				return nil, err
 			}
-			set = append(set, msgs...)
+			if attributes&messageLogAppendTime != 0 {
+				// broker assigned timestamp applies to all inner messages
+				for _, m := range msgs {
+					m.Timestamp = msg.Timestamp
+				}
+			}
+			b := legacy()
+			b.messages = append(b.messages, msgs...)
 		default:
+			if skipped != nil {
+				*skipped = append(*skipped, offset)
+				continue
+			}
 			return nil, fmt.Errorf("cannot handle compression method: %d", compression)
 		}
 	}
 }
 
+// readWrappedMessages decompresses the value of a legacy message with given
+// offset and magic byte and returns the messages of the message set it holds,
+// which may be compressed again.
+//
+// Messages wrapped by a message of format v1 store offsets relative to the
+// set, with the wrapping message carrying the absolute offset of the last
+// one; they are converted to absolute offsets, including the offsets appended
+// to skipped. Messages wrapped in format v0 already store absolute offsets.
+func readWrappedMessages(offset int64, magic int8, compression Compression, val []byte, skipped *[]int64, depth int) ([]*Message, error) {
+	if depth >= maxCompressionDepth {
+		return nil, fmt.Errorf("compressed messages nested more than %d levels deep", maxCompressionDepth)
+	}
+	decoded, err := decompress(compression, val)
+	if err != nil {
+		return nil, err
+	}
+	var innerSkipped *[]int64
+	if skipped != nil {
+		innerSkipped = new([]int64)
+	}
+	batches, err := readNestedMessageBatches(bytes.NewReader(decoded), int32(len(decoded)), innerSkipped, depth+1)
+	putBuffer(decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []*Message
+	for _, batch := range batches {
+		if !batch.control {
+			msgs = append(msgs, batch.messages...)
+		}
+	}
+	var inner []int64
+	if innerSkipped != nil {
+		inner = *innerSkipped
+	}
+
+	if magic == messageMagicV1 && (len(msgs) > 0 || len(inner) > 0) {
+		// messages are read in order, the last one has the highest offset
+		var last int64
+		if n := len(msgs); n > 0 {
+			last = msgs[n-1].Offset
+		}
+		if n := len(inner); n > 0 && inner[n-1] > last {
+			last = inner[n-1]
+		}
+		base := offset - last
+		for _, m := range msgs {
+			m.Offset += base
+		}
+		for i := range inner {
+			inner[i] += base
+		}
+	}
+	if skipped != nil {
+		*skipped = append(*skipped, inner...)
+	}
+	return msgs, nil
+}
+
 type MetadataReq struct {
 	CorrelationID int32
 	ClientID      string
 	Topics        []string
+
+	// Version of the request, 0 to 2 are supported. Starting with version 1,
+	// nil Topics requests all topics while an empty list requests none.
+	Version int16
 }
 
 func ReadMetadataReq(r io.Reader) (*MetadataReq, error) {
@@ -345,11 +574,15 @@ func ReadMetadataReq(r io.Reader) (*MetadataReq, error) {
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
-	req.Topics = make([]string, dec.DecodeArrayLen())
+	// null array (all topics) is only sent with version 1 and higher
+	if n := dec.DecodeArrayLen(); n >= 0 {
+		req.Topics = make([]string, n)
+	}
 	for i := range req.Topics {
 		req.Topics[i] = dec.DecodeString()
 	}
@@ -361,17 +594,26 @@ func ReadMetadataReq(r io.Reader) (*MetadataReq, error) {
 }
 
 func (r *MetadataReq) Bytes() ([]byte, error) {
+	if r.Version < 0 || r.Version > 2 {
+		return nil, fmt.Errorf("unsupported metadata request version: %d", r.Version)
+	}
+
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(int16(MetadataReqKind))
-	enc.Encode(int16(0))
+	enc.Encode(r.Version)
 	enc.Encode(r.CorrelationID)
 	enc.Encode(r.ClientID)
 
-	enc.EncodeArrayLen(len(r.Topics))
+	if r.Topics == nil && r.Version >= 1 {
+		// null array means all topics
+		enc.EncodeArrayLen(-1)
+	} else {
+		enc.EncodeArrayLen(len(r.Topics))
+	}
 	for _, name := range r.Topics {
 		enc.Encode(name)
 	}
@@ -398,19 +640,31 @@ func (r *MetadataReq) WriteTo(w io.Writer) (int64, error) {
 
 type MetadataResp struct {
 	CorrelationID int32
-	Brokers       []MetadataRespBroker
-	Topics        []MetadataRespTopic
+
+	// Version of the response, must match the version of the request.
+	Version int16
+
+	Brokers []MetadataRespBroker
+
+	// ClusterID is set with version 2 and higher, ControllerID with
+	// version 1 and higher.
+	ClusterID    string
+	ControllerID int32
+
+	Topics []MetadataRespTopic
 }
 
 type MetadataRespBroker struct {
 	NodeID int32
 	Host   string
 	Port   int32
+	Rack   string // set with version 1 and higher
 }
 
 type MetadataRespTopic struct {
 	Name       string
 	Err        error
+	IsInternal bool // set with version 1 and higher
 	Partitions []MetadataRespPartition
 }
 
@@ -434,11 +688,27 @@ func (r *MetadataResp) Bytes() ([]byte, error) {
 		enc.Encode(broker.NodeID)
 		enc.Encode(broker.Host)
 		enc.Encode(broker.Port)
+		if r.Version >= 1 {
+			encodeNullableString(enc, broker.Rack)
+		}
+	}
+	if r.Version >= 2 {
+		encodeNullableString(enc, r.ClusterID)
+	}
+	if r.Version >= 1 {
+		enc.Encode(r.ControllerID)
 	}
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
 		enc.EncodeError(topic.Err)
 		enc.Encode(topic.Name)
+		if r.Version >= 1 {
+			var internal int8
+			if topic.IsInternal {
+				internal = 1
+			}
+			enc.Encode(internal)
+		}
 		enc.EncodeArrayLen(len(topic.Partitions))
 		for _, part := range topic.Partitions {
 			enc.EncodeError(part.Err)
@@ -460,13 +730,22 @@ func (r *MetadataResp) Bytes() ([]byte, error) {
 	return b, nil
 }
 
+// ReadMetadataResp reads a version 0 metadata response.
 func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
+	return ReadVersionedMetadataResp(r, 0)
+}
+
+// ReadVersionedMetadataResp reads a metadata response of given version. The
+// version is not part of the response, so it must be the one used by the
+// request.
+func ReadVersionedMetadataResp(r io.Reader, version int16) (*MetadataResp, error) {
 	var resp MetadataResp
 	dec := NewDecoder(r)
 
 	// total message size
 	_ = dec.DecodeInt32()
 	resp.CorrelationID = dec.DecodeInt32()
+	resp.Version = version
 
 	resp.Brokers = make([]MetadataRespBroker, dec.DecodeArrayLen())
 	for i := range resp.Brokers {
@@ -474,6 +753,15 @@ func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
 		b.NodeID = dec.DecodeInt32()
 		b.Host = dec.DecodeString()
 		b.Port = dec.DecodeInt32()
+		if version >= 1 {
+			b.Rack = dec.DecodeString()
+		}
+	}
+	if version >= 2 {
+		resp.ClusterID = dec.DecodeString()
+	}
+	if version >= 1 {
+		resp.ControllerID = dec.DecodeInt32()
 	}
 
 	resp.Topics = make([]MetadataRespTopic, dec.DecodeArrayLen())
@@ -481,6 +769,9 @@ func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
 		var t = &resp.Topics[ti]
 		t.Err = errFromNo(dec.DecodeInt16())
 		t.Name = dec.DecodeString()
+		if version >= 1 {
+			t.IsInternal = dec.DecodeInt8() != 0
+		}
 		t.Partitions = make([]MetadataRespPartition, dec.DecodeArrayLen())
 		for pi := range t.Partitions {
 			var p = &t.Partitions[pi]
@@ -506,12 +797,39 @@ func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
 	return &resp, nil
 }
 
+// encodeNullableString writes empty string as null.
+func encodeNullableString(enc *encoder, val string) {
+	if val == "" {
+		enc.EncodeInt16(-1)
+		return
+	}
+	enc.EncodeString(val)
+}
+
 type FetchReq struct {
 	CorrelationID int32
 	ClientID      string
 	MaxWaitTime   time.Duration
 	MinBytes      int32
 
+	// Version of the request, 0 to 11 are supported. Zero value sends the
+	// request in the original format. Fetch sessions (version 7 and higher)
+	// are not used, every request is a full fetch.
+	Version int16
+
+	// MaxBytes limits the size of the whole response. Sent with version 3
+	// and higher.
+	MaxBytes int32
+
+	// IsolationLevel is one of IsolationLevelReadUncommitted or
+	// IsolationLevelReadCommitted. Sent with version 4 and higher.
+	IsolationLevel int8
+
+	// RackID of the client, which lets brokers configured for it suggest
+	// a replica close to the client to fetch from. Sent with version 11 and
+	// higher.
+	RackID string
+
 	Topics []FetchReqTopic
 }
 
@@ -532,14 +850,25 @@ func ReadFetchReq(r io.Reader) (*FetchReq, error) {
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
 	// replica id
 	_ = dec.DecodeInt32()
 	req.MaxWaitTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
 	req.MinBytes = dec.DecodeInt32()
+	if req.Version >= 3 {
+		req.MaxBytes = dec.DecodeInt32()
+	}
+	if req.Version >= 4 {
+		req.IsolationLevel = dec.DecodeInt8()
+	}
+	if req.Version >= 7 {
+		// session id + session epoch
+		_ = dec.DecodeInt64()
+	}
 	req.Topics = make([]FetchReqTopic, dec.DecodeArrayLen())
 	for ti := range req.Topics {
 		var topic = &req.Topics[ti]
@@ -548,10 +877,30 @@ func ReadFetchReq(r io.Reader) (*FetchReq, error) {
 		for pi := range topic.Partitions {
 			var part = &topic.Partitions[pi]
 			part.ID = dec.DecodeInt32()
+			if req.Version >= 9 {
+				// current leader epoch
+				_ = dec.DecodeInt32()
+			}
 			part.FetchOffset = dec.DecodeInt64()
+			if req.Version >= 5 {
+				// log start offset
+				_ = dec.DecodeInt64()
+			}
 			part.MaxBytes = dec.DecodeInt32()
 		}
 	}
+	if req.Version >= 7 {
+		// forgotten topics
+		for i, n := 0, dec.DecodeArrayLen(); i < n; i++ {
+			_ = dec.DecodeString()
+			for j, m := 0, dec.DecodeArrayLen(); j < m; j++ {
+				_ = dec.DecodeInt32()
+			}
+		}
+	}
+	if req.Version >= 11 {
+		req.RackID = dec.DecodeString()
+	}
 
 	if dec.Err() != nil {
 		return nil, dec.Err()
@@ -560,13 +909,17 @@ func ReadFetchReq(r io.Reader) (*FetchReq, error) {
 }
 
 func (r *FetchReq) Bytes() ([]byte, error) {
+	if r.Version < 0 || r.Version > 11 {
+		return nil, fmt.Errorf("unsupported fetch request version: %d", r.Version)
+	}
+
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(int16(FetchReqKind))
-	enc.Encode(int16(0))
+	enc.Encode(r.Version)
 	enc.Encode(r.CorrelationID)
 	enc.Encode(r.ClientID)
 
@@ -574,6 +927,16 @@ func (r *FetchReq) Bytes() ([]byte, error) {
 	enc.Encode(int32(-1))
 	enc.Encode(int32(r.MaxWaitTime / time.Millisecond))
 	enc.Encode(r.MinBytes)
+	if r.Version >= 3 {
+		enc.Encode(r.MaxBytes)
+	}
+	if r.Version >= 4 {
+		enc.Encode(r.IsolationLevel)
+	}
+	if r.Version >= 7 {
+		enc.Encode(int32(0))  // session id, none
+		enc.Encode(int32(-1)) // session epoch, full fetch without session
+	}
 
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
@@ -581,10 +944,22 @@ func (r *FetchReq) Bytes() ([]byte, error) {
 		enc.EncodeArrayLen(len(topic.Partitions))
 		for _, part := range topic.Partitions {
 			enc.Encode(part.ID)
+			if r.Version >= 9 {
+				enc.Encode(int32(-1)) // current leader epoch, unknown
+			}
 			enc.Encode(part.FetchOffset)
+			if r.Version >= 5 {
+				enc.Encode(int64(-1)) // log start offset, only used by followers
+			}
 			enc.Encode(part.MaxBytes)
 		}
 	}
+	if r.Version >= 7 {
+		enc.EncodeArrayLen(0) // forgotten topics
+	}
+	if r.Version >= 11 {
+		enc.Encode(r.RackID)
+	}
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
@@ -608,7 +983,20 @@ func (r *FetchReq) WriteTo(w io.Writer) (int64, error) {
 
 type FetchResp struct {
 	CorrelationID int32
-	Topics        []FetchRespTopic
+
+	// Version of the response, must match the version of the request.
+	Version int16
+
+	// ThrottleTime is set with version 1 and higher.
+	ThrottleTime time.Duration
+
+	// Err is the error of the whole request, set with version 7 and higher.
+	Err error
+
+	// Compression of the written messages, only used when serializing.
+	Compression Compression
+
+	Topics []FetchRespTopic
 }
 
 type FetchRespTopic struct {
@@ -620,7 +1008,76 @@ type FetchRespPartition struct {
 	ID        int32
 	Err       error
 	TipOffset int64
-	Messages  []*Message
+
+	// LastStableOffset and AbortedTransactions are set with version 4 and
+	// higher. Messages of aborted transactions are already filtered out
+	// from Messages when decoding.
+	LastStableOffset    int64
+	AbortedTransactions []FetchRespAbortedTransaction
+
+	// LogStartOffset is the first offset of the partition log, set with
+	// version 5 and higher.
+	LogStartOffset int64
+
+	// PreferredReadReplica is the ID of the node the client should fetch
+	// from next, or -1 if it should keep fetching from the node it asked.
+	// Set with version 11 and higher.
+	PreferredReadReplica int32
+
+	Messages []*Message
+
+	// MalformedOffsets are the offsets of messages that were skipped because
+	// they could not be decoded. Only set by ReadFetchRespSkipMalformed.
+	MalformedOffsets []int64
+
+	// RawMessages is the message set as sent by the broker, which may end
+	// with a partial entry, see RawEntries. Only set by ReadFetchRespRaw,
+	// which leaves Messages empty.
+	RawMessages []byte
+}
+
+// RawEntry is a complete entry of a raw message set: a single message, a
+// compressed message wrapping several or a record batch.
+type RawEntry struct {
+	// LastOffset is the offset of the last message of the entry.
+	LastOffset int64
+	// Data is the entry as sent by the broker, including its offset and
+	// size.
+	Data []byte
+}
+
+// RawEntries splits a raw message set into its complete entries without
+// decoding their messages. The partial entry brokers send at the end of a
+// message set cut by the fetch size is dropped, as is everything from an
+// entry that cannot be parsed on.
+func RawEntries(raw []byte) []RawEntry {
+	// Message set entries and record batches both start with their offset
+	// and size, and have the magic byte at the same position.
+	const headerSize, magicPos, lastOffsetDeltaPos = 12, 16, 23
+	var entries []RawEntry
+	for len(raw) >= headerSize {
+		offset := int64(binary.BigEndian.Uint64(raw))
+		size := int64(int32(binary.BigEndian.Uint32(raw[8:])))
+		n := headerSize + size
+		if n <= magicPos || n > int64(len(raw)) {
+			break
+		}
+		last := offset
+		if raw[magicPos] == 2 {
+			if n < lastOffsetDeltaPos+4 {
+				break
+			}
+			last += int64(int32(binary.BigEndian.Uint32(raw[lastOffsetDeltaPos:])))
+		}
+		entries = append(entries, RawEntry{LastOffset: last, Data: raw[:n:n]})
+		raw = raw[n:]
+	}
+	return entries
+}
+
+type FetchRespAbortedTransaction struct {
+	ProducerID  int64
+	FirstOffset int64
 }
 
 func (r *FetchResp) Bytes() ([]byte, error) {
@@ -629,6 +1086,13 @@ func (r *FetchResp) Bytes() ([]byte, error) {
 
 	enc.Encode(int32(0)) // placeholder
 	enc.Encode(r.CorrelationID)
+	if r.Version >= 1 {
+		enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	}
+	if r.Version >= 7 {
+		enc.EncodeError(r.Err)
+		enc.Encode(int32(0)) // session id
+	}
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
 		enc.Encode(topic.Name)
@@ -637,11 +1101,31 @@ func (r *FetchResp) Bytes() ([]byte, error) {
 			enc.Encode(part.ID)
 			enc.EncodeError(part.Err)
 			enc.Encode(part.TipOffset)
+			if r.Version >= 4 {
+				enc.Encode(part.LastStableOffset)
+			}
+			if r.Version >= 5 {
+				enc.Encode(part.LogStartOffset)
+			}
+			if r.Version >= 4 {
+				enc.EncodeArrayLen(len(part.AbortedTransactions))
+				for _, txn := range part.AbortedTransactions {
+					enc.Encode(txn.ProducerID)
+					enc.Encode(txn.FirstOffset)
+				}
+			}
+			if r.Version >= 11 {
+				enc.Encode(part.PreferredReadReplica)
+			}
 			i := len(buf)
 			enc.Encode(int32(0)) // placeholder
-			// NOTE(caleb): writing compressed fetch response isn't implemented
-			// for now, since that's not needed for clients.
-			n, err := writeMessageSet(&buf, part.Messages, CompressionNone)
+			var n int
+			var err error
+			if r.Version >= 4 {
+				n, err = writeRecordBatch(&buf, &messageBatch{producerID: -1, messages: part.Messages}, r.Compression)
+			} else {
+				n, err = writeMessageSet(&buf, part.Messages, r.Compression)
+			}
 			if err != nil {
 				return nil, err
 			}
@@ -657,8 +1141,32 @@ func (r *FetchResp) Bytes() ([]byte, error) {
 	return []byte(buf), nil
 }
 
+// ReadFetchResp reads a version 0 fetch response.
 func ReadFetchResp(r io.Reader) (*FetchResp, error) {
-	var err error
+	return ReadVersionedFetchResp(r, 0)
+}
+
+// ReadVersionedFetchResp reads a fetch response of given version. The version
+// is not part of the response, so it must be the one used by the request.
+func ReadVersionedFetchResp(r io.Reader, version int16) (*FetchResp, error) {
+	return readFetchResp(r, version, false, false)
+}
+
+// ReadFetchRespSkipMalformed works like ReadVersionedFetchResp, but messages
+// with an invalid crc or that cannot be decoded are skipped instead of ending
+// the message set. Offsets of skipped messages are reported in
+// MalformedOffsets of their partition.
+func ReadFetchRespSkipMalformed(r io.Reader, version int16) (*FetchResp, error) {
+	return readFetchResp(r, version, true, false)
+}
+
+// ReadFetchRespRaw works like ReadVersionedFetchResp, but message sets are
+// kept in RawMessages of their partition instead of being decoded.
+func ReadFetchRespRaw(r io.Reader, version int16) (*FetchResp, error) {
+	return readFetchResp(r, version, false, true)
+}
+
+func readFetchResp(r io.Reader, version int16, skipMalformed, raw bool) (*FetchResp, error) {
 	var resp FetchResp
 
 	dec := NewDecoder(r)
@@ -666,6 +1174,15 @@ func ReadFetchResp(r io.Reader) (*FetchResp, error) {
 	// total message size
 	_ = dec.DecodeInt32()
 	resp.CorrelationID = dec.DecodeInt32()
+	resp.Version = version
+	if version >= 1 {
+		resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	}
+	if version >= 7 {
+		resp.Err = errFromNo(dec.DecodeInt16())
+		// session id
+		_ = dec.DecodeInt32()
+	}
 
 	resp.Topics = make([]FetchRespTopic, dec.DecodeArrayLen())
 	for ti := range resp.Topics {
@@ -677,6 +1194,23 @@ func ReadFetchResp(r io.Reader) (*FetchResp, error) {
 			part.ID = dec.DecodeInt32()
 			part.Err = errFromNo(dec.DecodeInt16())
 			part.TipOffset = dec.DecodeInt64()
+			if version >= 4 {
+				part.LastStableOffset = dec.DecodeInt64()
+				if version >= 5 {
+					part.LogStartOffset = dec.DecodeInt64()
+				}
+				// null array is sent as -1
+				if n := dec.DecodeInt32(); n > 0 {
+					part.AbortedTransactions = make([]FetchRespAbortedTransaction, n)
+					for i := range part.AbortedTransactions {
+						part.AbortedTransactions[i].ProducerID = dec.DecodeInt64()
+						part.AbortedTransactions[i].FirstOffset = dec.DecodeInt64()
+					}
+				}
+			}
+			if version >= 11 {
+				part.PreferredReadReplica = dec.DecodeInt32()
+			}
 			if dec.Err() != nil {
 				return nil, dec.Err()
 			}
@@ -684,9 +1218,25 @@ func ReadFetchResp(r io.Reader) (*FetchResp, error) {
 			if dec.Err() != nil {
 				return nil, dec.Err()
 			}
-			if part.Messages, err = readMessageSet(r, msgSetSize); err != nil {
+			if raw {
+				if msgSetSize < 0 {
+					return nil, ErrInvalidMessageSize
+				}
+				part.RawMessages = make([]byte, msgSetSize)
+				if _, err := io.ReadFull(r, part.RawMessages); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			var skipped *[]int64
+			if skipMalformed {
+				skipped = &part.MalformedOffsets
+			}
+			batches, err := readMessageBatches(r, msgSetSize, skipped)
+			if err != nil {
 				return nil, err
 			}
+			part.Messages = filterAborted(batches, part.AbortedTransactions)
 			for _, msg := range part.Messages {
 				msg.Topic = topic.Name
 				msg.Partition = part.ID
@@ -811,7 +1361,16 @@ type OffsetCommitReq struct {
 	CorrelationID int32
 	ClientID      string
 	ConsumerGroup string
-	Topics        []OffsetCommitReqTopic
+
+	// GenerationID and MemberID identify the group member committing, as
+	// assigned when joining the group. The broker rejects commits of members
+	// from an older generation with ErrIllegalGeneration. Leave MemberID
+	// empty to commit without group membership, in which case GenerationID
+	// is ignored and sent as -1.
+	GenerationID int32
+	MemberID     string
+
+	Topics []OffsetCommitReqTopic
 }
 
 type OffsetCommitReqTopic struct {
@@ -839,8 +1398,8 @@ func ReadOffsetCommitReq(r io.Reader) (*OffsetCommitReq, error) {
 	req.ClientID = dec.DecodeString()
 	req.ConsumerGroup = dec.DecodeString()
 	if apiVersion == 1 {
-		_ = dec.DecodeInt32()
-		_ = dec.DecodeString()
+		req.GenerationID = dec.DecodeInt32()
+		req.MemberID = dec.DecodeString()
 	}
 	req.Topics = make([]OffsetCommitReqTopic, dec.DecodeArrayLen())
 	for ti := range req.Topics {
@@ -874,8 +1433,12 @@ func (r *OffsetCommitReq) Bytes() ([]byte, error) {
 	enc.Encode(r.ClientID)
 
 	enc.Encode(r.ConsumerGroup)
-	enc.Encode(int32(-1)) // ConsumerGroupGenerationId
-	enc.Encode("")        // ConsumerId
+	if r.MemberID == "" {
+		enc.Encode(int32(-1)) // ConsumerGroupGenerationId
+	} else {
+		enc.Encode(r.GenerationID)
+	}
+	enc.Encode(r.MemberID)
 
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
@@ -1136,9 +1699,16 @@ type ProduceReq struct {
 	CorrelationID int32
 	ClientID      string
 	Compression   Compression // only used when sending ProduceReqs
-	RequiredAcks  int16
+	RequiredAcks  RequiredAcks
 	Timeout       time.Duration
-	Topics        []ProduceReqTopic
+
+	// Version of the request, 0 to 3 are supported. Versions lower than 3
+	// write messages in the legacy format, dropping their timestamps and
+	// headers. Version 3 writes each partition as a v2 record batch, which
+	// requires kafka 0.11 or newer.
+	Version int16
+
+	Topics []ProduceReqTopic
 }
 
 type ProduceReqTopic struct {
@@ -1157,11 +1727,16 @@ func ReadProduceReq(r io.Reader) (*ProduceReq, error) {
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
-	req.RequiredAcks = dec.DecodeInt16()
+	if req.Version >= 3 {
+		// transactional id
+		_ = dec.DecodeString()
+	}
+	req.RequiredAcks = RequiredAcks(dec.DecodeInt16())
 	req.Timeout = time.Duration(dec.DecodeInt32()) * time.Millisecond
 	req.Topics = make([]ProduceReqTopic, dec.DecodeArrayLen())
 	for ti := range req.Topics {
@@ -1192,16 +1767,23 @@ func ReadProduceReq(r io.Reader) (*ProduceReq, error) {
 }
 
 func (r *ProduceReq) Bytes() ([]byte, error) {
+	if r.Version < 0 || r.Version > 3 {
+		return nil, fmt.Errorf("unsupported produce request version: %d", r.Version)
+	}
+
 	var buf buffer
 	enc := NewEncoder(&buf)
 
 	enc.EncodeInt32(0) // placeholder
 	enc.EncodeInt16(ProduceReqKind)
-	enc.EncodeInt16(0)
+	enc.EncodeInt16(r.Version)
 	enc.EncodeInt32(r.CorrelationID)
 	enc.EncodeString(r.ClientID)
+	if r.Version >= 3 {
+		encodeNullableString(enc, "") // transactional id
+	}
 
-	enc.EncodeInt16(r.RequiredAcks)
+	enc.EncodeInt16(int16(r.RequiredAcks))
 	enc.EncodeInt32(int32(r.Timeout / time.Millisecond))
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, t := range r.Topics {
@@ -1211,7 +1793,14 @@ func (r *ProduceReq) Bytes() ([]byte, error) {
 			enc.EncodeInt32(p.ID)
 			i := len(buf)
 			enc.EncodeInt32(0) // placeholder
-			n, err := writeMessageSet(&buf, p.Messages, r.Compression)
+			var n int
+			var err error
+			if r.Version >= 3 {
+				batch := &messageBatch{producerID: -1, messages: p.Messages, relative: true}
+				n, err = writeRecordBatch(&buf, batch, r.Compression)
+			} else {
+				n, err = writeMessageSet(&buf, p.Messages, r.Compression)
+			}
 			if err != nil {
 				return nil, err
 			}
@@ -1238,7 +1827,14 @@ func (r *ProduceReq) WriteTo(w io.Writer) (int64, error) {
 
 type ProduceResp struct {
 	CorrelationID int32
-	Topics        []ProduceRespTopic
+
+	// Version of the response, must match the version of the request.
+	Version int16
+
+	Topics []ProduceRespTopic
+
+	// ThrottleTime is set with version 1 and higher.
+	ThrottleTime time.Duration
 }
 
 type ProduceRespTopic struct {
@@ -1250,6 +1846,11 @@ type ProduceRespPartition struct {
 	ID     int32
 	Err    error
 	Offset int64
+
+	// LogAppendTime is the timestamp in milliseconds assigned by the broker
+	// to the messages if the topic uses log append time, -1 otherwise. Set
+	// with version 2 and higher.
+	LogAppendTime int64
 }
 
 func (r *ProduceResp) Bytes() ([]byte, error) {
@@ -1267,8 +1868,14 @@ func (r *ProduceResp) Bytes() ([]byte, error) {
 			enc.Encode(part.ID)
 			enc.EncodeError(part.Err)
 			enc.Encode(part.Offset)
+			if r.Version >= 2 {
+				enc.Encode(part.LogAppendTime)
+			}
 		}
 	}
+	if r.Version >= 1 {
+		enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	}
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
@@ -1281,8 +1888,16 @@ func (r *ProduceResp) Bytes() ([]byte, error) {
 	return b, nil
 }
 
+// ReadProduceResp reads a version 0 produce response.
 func ReadProduceResp(r io.Reader) (*ProduceResp, error) {
-	var resp ProduceResp
+	return ReadVersionedProduceResp(r, 0)
+}
+
+// ReadVersionedProduceResp reads a produce response of given version. The
+// version is not part of the response, so it must be the one used by the
+// request.
+func ReadVersionedProduceResp(r io.Reader, version int16) (*ProduceResp, error) {
+	resp := ProduceResp{Version: version}
 	dec := NewDecoder(r)
 
 	// total message size
@@ -1298,8 +1913,14 @@ func ReadProduceResp(r io.Reader) (*ProduceResp, error) {
 			p.ID = dec.DecodeInt32()
 			p.Err = errFromNo(dec.DecodeInt16())
 			p.Offset = dec.DecodeInt64()
+			if version >= 2 {
+				p.LogAppendTime = dec.DecodeInt64()
+			}
 		}
 	}
+	if version >= 1 {
+		resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	}
 
 	if err := dec.Err(); err != nil {
 		return nil, err
@@ -1312,6 +1933,11 @@ type OffsetReq struct {
 	ClientID      string
 	ReplicaID     int32
 	Topics        []OffsetReqTopic
+
+	// Version of the request, 0 and 1 are supported. Version 1 returns the
+	// single earliest offset whose timestamp is greater or equal to TimeMs,
+	// MaxOffsets is ignored. It requires kafka 0.10.1 or newer.
+	Version int16
 }
 
 type OffsetReqTopic struct {
@@ -1331,8 +1957,9 @@ func ReadOffsetReq(r io.Reader) (*OffsetReq, error) {
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
 	req.ReplicaID = dec.DecodeInt32()
@@ -1345,7 +1972,9 @@ func ReadOffsetReq(r io.Reader) (*OffsetReq, error) {
 			var part = &topic.Partitions[pi]
 			part.ID = dec.DecodeInt32()
 			part.TimeMs = dec.DecodeInt64()
-			part.MaxOffsets = dec.DecodeInt32()
+			if req.Version == 0 {
+				part.MaxOffsets = dec.DecodeInt32()
+			}
 		}
 	}
 
@@ -1356,13 +1985,17 @@ func ReadOffsetReq(r io.Reader) (*OffsetReq, error) {
 }
 
 func (r *OffsetReq) Bytes() ([]byte, error) {
+	if r.Version < 0 || r.Version > 1 {
+		return nil, fmt.Errorf("unsupported offset request version: %d", r.Version)
+	}
+
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(int16(OffsetReqKind))
-	enc.Encode(int16(0))
+	enc.Encode(r.Version)
 	enc.Encode(r.CorrelationID)
 	enc.Encode(r.ClientID)
 
@@ -1374,7 +2007,9 @@ func (r *OffsetReq) Bytes() ([]byte, error) {
 		for _, part := range topic.Partitions {
 			enc.Encode(part.ID)
 			enc.Encode(part.TimeMs)
-			enc.Encode(part.MaxOffsets)
+			if r.Version == 0 {
+				enc.Encode(part.MaxOffsets)
+			}
 		}
 	}
 
@@ -1401,6 +2036,9 @@ func (r *OffsetReq) WriteTo(w io.Writer) (int64, error) {
 type OffsetResp struct {
 	CorrelationID int32
 	Topics        []OffsetRespTopic
+
+	// Version of the response, must be the same as the request version.
+	Version int16
 }
 
 type OffsetRespTopic struct {
@@ -1411,11 +2049,23 @@ type OffsetRespTopic struct {
 type OffsetRespPartition struct {
 	ID      int32
 	Err     error
-	Offsets []int64
+	Offsets []int64 // version 1 responses carry a single offset
+
+	// Timestamp of the message at the returned offset, or -1 if there is no
+	// such message. Only set in version 1 responses.
+	Timestamp int64
 }
 
+// ReadOffsetResp reads a version 0 offset response.
 func ReadOffsetResp(r io.Reader) (*OffsetResp, error) {
-	var resp OffsetResp
+	return ReadVersionedOffsetResp(r, 0)
+}
+
+// ReadVersionedOffsetResp reads an offset response of given version. The
+// version is not part of the response, so it must be the one used by the
+// request.
+func ReadVersionedOffsetResp(r io.Reader, version int16) (*OffsetResp, error) {
+	resp := OffsetResp{Version: version}
 	dec := NewDecoder(r)
 
 	// total message size
@@ -1430,6 +2080,11 @@ func ReadOffsetResp(r io.Reader) (*OffsetResp, error) {
 			var p = &t.Partitions[pi]
 			p.ID = dec.DecodeInt32()
 			p.Err = errFromNo(dec.DecodeInt16())
+			if version >= 1 {
+				p.Timestamp = dec.DecodeInt64()
+				p.Offsets = []int64{dec.DecodeInt64()}
+				continue
+			}
 			p.Offsets = make([]int64, dec.DecodeArrayLen())
 			for oi := range p.Offsets {
 				p.Offsets[oi] = dec.DecodeInt64()
@@ -1457,6 +2112,15 @@ func (r *OffsetResp) Bytes() ([]byte, error) {
 		for _, part := range topic.Partitions {
 			enc.Encode(part.ID)
 			enc.EncodeError(part.Err)
+			if r.Version >= 1 {
+				offset := int64(-1)
+				if len(part.Offsets) > 0 {
+					offset = part.Offsets[0]
+				}
+				enc.Encode(part.Timestamp)
+				enc.Encode(offset)
+				continue
+			}
 			enc.EncodeArrayLen(len(part.Offsets))
 			for _, off := range part.Offsets {
 				enc.Encode(off)
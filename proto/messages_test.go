@@ -2,6 +2,9 @@ package proto
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"reflect"
 	"runtime"
@@ -31,6 +34,8 @@ var _ TestRequest = &GroupCoordinatorReq{}
 var _ TestRequest = &OffsetReq{}
 var _ TestRequest = &OffsetCommitReq{}
 var _ TestRequest = &OffsetFetchReq{}
+var _ TestRequest = &DescribeConfigsReq{}
+var _ TestRequest = &AlterConfigsReq{}
 
 func testRequestSerialization(c *C, r TestRequest) {
 	var buf bytes.Buffer
@@ -132,6 +137,63 @@ func (s *MessagesSuite) TestMetadataResponse(c *C) {
 	}
 }
 
+func (s *MessagesSuite) TestMetadataVersions(c *C) {
+	req := &MetadataReq{
+		CorrelationID: 123,
+		ClientID:      "testcli",
+		Topics:        nil,
+		Version:       2,
+	}
+	testRequestSerialization(c, req)
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	// null topics array requests all topics
+	c.Assert(b[len(b)-4:], DeepEquals, []byte{0xff, 0xff, 0xff, 0xff})
+	r, err := ReadMetadataReq(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(r, DeepEquals, req)
+
+	resp := &MetadataResp{
+		CorrelationID: 123,
+		Version:       2,
+		Brokers: []MetadataRespBroker{
+			{NodeID: 1, Host: "172.17.42.1", Port: 9092, Rack: "rack-a"},
+			{NodeID: 2, Host: "172.17.42.2", Port: 9092},
+		},
+		ClusterID:    "my-cluster",
+		ControllerID: 2,
+		Topics: []MetadataRespTopic{
+			{
+				Name:       "__consumer_offsets",
+				IsInternal: true,
+				Partitions: []MetadataRespPartition{
+					{ID: 0, Leader: 1, Replicas: []int32{1, 2}, Isrs: []int32{1}},
+				},
+			},
+		},
+	}
+	for _, version := range []int16{0, 1, 2} {
+		resp.Version = version
+		b, err := resp.Bytes()
+		c.Assert(err, IsNil)
+		got, err := ReadVersionedMetadataResp(bytes.NewBuffer(b), version)
+		c.Assert(err, IsNil)
+
+		expected := *resp
+		expected.Brokers = append([]MetadataRespBroker(nil), resp.Brokers...)
+		expected.Topics = append([]MetadataRespTopic(nil), resp.Topics...)
+		if version < 2 {
+			expected.ClusterID = ""
+		}
+		if version < 1 {
+			expected.ControllerID = 0
+			expected.Brokers[0].Rack = ""
+			expected.Topics[0].IsInternal = false
+		}
+		c.Assert(got, DeepEquals, &expected)
+	}
+}
+
 func getGoMinorVersion() string {
 	min := strings.Split(runtime.Version(), ".")[1]
 	return strings.Split(min, "beta")[0]
@@ -271,6 +333,75 @@ func (s *MessagesSuite) TestProduceResponse(c *C) {
 	}
 }
 
+func (s *MessagesSuite) TestProduceRecordBatch(c *C) {
+	base := time.Unix(1500000000, 0)
+	for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionSnappy} {
+		messages := []*Message{
+			{Key: []byte("1"), Value: []byte("a"), Timestamp: base.Add(time.Hour)},
+			{Key: []byte("2"), Value: []byte("b"), Timestamp: base},
+			{Key: []byte("3"), Value: []byte("c")},
+			{Key: []byte("4"), Value: []byte("d"), Timestamp: base.Add(1500 * time.Millisecond),
+				Headers: []Header{{Key: "h", Value: []byte("v")}}},
+		}
+		req := &ProduceReq{
+			CorrelationID: 241,
+			ClientID:      "test",
+			Compression:   compression,
+			RequiredAcks:  RequiredAcksAll,
+			Timeout:       time.Second,
+			Version:       3,
+			Topics: []ProduceReqTopic{
+				{
+					Name:       "foo",
+					Partitions: []ProduceReqPartition{{ID: 1, Messages: messages}},
+				},
+			},
+		}
+		testRequestSerialization(c, req)
+
+		b, err := req.Bytes()
+		c.Assert(err, IsNil)
+		decoded, err := ReadProduceReq(bytes.NewReader(b))
+		c.Assert(err, IsNil)
+		c.Assert(decoded.Version, Equals, int16(3))
+		c.Assert(decoded.Topics[0].Partitions[0].ID, Equals, int32(1))
+		decMessages := decoded.Topics[0].Partitions[0].Messages
+		c.Assert(decMessages, HasLen, len(messages))
+		for i, m := range decMessages {
+			c.Assert(m.Offset, Equals, int64(i))
+			c.Assert(m.Key, DeepEquals, messages[i].Key)
+			c.Assert(m.Value, DeepEquals, messages[i].Value)
+			c.Assert(m.Headers, DeepEquals, messages[i].Headers)
+			c.Assert(m.Timestamp.Equal(messages[i].Timestamp), Equals, true,
+				Commentf("compression %d, message %d: %s", compression, i, m.Timestamp))
+		}
+	}
+
+	_, err := (&ProduceReq{Version: 4}).Bytes()
+	c.Assert(err, NotNil)
+}
+
+func (s *MessagesSuite) TestProduceResponseVersions(c *C) {
+	resp := &ProduceResp{
+		CorrelationID: 241,
+		Version:       2,
+		Topics: []ProduceRespTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceRespPartition{
+					{ID: 1, Offset: 12, LogAppendTime: 1500000000000},
+				},
+			},
+		},
+		ThrottleTime: 5 * time.Millisecond,
+	}
+	b, err := resp.Bytes()
+	c.Assert(err, IsNil)
+	decoded, err := ReadVersionedProduceResp(bytes.NewReader(b), 2)
+	c.Assert(err, IsNil)
+	c.Assert(decoded, DeepEquals, resp)
+}
+
 func (s *MessagesSuite) TestFetchRequest(c *C) {
 	req := &FetchReq{
 		CorrelationID: 241,
@@ -402,6 +533,469 @@ func (s *MessagesSuite) TestFetchResponse(c *C) {
 	}
 }
 
+func (s *MessagesSuite) TestFetchRequestIsolationLevel(c *C) {
+	req := &FetchReq{
+		CorrelationID:  241,
+		ClientID:       "test",
+		MaxWaitTime:    time.Second * 2,
+		MinBytes:       12454,
+		Version:        4,
+		MaxBytes:       1000000,
+		IsolationLevel: IsolationLevelReadCommitted,
+		Topics: []FetchReqTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchReqPartition{
+					{ID: 421, FetchOffset: 529, MaxBytes: 4921},
+				},
+			},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, err := req.Bytes()
+	if err != nil {
+		c.Fatalf("cannot serialize request: %s", err)
+	}
+
+	r, err := ReadFetchReq(bytes.NewBuffer(b))
+	if err != nil {
+		c.Fatalf("cannot read request: %s", err)
+	}
+	if !reflect.DeepEqual(r, req) {
+		c.Fatalf("malformed request: %#v", r)
+	}
+
+	req.Version = 12
+	if _, err := req.Bytes(); err == nil {
+		c.Fatal("expected error for unsupported version")
+	}
+}
+
+func (s *MessagesSuite) TestFetchResponseAbortedTransaction(c *C) {
+	msg := func(offset int64, value string) *Message {
+		return &Message{Offset: offset, Value: []byte(value)}
+	}
+	// abort control record: version 0, type abort
+	marker := &Message{Offset: 3, Key: []byte{0, 0, 0, 0}, Value: []byte{0, 0, 0, 0, 0, 0}}
+	batches := []*messageBatch{
+		{producerID: 7, transactional: true, messages: []*Message{msg(0, "aborted-1"), msg(1, "aborted-2")}},
+		{producerID: -1, messages: []*Message{msg(2, "plain")}},
+		{producerID: 7, transactional: true, control: true, messages: []*Message{marker}},
+		{producerID: 8, transactional: true, messages: []*Message{msg(4, "committed")}},
+		{producerID: 7, transactional: true, messages: []*Message{msg(5, "next-txn")}},
+	}
+
+	build := func(aborted []FetchRespAbortedTransaction) []byte {
+		var buf buffer
+		enc := NewEncoder(&buf)
+		enc.Encode(int32(0)) // placeholder
+		enc.Encode(int32(241))
+		enc.Encode(int32(0)) // throttle time
+		enc.EncodeArrayLen(1)
+		enc.Encode("foo")
+		enc.EncodeArrayLen(1)
+		enc.Encode(int32(0))
+		enc.EncodeError(nil)
+		enc.Encode(int64(6))
+		enc.Encode(int64(6))
+		enc.EncodeArrayLen(len(aborted))
+		for _, txn := range aborted {
+			enc.Encode(txn.ProducerID)
+			enc.Encode(txn.FirstOffset)
+		}
+		i := len(buf)
+		enc.Encode(int32(0)) // placeholder
+		for _, batch := range batches {
+			if _, err := writeRecordBatch(&buf, batch, CompressionNone); err != nil {
+				c.Fatalf("cannot write record batch: %s", err)
+			}
+		}
+		c.Assert(enc.Err(), IsNil)
+		binary.BigEndian.PutUint32(buf[i:i+4], uint32(len(buf)-i-4))
+		binary.BigEndian.PutUint32(buf[:4], uint32(len(buf)-4))
+		return buf
+	}
+
+	values := func(resp *FetchResp) []string {
+		var vals []string
+		for _, m := range resp.Topics[0].Partitions[0].Messages {
+			vals = append(vals, string(m.Value))
+		}
+		return vals
+	}
+
+	// read_committed, broker reports transaction of producer 7 as aborted
+	aborted := []FetchRespAbortedTransaction{{ProducerID: 7, FirstOffset: 0}}
+	resp, err := ReadVersionedFetchResp(bytes.NewReader(build(aborted)), 4)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].LastStableOffset, Equals, int64(6))
+	c.Assert(resp.Topics[0].Partitions[0].AbortedTransactions, DeepEquals, aborted)
+	c.Assert(values(resp), DeepEquals, []string{"plain", "committed", "next-txn"})
+	for _, m := range resp.Topics[0].Partitions[0].Messages {
+		c.Assert(m.Topic, Equals, "foo")
+		c.Assert(m.TipOffset, Equals, int64(6))
+	}
+
+	// without aborted transactions only control records are skipped
+	resp, err = ReadVersionedFetchResp(bytes.NewReader(build(nil)), 4)
+	c.Assert(err, IsNil)
+	c.Assert(values(resp), DeepEquals,
+		[]string{"aborted-1", "aborted-2", "plain", "committed", "next-txn"})
+}
+
+func (s *MessagesSuite) TestFetchVersion11(c *C) {
+	req := &FetchReq{
+		CorrelationID:  241,
+		ClientID:       "test",
+		MaxWaitTime:    time.Second,
+		MinBytes:       1,
+		Version:        11,
+		MaxBytes:       1000000,
+		IsolationLevel: IsolationLevelReadCommitted,
+		RackID:         "rack-1",
+		Topics: []FetchReqTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchReqPartition{
+					{ID: 421, FetchOffset: 529, MaxBytes: 4921},
+				},
+			},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	r, err := ReadFetchReq(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(r, DeepEquals, req)
+
+	resp := &FetchResp{
+		CorrelationID: 241,
+		Version:       11,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{
+						ID:                   421,
+						TipOffset:            600,
+						LastStableOffset:     600,
+						LogStartOffset:       12,
+						PreferredReadReplica: 3,
+						Messages: []*Message{
+							{Offset: 529, Value: []byte("first")},
+						},
+					},
+				},
+			},
+		},
+	}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	got, err := ReadVersionedFetchResp(bytes.NewReader(b), 11)
+	c.Assert(err, IsNil)
+	c.Assert(got.Err, IsNil)
+	part := got.Topics[0].Partitions[0]
+	c.Assert(part.ID, Equals, int32(421))
+	c.Assert(part.TipOffset, Equals, int64(600))
+	c.Assert(part.LogStartOffset, Equals, int64(12))
+	c.Assert(part.PreferredReadReplica, Equals, int32(3))
+	c.Assert(part.Messages, HasLen, 1)
+	c.Assert(string(part.Messages[0].Value), Equals, "first")
+	c.Assert(part.Messages[0].Offset, Equals, int64(529))
+}
+
+func (s *MessagesSuite) TestFetchResponseRaw(c *C) {
+	for _, version := range []int16{0, 11} {
+		resp := &FetchResp{
+			CorrelationID: 241,
+			Version:       version,
+			Topics: []FetchRespTopic{
+				{
+					Name: "foo",
+					Partitions: []FetchRespPartition{
+						{
+							ID:        1,
+							TipOffset: 600,
+							Messages: []*Message{
+								{Offset: 529, Value: []byte("first")},
+								{Offset: 530, Value: []byte("second")},
+							},
+						},
+					},
+				},
+			},
+		}
+		b, err := resp.Bytes()
+		c.Assert(err, IsNil)
+		got, err := ReadFetchRespRaw(bytes.NewReader(b), version)
+		c.Assert(err, IsNil)
+		part := got.Topics[0].Partitions[0]
+		c.Assert(part.ID, Equals, int32(1))
+		c.Assert(part.TipOffset, Equals, int64(600))
+		c.Assert(part.Messages, HasLen, 0)
+
+		entries := RawEntries(part.RawMessages)
+		c.Assert(len(entries) > 0, Equals, true)
+		c.Assert(entries[len(entries)-1].LastOffset, Equals, int64(530))
+		var joined []byte
+		for _, e := range entries {
+			joined = append(joined, e.Data...)
+		}
+		c.Assert(joined, DeepEquals, part.RawMessages)
+
+		// entries cut by the fetch size are dropped
+		truncated := RawEntries(part.RawMessages[:len(part.RawMessages)-1])
+		c.Assert(truncated, HasLen, len(entries)-1)
+	}
+
+	_, err := ReadFetchRespRaw(bytes.NewReader([]byte{0, 0, 0, 1}), 0)
+	c.Assert(err, NotNil)
+}
+
+func (s *MessagesSuite) TestHeaders(c *C) {
+	carrier := map[string][]byte{
+		"traceparent": []byte("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"),
+		"tracestate":  []byte("congo=t61rcWkgMzE"),
+		"empty":       nil,
+	}
+	msg := &Message{
+		Value:   []byte("value"),
+		Headers: []Header{{Key: "other", Value: []byte("kept")}, {Key: "tracestate", Value: []byte("old")}},
+	}
+	InjectHeaders(carrier, msg)
+	c.Assert(msg.Headers, DeepEquals, []Header{
+		{Key: "other", Value: []byte("kept")},
+		{Key: "empty"},
+		{Key: "traceparent", Value: carrier["traceparent"]},
+		{Key: "tracestate", Value: carrier["tracestate"]},
+	})
+
+	// headers survive a round trip through a record batch
+	resp := &FetchResp{
+		CorrelationID: 241,
+		Version:       4,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{ID: 0, TipOffset: 1, Messages: []*Message{msg}},
+				},
+			},
+		},
+	}
+	b, err := resp.Bytes()
+	c.Assert(err, IsNil)
+	got, err := ReadVersionedFetchResp(bytes.NewReader(b), 4)
+	c.Assert(err, IsNil)
+	fetched := got.Topics[0].Partitions[0].Messages[0]
+	c.Assert(fetched.Headers, DeepEquals, msg.Headers)
+
+	extracted := ExtractHeaders(fetched)
+	delete(extracted, "other")
+	c.Assert(extracted, DeepEquals, carrier)
+}
+
+func (s *MessagesSuite) TestOffsetVersions(c *C) {
+	req := &OffsetReq{
+		Version:       1,
+		CorrelationID: 241,
+		ClientID:      "test",
+		ReplicaID:     -1,
+		Topics: []OffsetReqTopic{
+			{
+				Name:       "foo",
+				Partitions: []OffsetReqPartition{{ID: 2, TimeMs: 1500000000000}},
+			},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	decReq, err := ReadOffsetReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(decReq, DeepEquals, req)
+
+	_, err = (&OffsetReq{Version: 2}).Bytes()
+	c.Assert(err, NotNil)
+
+	resp := &OffsetResp{
+		Version:       1,
+		CorrelationID: 241,
+		Topics: []OffsetRespTopic{
+			{
+				Name: "foo",
+				Partitions: []OffsetRespPartition{
+					{ID: 2, Offsets: []int64{123}, Timestamp: 1500000000042},
+				},
+			},
+		},
+	}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	decResp, err := ReadVersionedOffsetResp(bytes.NewReader(b), 1)
+	c.Assert(err, IsNil)
+	c.Assert(decResp, DeepEquals, resp)
+}
+
+func (s *MessagesSuite) TestOffsetCommitGeneration(c *C) {
+	req := &OffsetCommitReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		ConsumerGroup: "group",
+		GenerationID:  7,
+		MemberID:      "test-member",
+		Topics: []OffsetCommitReqTopic{
+			{Name: "foo", Partitions: []OffsetCommitReqPartition{{ID: 2, Offset: 42}}},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	decReq, err := ReadOffsetCommitReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(decReq.GenerationID, Equals, int32(7))
+	c.Assert(decReq.MemberID, Equals, "test-member")
+	c.Assert(decReq.Topics[0].Partitions[0].Offset, Equals, int64(42))
+
+	// generation is only sent together with a member
+	req.MemberID = ""
+	b, err = req.Bytes()
+	c.Assert(err, IsNil)
+	decReq, err = ReadOffsetCommitReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(decReq.GenerationID, Equals, int32(-1))
+	c.Assert(decReq.MemberID, Equals, "")
+}
+
+func (s *MessagesSuite) TestRecordBatchTimestamps(c *C) {
+	base := time.Unix(1500000000, 0)
+	batch := &messageBatch{
+		producerID: -1,
+		messages: []*Message{
+			{Offset: 5, Value: []byte("a"), Timestamp: base.Add(20 * time.Millisecond)},
+			{Offset: 6, Value: []byte("b"), Timestamp: base},
+			{Offset: 7, Value: []byte("c"), Timestamp: base.Add(time.Second)},
+		},
+	}
+	var buf buffer
+	_, err := writeRecordBatch(&buf, batch, CompressionNone)
+	c.Assert(err, IsNil)
+	// skip base offset and batch length
+	decoded, err := readRecordBatch(5, buf[12:])
+	c.Assert(err, IsNil)
+	c.Assert(len(decoded.messages), Equals, 3)
+	for i, m := range decoded.messages {
+		c.Assert(m.Timestamp.Equal(batch.messages[i].Timestamp), Equals, true)
+	}
+
+	// broker assigned timestamp overrides record timestamps
+	buf[8+4+4+1+4+1] |= batchLogAppendTime
+	decoded, err = readRecordBatch(5, buf[12:])
+	c.Assert(err, IsNil)
+	for _, m := range decoded.messages {
+		c.Assert(m.Timestamp.Equal(base.Add(time.Second)), Equals, true)
+	}
+
+	// batches without timestamps decode to zero time
+	for _, m := range batch.messages {
+		m.Timestamp = time.Time{}
+	}
+	buf = buf[:0]
+	_, err = writeRecordBatch(&buf, batch, CompressionNone)
+	c.Assert(err, IsNil)
+	decoded, err = readRecordBatch(5, buf[12:])
+	c.Assert(err, IsNil)
+	for _, m := range decoded.messages {
+		c.Assert(m.Timestamp.IsZero(), Equals, true)
+	}
+}
+
+func (s *MessagesSuite) TestRecordBatchInvalidCount(c *C) {
+	batch := &messageBatch{
+		producerID: -1,
+		messages:   []*Message{{Offset: 5, Value: []byte("a")}},
+	}
+	var buf buffer
+	_, err := writeRecordBatch(&buf, batch, CompressionNone)
+	c.Assert(err, IsNil)
+	// skip base offset and batch length
+	raw := []byte(buf[12:])
+	countOff := recordBatchHeaderSize - 4
+
+	for _, count := range []int32{-1, 1 << 30, int32(len(raw) - recordBatchHeaderSize + 1)} {
+		binary.BigEndian.PutUint32(raw[countOff:], uint32(count))
+		_, err = readRecordBatch(5, raw)
+		c.Assert(err, Equals, ErrInvalidRecordBatch, Commentf("count %d", count))
+	}
+}
+
+func (s *MessagesSuite) TestConfigsRequests(c *C) {
+	describeReq := &DescribeConfigsReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		Resources: []DescribeConfigsReqResource{
+			{Type: ConfigResourceTopic, Name: "foo", ConfigNames: []string{"retention.ms"}},
+			{Type: ConfigResourceBroker, Name: "1"},
+		},
+	}
+	testRequestSerialization(c, describeReq)
+	b, err := describeReq.Bytes()
+	c.Assert(err, IsNil)
+	decDescribeReq, err := ReadDescribeConfigsReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(decDescribeReq, DeepEquals, describeReq)
+
+	describeResp := &DescribeConfigsResp{
+		CorrelationID: 241,
+		Resources: []DescribeConfigsRespResource{
+			{
+				Type:          ConfigResourceTopic,
+				Name:          "foo",
+				ConfigEntries: []ConfigEntry{{Name: "retention.ms", Value: "1000", Sensitive: true}},
+			},
+			{Err: ErrInvalidConfig, ErrMessage: "bad", Type: ConfigResourceBroker, Name: "1", ConfigEntries: []ConfigEntry{}},
+		},
+	}
+	b, err = describeResp.Bytes()
+	c.Assert(err, IsNil)
+	decDescribeResp, err := ReadDescribeConfigsResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(decDescribeResp, DeepEquals, describeResp)
+
+	alterReq := &AlterConfigsReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		Resources: []AlterConfigsReqResource{
+			{
+				Type:          ConfigResourceTopic,
+				Name:          "foo",
+				ConfigEntries: []AlterConfigsReqEntry{{Name: "retention.ms", Value: "1000"}},
+			},
+		},
+		ValidateOnly: true,
+	}
+	testRequestSerialization(c, alterReq)
+	b, err = alterReq.Bytes()
+	c.Assert(err, IsNil)
+	decAlterReq, err := ReadAlterConfigsReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(decAlterReq, DeepEquals, alterReq)
+
+	alterResp := &AlterConfigsResp{
+		CorrelationID: 241,
+		ThrottleTime:  5,
+		Resources: []AlterConfigsRespResource{
+			{Err: ErrInvalidConfig, ErrMessage: "bad", Type: ConfigResourceTopic, Name: "foo"},
+		},
+	}
+	b, err = alterResp.Bytes()
+	c.Assert(err, IsNil)
+	decAlterResp, err := ReadAlterConfigsResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(decAlterResp, DeepEquals, alterResp)
+}
+
 func (s *MessagesSuite) TestSerializeEmptyMessageSet(c *C) {
 	var buf bytes.Buffer
 	messages := []*Message{}
@@ -443,6 +1037,194 @@ func (s *MessagesSuite) TestReadIncompleteMessage(c *C) {
 	}
 }
 
+func (s *MessagesSuite) TestReadRespLimit(c *C) {
+	// size prefix of a 100MB response followed by the correlation ID
+	prefix := []byte{0x06, 0x40, 0x00, 0x00, 0x0, 0x0, 0x0, 0x1}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, _, err := ReadRespLimit(bytes.NewReader(prefix), 1024*1024)
+	runtime.ReadMemStats(&after)
+	c.Assert(err, Equals, ErrInvalidResponseSize)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1024*1024 {
+		c.Fatalf("allocated %d bytes for rejected response", alloc)
+	}
+
+	// limit does not matter when the response fits
+	b, err := (&OffsetResp{CorrelationID: 1}).Bytes()
+	c.Assert(err, IsNil)
+	correlationID, resp, err := ReadRespLimit(bytes.NewReader(b), int32(len(b)-4))
+	c.Assert(err, IsNil)
+	c.Assert(correlationID, Equals, int32(1))
+	c.Assert(resp, DeepEquals, b)
+	_, _, err = ReadRespLimit(bytes.NewReader(b), int32(len(b)-5))
+	c.Assert(err, Equals, ErrInvalidResponseSize)
+
+	// without a limit, the default one applies
+	_, _, err = ReadRespLimit(bytes.NewReader([]byte{0x7f, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x1}), 0)
+	c.Assert(err, Equals, ErrInvalidResponseSize)
+}
+
+func (s *MessagesSuite) TestCompressedFetchResponse(c *C) {
+	messages := make([]*Message, 50)
+	for i := range messages {
+		messages[i] = &Message{
+			Offset: int64(10 + i),
+			Key:    []byte(fmt.Sprintf("key-%d", i)),
+			Value:  bytes.Repeat([]byte{byte(i)}, 100+i),
+		}
+	}
+
+	for _, version := range []int16{0, 4} {
+		for _, compression := range []Compression{CompressionGzip, CompressionSnappy} {
+			resp := &FetchResp{
+				CorrelationID: 1,
+				Version:       version,
+				Compression:   compression,
+				Topics: []FetchRespTopic{
+					{
+						Name: "foo",
+						Partitions: []FetchRespPartition{
+							{ID: 0, TipOffset: 60, Messages: messages},
+						},
+					},
+				},
+			}
+			raw, err := resp.Bytes()
+			c.Assert(err, IsNil)
+
+			// decode more than once, so that pooled buffers are reused
+			for i := 0; i < 3; i++ {
+				got, err := ReadVersionedFetchResp(bytes.NewReader(raw), version)
+				c.Assert(err, IsNil)
+				msgs := got.Topics[0].Partitions[0].Messages
+				c.Assert(msgs, HasLen, len(messages))
+				for j, m := range msgs {
+					c.Assert(m.Offset, Equals, messages[j].Offset)
+					c.Assert(m.Key, DeepEquals, messages[j].Key)
+					c.Assert(m.Value, DeepEquals, messages[j].Value)
+				}
+			}
+		}
+	}
+}
+
+// legacyMessageV1 encodes a single message of format v1 with given offset,
+// attributes and value.
+func legacyMessageV1(offset int64, attributes int8, value []byte) []byte {
+	var body bytes.Buffer
+	enc := NewEncoder(&body)
+	enc.EncodeInt8(messageMagicV1)
+	enc.EncodeInt8(attributes)
+	enc.EncodeInt64(1500000000000)
+	enc.EncodeBytes(nil)
+	enc.EncodeBytes(value)
+
+	var buf bytes.Buffer
+	enc = NewEncoder(&buf)
+	enc.EncodeInt64(offset)
+	enc.EncodeInt32(int32(4 + body.Len()))
+	enc.EncodeUint32(crc32.ChecksumIEEE(body.Bytes()))
+	_, _ = buf.Write(body.Bytes())
+	return buf.Bytes()
+}
+
+func (s *MessagesSuite) TestReadNestedCompressedMessages(c *C) {
+	compressed := func(compression Compression, offset int64, set ...[]byte) []byte {
+		val, err := compress(compression, bytes.Join(set, nil))
+		c.Assert(err, IsNil)
+		return legacyMessageV1(offset, int8(compression), val)
+	}
+
+	// inner offsets are relative, the wrapper holds the offset of the last
+	inner := compressed(CompressionGzip, 2,
+		legacyMessageV1(0, 0, []byte("b")),
+		legacyMessageV1(1, 0, []byte("c")),
+	)
+	set := bytes.Join([][]byte{
+		legacyMessageV1(9, 0, []byte("first")),
+		compressed(CompressionSnappy, 13,
+			legacyMessageV1(0, 0, []byte("a")),
+			inner,
+			legacyMessageV1(3, 0, []byte("d")),
+		),
+	}, nil)
+
+	msgs, err := readMessageSet(bytes.NewReader(set), int32(len(set)))
+	c.Assert(err, IsNil)
+	var got []string
+	for _, m := range msgs {
+		got = append(got, fmt.Sprintf("%d:%s", m.Offset, m.Value))
+	}
+	c.Assert(got, DeepEquals, []string{"9:first", "10:a", "11:b", "12:c", "13:d"})
+
+	// the crc of decompressed messages is checked
+	corrupted := legacyMessageV1(1, 0, []byte("c"))
+	corrupted[len(corrupted)-1] ^= 0xff
+	set = bytes.Join([][]byte{
+		legacyMessageV1(9, 0, []byte("first")),
+		compressed(CompressionGzip, 11,
+			legacyMessageV1(0, 0, []byte("b")),
+			corrupted,
+		),
+	}, nil)
+	_, err = readMessageSet(bytes.NewReader(set), int32(len(set)))
+	c.Assert(err, ErrorMatches, "invalid crc of compressed message at offset 1")
+
+	var skipped []int64
+	msgs, err = readMessageSetSkip(bytes.NewReader(set), int32(len(set)), &skipped)
+	c.Assert(err, IsNil)
+	c.Assert(msgs, HasLen, 2)
+	c.Assert(msgs[1].Offset, Equals, int64(10))
+	c.Assert(skipped, DeepEquals, []int64{11})
+
+	// nesting is limited
+	set = legacyMessageV1(0, 0, []byte("x"))
+	for i := 0; i <= maxCompressionDepth; i++ {
+		set = compressed(CompressionGzip, 0, set)
+	}
+	_, err = readMessageSet(bytes.NewReader(set), int32(len(set)))
+	c.Assert(err, ErrorMatches, "compressed messages nested more than .*")
+}
+
+func (s *MessagesSuite) TestDecompressReusesBuffers(c *C) {
+	decoded := bytes.Repeat([]byte("lorem ipsum dolor sit amet "), 10000)
+	for _, compression := range []Compression{CompressionGzip, CompressionSnappy} {
+		val, err := compress(compression, decoded)
+		c.Assert(err, IsNil)
+
+		const runs = 50
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		for i := 0; i < runs; i++ {
+			b, err := decompress(compression, val)
+			c.Assert(err, IsNil)
+			c.Assert(len(b), Equals, len(decoded))
+			putBuffer(b)
+		}
+		runtime.ReadMemStats(&after)
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > uint64(runs*len(decoded)/4) {
+			c.Fatalf("compression %d: allocated %d bytes for %d runs", compression, alloc, runs)
+		}
+	}
+}
+
+func (s *MessagesSuite) TestBufferPool(c *C) {
+	for _, size := range []int{0, 1, 1024, 1025, 5000, 1 << 20} {
+		b := getBuffer(size)
+		c.Assert(b, HasLen, 0)
+		if cap(b) < size {
+			c.Fatalf("buffer of %d bytes has capacity %d", size, cap(b))
+		}
+		putBuffer(b)
+	}
+
+	// buffers too big for the pool are allocated to size
+	b := getBuffer(1<<maxPooledBufferBits + 1)
+	c.Assert(cap(b), Equals, 1<<maxPooledBufferBits+1)
+	putBuffer(b)
+}
+
 func BenchmarkProduceRequestMarshal(b *testing.B) {
 	messages := make([]*Message, 100)
 	for i := range messages {
@@ -579,5 +1361,52 @@ func BenchmarkFetchResponseUnmarshal(b *testing.B) {
 	}
 }
 
+func BenchmarkFetchResponseUnmarshalGzip(b *testing.B) {
+	benchmarkCompressedFetchResponseUnmarshal(b, CompressionGzip, 0)
+}
+
+func BenchmarkFetchResponseUnmarshalSnappy(b *testing.B) {
+	benchmarkCompressedFetchResponseUnmarshal(b, CompressionSnappy, 0)
+}
+
+func BenchmarkFetchResponseUnmarshalRecordBatchGzip(b *testing.B) {
+	benchmarkCompressedFetchResponseUnmarshal(b, CompressionGzip, 4)
+}
+
+func benchmarkCompressedFetchResponseUnmarshal(b *testing.B, compression Compression, version int16) {
+	messages := make([]*Message, 500)
+	for i := range messages {
+		messages[i] = &Message{
+			Offset: int64(i),
+			Value:  []byte(`Lorem ipsum dolor sit amet, consectetur adipiscing elit. Donec a diam lectus. Sed sit amet ipsum mauris. Maecenas congue ligula ac quam viverra nec consectetur ante hendrerit. Donec et mollis dolor. Praesent et diam eget libero egestas mattis sit amet vitae augue. Nam tincidunt congue enim, ut porta lorem lacinia consectetur.`),
+		}
+	}
+	resp := &FetchResp{
+		CorrelationID: 241,
+		Version:       version,
+		Compression:   compression,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{ID: 0, TipOffset: 500, Messages: messages},
+				},
+			},
+		},
+	}
+	raw, err := resp.Bytes()
+	if err != nil {
+		b.Fatalf("cannot serialize response: %s", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := ReadVersionedFetchResp(bytes.NewReader(raw), version); err != nil {
+			b.Fatalf("could not deserialize messages: %s", err)
+		}
+	}
+}
+
 // vim has problem with coloring byte arrays in this file
 // vim: set syntax=off:
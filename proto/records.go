@@ -0,0 +1,439 @@
+package proto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+/*
+
+Record batches (message format v2) as described in
+https://kafka.apache.org/documentation/#recordbatch
+
+Brokers return stored batches as is to fetch requests of version 4 and up,
+so we have to understand them to support transactional reads.
+
+*/
+
+const (
+	// Magic byte values of the message formats we can read.
+	messageMagicV0 = 0
+	messageMagicV1 = 1
+	messageMagicV2 = 2
+
+	// Legacy message attribute bit telling the timestamp was set by the
+	// broker.
+	messageLogAppendTime = 0x08
+
+	// Record batch attribute bits.
+	batchCompressionMask = 0x07
+	batchLogAppendTime   = 0x08
+	batchTransactional   = 0x10
+	batchControl         = 0x20
+
+	// Control record types, stored in the control record key.
+	controlTypeAbort  = 0
+	controlTypeCommit = 1
+
+	// Size of the record batch header following the batch length field:
+	// partition leader epoch, magic, crc, attributes, last offset delta,
+	// first timestamp, max timestamp, producer id, producer epoch, base
+	// sequence and record count.
+	recordBatchHeaderSize = 4 + 1 + 4 + 2 + 4 + 8 + 8 + 8 + 2 + 4 + 4
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrInvalidRecordBatch is returned when a record batch cannot be decoded.
+var ErrInvalidRecordBatch = errors.New("invalid record batch")
+
+// messageBatch is a group of messages read from a message set together with
+// the transactional state of the record batch they came from. Messages in the
+// legacy formats (v0 and v1) are never transactional.
+type messageBatch struct {
+	producerID    int64
+	transactional bool
+	control       bool
+	abort         bool // set for control batches carrying an abort marker
+	legacy        bool // set for messages in message format v0 or v1
+	messages      []*Message
+
+	// relative makes writeRecordBatch number the messages from zero instead
+	// of using their offsets, as required for produce requests.
+	relative bool
+}
+
+// decompress returns the uncompressed content of a compressed message value
+// or record batch. The result is taken from the buffer pool and should be
+// released with putBuffer once the messages are decoded from it.
+func decompress(compression Compression, val []byte) ([]byte, error) {
+	switch compression {
+	case CompressionGzip:
+		// gzip trailer holds the uncompressed size modulo 2^32, which is
+		// only used as a hint for the buffer size
+		hint := len(val) * 4
+		if len(val) >= 4 {
+			if size := int(binary.LittleEndian.Uint32(val[len(val)-4:])); size <= int(defaultMaxResponseSize) {
+				hint = size + bytes.MinRead
+			}
+		}
+		decoded, err := gunzip(val, hint)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding gzip message: %s", err)
+		}
+		return decoded, nil
+	case CompressionSnappy:
+		decoded, err := snappyDecode(val)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding snappy message: %s", err)
+		}
+		return decoded, nil
+	default:
+		return nil, fmt.Errorf("cannot handle compression method: %d", compression)
+	}
+}
+
+// compress returns val compressed with the given method.
+func compress(compression Compression, val []byte) ([]byte, error) {
+	switch compression {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(val); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionSnappy:
+		return snappy.Encode(nil, val), nil
+	default:
+		return nil, fmt.Errorf("cannot handle compression method: %d", compression)
+	}
+}
+
+// readRecordBatch decodes a v2 record batch. The batch is the whole content
+// following the batch length field, starting with the partition leader epoch.
+// Batch crc must be validated by the caller.
+func readRecordBatch(baseOffset int64, batch []byte) (*messageBatch, error) {
+	if len(batch) < recordBatchHeaderSize {
+		return nil, ErrInvalidRecordBatch
+	}
+
+	dec := NewDecoder(bytes.NewReader(batch[9:]))
+	attributes := dec.DecodeInt16()
+	_ = dec.DecodeInt32() // last offset delta
+	firstTimestamp := dec.DecodeInt64()
+	maxTimestamp := dec.DecodeInt64()
+	producerID := dec.DecodeInt64()
+	_ = dec.DecodeInt16() // producer epoch
+	_ = dec.DecodeInt32() // base sequence
+	count := dec.DecodeInt32()
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	if count < 0 {
+		return nil, ErrInvalidRecordBatch
+	}
+
+	records := batch[recordBatchHeaderSize:]
+	if compression := Compression(attributes & batchCompressionMask); compression != CompressionNone {
+		var err error
+		if records, err = decompress(compression, records); err != nil {
+			return nil, err
+		}
+		// records are copied when decoded, so the buffer can be reused
+		defer putBuffer(records)
+	}
+	// every record takes at least one byte, so a bigger count cannot be
+	// right and must not be used to size the result
+	if int64(count) > int64(len(records)) {
+		return nil, ErrInvalidRecordBatch
+	}
+
+	result := &messageBatch{
+		producerID:    producerID,
+		transactional: attributes&batchTransactional != 0,
+		control:       attributes&batchControl != 0,
+		messages:      make([]*Message, 0, count),
+	}
+
+	rd := bytes.NewReader(records)
+	for i := int32(0); i < count; i++ {
+		msg, err := readRecord(rd, baseOffset, firstTimestamp)
+		if err != nil {
+			return nil, err
+		}
+		if attributes&batchLogAppendTime != 0 {
+			// broker assigned timestamp applies to all records
+			msg.Timestamp = timestampFromMillis(maxTimestamp)
+		}
+		result.messages = append(result.messages, msg)
+	}
+
+	if result.control && len(result.messages) > 0 {
+		// Control record key is a version followed by the control type.
+		key := result.messages[0].Key
+		if len(key) >= 4 && binary.BigEndian.Uint16(key[2:4]) == controlTypeAbort {
+			result.abort = true
+		}
+	}
+	return result, nil
+}
+
+// readRecord decodes a single record from a record batch.
+func readRecord(rd *bytes.Reader, baseOffset, firstTimestamp int64) (*Message, error) {
+	length, err := binary.ReadVarint(rd)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 || length > int64(rd.Len()) {
+		return nil, ErrInvalidRecordBatch
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(rd, body); err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(body)
+	if _, err := r.ReadByte(); err != nil { // attributes, unused
+		return nil, err
+	}
+	timestampDelta, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	offsetDelta, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &Message{Offset: baseOffset + offsetDelta}
+	if firstTimestamp >= 0 {
+		msg.Timestamp = timestampFromMillis(firstTimestamp + timestampDelta)
+	}
+	if msg.Key, err = readVarintBytes(r); err != nil {
+		return nil, err
+	}
+	if msg.Value, err = readVarintBytes(r); err != nil {
+		return nil, err
+	}
+	count, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if count < 0 || count > int64(r.Len()) {
+		return nil, ErrInvalidRecordBatch
+	}
+	if count > 0 {
+		msg.Headers = make([]Header, count)
+		for i := range msg.Headers {
+			key, err := readVarintBytes(r)
+			if err != nil {
+				return nil, err
+			}
+			msg.Headers[i].Key = string(key)
+			if msg.Headers[i].Value, err = readVarintBytes(r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return msg, nil
+}
+
+// readVarintBytes reads a byte slice prefixed with its varint encoded length.
+// Negative length means null.
+func readVarintBytes(r *bytes.Reader) ([]byte, error) {
+	length, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		return nil, nil
+	}
+	if length > int64(r.Len()) {
+		return nil, ErrInvalidRecordBatch
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeRecordBatch writes messages as a single v2 record batch. The offset of
+// the first message is used as the base offset, unless the batch is relative.
+//
+// The smallest timestamp of the messages is used as the base timestamp, so
+// that the timestamps of all messages can be stored as deltas from it.
+// Messages without a timestamp are read back without one as well.
+func writeRecordBatch(w io.Writer, b *messageBatch, compression Compression) (int, error) {
+	if len(b.messages) == 0 {
+		return 0, nil
+	}
+	baseOffset := b.messages[0].Offset
+	lastOffsetDelta := b.messages[len(b.messages)-1].Offset - baseOffset
+	if b.relative {
+		baseOffset = 0
+		lastOffsetDelta = int64(len(b.messages) - 1)
+	}
+	firstTimestamp, maxTimestamp := int64(-1), int64(-1)
+	for _, msg := range b.messages {
+		ts := timestampToMillis(msg.Timestamp)
+		if ts < 0 {
+			continue
+		}
+		if firstTimestamp < 0 || ts < firstTimestamp {
+			firstTimestamp = ts
+		}
+		if ts > maxTimestamp {
+			maxTimestamp = ts
+		}
+	}
+
+	var records buffer
+	var varint [binary.MaxVarintLen64]byte
+	for i, msg := range b.messages {
+		var timestampDelta int64
+		if firstTimestamp >= 0 {
+			// messages without timestamp are written as -1, which is read
+			// back as no timestamp
+			timestampDelta = timestampToMillis(msg.Timestamp) - firstTimestamp
+		}
+		offsetDelta := msg.Offset - baseOffset
+		if b.relative {
+			offsetDelta = int64(i)
+		}
+
+		var rec buffer
+		rec = append(rec, 0) // attributes
+		rec = append(rec, varint[:binary.PutVarint(varint[:], timestampDelta)]...)
+		rec = append(rec, varint[:binary.PutVarint(varint[:], offsetDelta)]...)
+		rec = appendVarintBytes(rec, msg.Key)
+		rec = appendVarintBytes(rec, msg.Value)
+		rec = append(rec, varint[:binary.PutVarint(varint[:], int64(len(msg.Headers)))]...)
+		for _, h := range msg.Headers {
+			rec = appendVarintBytes(rec, []byte(h.Key))
+			rec = appendVarintBytes(rec, h.Value)
+		}
+
+		records = append(records, varint[:binary.PutVarint(varint[:], int64(len(rec)))]...)
+		records = append(records, rec...)
+	}
+
+	var attributes int16
+	if compression != CompressionNone {
+		compressed, err := compress(compression, records)
+		if err != nil {
+			return 0, err
+		}
+		records = compressed
+		attributes |= int16(compression) & batchCompressionMask
+	}
+	if b.transactional {
+		attributes |= batchTransactional
+	}
+	if b.control {
+		attributes |= batchControl
+	}
+
+	var buf buffer
+	enc := NewEncoder(&buf)
+	enc.EncodeInt64(baseOffset)
+	enc.EncodeInt32(int32(recordBatchHeaderSize + len(records)))
+	enc.EncodeInt32(-1) // partition leader epoch
+	enc.EncodeInt8(messageMagicV2)
+	enc.EncodeUint32(0) // crc placeholder
+	enc.EncodeInt16(attributes)
+	enc.EncodeInt32(int32(lastOffsetDelta))
+	enc.EncodeInt64(firstTimestamp)
+	enc.EncodeInt64(maxTimestamp)
+	enc.EncodeInt64(b.producerID)
+	enc.EncodeInt16(-1) // producer epoch
+	enc.EncodeInt32(-1) // base sequence
+	enc.EncodeInt32(int32(len(b.messages)))
+	if err := enc.Err(); err != nil {
+		return 0, err
+	}
+	buf = append(buf, records...)
+
+	// crc covers everything from the attributes to the end of the batch
+	const crcoff = 8 + 4 + 4 + 1
+	binary.BigEndian.PutUint32(buf[crcoff:crcoff+4], crc32.Checksum(buf[crcoff+4:], castagnoliTable))
+	return w.Write(buf)
+}
+
+// timestampFromMillis converts a message timestamp in milliseconds since the
+// epoch to time. Negative timestamps mean no timestamp and are returned as
+// zero time.
+func timestampFromMillis(ms int64) time.Time {
+	if ms < 0 {
+		return time.Time{}
+	}
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
+// timestampToMillis is the reverse of timestampFromMillis, returning -1 for
+// zero time.
+func timestampToMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return -1
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func appendVarintBytes(b buffer, val []byte) buffer {
+	var varint [binary.MaxVarintLen64]byte
+	if val == nil {
+		return append(b, varint[:binary.PutVarint(varint[:], -1)]...)
+	}
+	b = append(b, varint[:binary.PutVarint(varint[:], int64(len(val)))]...)
+	return append(b, val...)
+}
+
+// filterAborted drops the messages of aborted transactions and all control
+// batches, returning the remaining messages in order. This follows the
+// algorithm used by the Java client: a producer's transaction is considered
+// aborted starting at the first offset reported by the broker until the abort
+// marker for that producer is seen.
+func filterAborted(batches []*messageBatch, aborted []FetchRespAbortedTransaction) []*Message {
+	aborted = append([]FetchRespAbortedTransaction(nil), aborted...)
+	sort.Slice(aborted, func(i, j int) bool {
+		return aborted[i].FirstOffset < aborted[j].FirstOffset
+	})
+
+	abortedProducers := make(map[int64]struct{})
+	messages := make([]*Message, 0)
+	for _, batch := range batches {
+		if len(batch.messages) == 0 {
+			continue
+		}
+		baseOffset := batch.messages[0].Offset
+		for len(aborted) > 0 && aborted[0].FirstOffset <= baseOffset {
+			abortedProducers[aborted[0].ProducerID] = struct{}{}
+			aborted = aborted[1:]
+		}
+
+		if batch.control {
+			if batch.abort {
+				delete(abortedProducers, batch.producerID)
+			}
+			continue
+		}
+		if _, ok := abortedProducers[batch.producerID]; ok && batch.transactional {
+			continue
+		}
+		messages = append(messages, batch.messages...)
+	}
+	return messages
+}
@@ -22,7 +22,17 @@ var snappyJavaMagic = []byte("\x82SNAPPY\x00")
 
 func snappyDecode(b []byte) ([]byte, error) {
 	if !bytes.HasPrefix(b, snappyJavaMagic) {
-		return snappy.Decode(nil, b)
+		n, err := snappy.DecodedLen(b)
+		if err != nil {
+			return nil, err
+		}
+		buf := getBuffer(n)
+		decoded, err := snappy.Decode(buf[:cap(buf)], b)
+		if err != nil {
+			putBuffer(buf)
+			return nil, err
+		}
+		return decoded, nil
 	}
 
 	// See https://github.com/xerial/snappy-java/blob/develop/src/main/java/org/xerial/snappy/SnappyInputStream.java
@@ -32,7 +42,7 @@ func snappyDecode(b []byte) ([]byte, error) {
 	}
 	// b[12:16] is the "compatible version"; ignore for now
 	var (
-		decoded = make([]byte, 0, len(b))
+		decoded = getBuffer(len(b) * 2)
 		chunk   []byte
 		err     error
 	)
@@ -41,6 +51,7 @@ func snappyDecode(b []byte) ([]byte, error) {
 		i += 4
 		chunk, err = snappy.Decode(chunk, b[i:i+n])
 		if err != nil {
+			putBuffer(decoded)
 			return nil, err
 		}
 		i += n
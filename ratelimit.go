@@ -0,0 +1,44 @@
+package kafka
+
+import (
+	"context"
+	"time"
+)
+
+// rateLimiter is a token bucket holding at most a single token, which paces
+// calls to wait to the configured rate without allowing bursts.
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time // time at which the next token becomes available
+	clock    clock
+}
+
+// newRateLimiter returns a rate limiter allowing perSecond calls to wait per
+// second, measured using given clock. Zero or negative rate means unlimited,
+// in which case nil is returned; wait is a no-op on a nil limiter.
+func newRateLimiter(perSecond int, clk clock) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		interval: time.Second / time.Duration(perSecond),
+		clock:    clk,
+	}
+}
+
+// wait blocks until a token is available and takes it, or returns the error
+// of ctx, leaving the token in place, if ctx is done first.
+func (rl *rateLimiter) wait(ctx context.Context) error {
+	if rl == nil {
+		return nil
+	}
+	now := rl.clock.Now()
+	if rl.next.After(now) {
+		if err := rl.clock.SleepCtx(ctx, rl.next.Sub(now)); err != nil {
+			return err
+		}
+		now = rl.next
+	}
+	rl.next = now.Add(rl.interval)
+	return nil
+}
@@ -20,6 +20,8 @@ const (
 	OffsetCommitRequest     = 8
 	OffsetFetchRequest      = 9
 	GroupCoordinatorRequest = 10
+	DescribeConfigsRequest  = 32
+	AlterConfigsRequest     = 33
 )
 
 type Serializable interface {
@@ -109,6 +111,17 @@ func (srv *Server) Close() {
 	srv.clients = make(map[int64]net.Conn)
 }
 
+// CloseClients closes the connections of all clients, while still accepting
+// new ones.
+func (srv *Server) CloseClients() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for _, cli := range srv.clients {
+		_ = cli.Close()
+	}
+}
+
 func (srv *Server) handleClient(c net.Conn) {
 	clientID := time.Now().UnixNano()
 	srv.mu.Lock()
@@ -157,6 +170,10 @@ func (srv *Server) handleClient(c net.Conn) {
 			request, err = proto.ReadOffsetCommitReq(bytes.NewBuffer(b))
 		case OffsetFetchRequest:
 			request, err = proto.ReadOffsetFetchReq(bytes.NewBuffer(b))
+		case DescribeConfigsRequest:
+			request, err = proto.ReadDescribeConfigsReq(bytes.NewBuffer(b))
+		case AlterConfigsRequest:
+			request, err = proto.ReadAlterConfigsReq(bytes.NewBuffer(b))
 		}
 
 		if err != nil {
@@ -204,6 +221,7 @@ func (srv *Server) defaultRequestHandler(request Serializable) Serializable {
 	case *proto.ProduceReq:
 		resp := &proto.ProduceResp{
 			CorrelationID: req.CorrelationID,
+			Version:       req.Version,
 		}
 		resp.Topics = make([]proto.ProduceRespTopic, len(req.Topics))
 		for ti, topic := range req.Topics {
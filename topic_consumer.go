@@ -0,0 +1,121 @@
+package kafka
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+// TopicConsumer reads messages from all partitions of a topic and keeps
+// track of the position of each partition, so that consumption of the whole
+// topic can be checkpointed and resumed.
+//
+// Partitions are read in turn: messages fetched from one partition are all
+// returned before moving to the next partition with data.
+type TopicConsumer struct {
+	conf      ConsumerConf
+	clock     clock
+	consumers []*consumer // indexed by partition ID
+
+	// mu protects next and serializes Consume calls.
+	mu   sync.Mutex
+	next int
+}
+
+// TopicConsumer creates a consumer reading all partitions of the topic set in
+// conf. conf.Partition is ignored, every partition starts at conf.StartOffset.
+//
+// conf.RetryLimit and conf.RetryWait apply to the whole topic: Consume
+// returns ErrNoData once no partition returned messages after RetryLimit
+// rounds of fetching all of them.
+func (b *Broker) TopicConsumer(conf ConsumerConf) (*TopicConsumer, error) {
+	count, err := b.refreshedPartitionCount(conf.Topic)
+	if err != nil {
+		return nil, err
+	}
+	if count <= 0 {
+		return nil, ErrNoPartitions
+	}
+
+	tc := &TopicConsumer{
+		conf:      conf,
+		clock:     b.clock,
+		consumers: make([]*consumer, count),
+	}
+	for partition := range tc.consumers {
+		pconf := conf
+		pconf.Partition = int32(partition)
+		// a single fetch per partition, so that an empty partition does not
+		// hold back the others
+		pconf.RetryLimit = 0
+		pconf.ConsumeDeadline = 0
+		if tc.consumers[partition], err = b.consumer(pconf); err != nil {
+			return nil, fmt.Errorf("cannot consume partition %d: %s", partition, err)
+		}
+	}
+	return tc, nil
+}
+
+// Consume returns the next message of any partition of the topic. The
+// Partition field of the message tells which partition it was read from.
+func (tc *TopicConsumer) Consume() (*proto.Message, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	for retry := 0; ; retry++ {
+		for i := 0; i < len(tc.consumers); i++ {
+			partition := tc.next
+			c := tc.consumers[partition]
+			msg, err := c.Consume()
+			if err == ErrNoData {
+				tc.next = (partition + 1) % len(tc.consumers)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if c.buffered() == 0 {
+				tc.next = (partition + 1) % len(tc.consumers)
+			}
+			return msg, nil
+		}
+
+		if tc.conf.RetryLimit != -1 && retry >= tc.conf.RetryLimit {
+			return nil, ErrNoData
+		}
+		if tc.conf.RetryWait > 0 {
+			tc.clock.Sleep(tc.conf.RetryWait)
+		}
+	}
+}
+
+// Checkpoint returns the offset of the next message to consume from every
+// partition of the topic, which SeekAll accepts to resume from.
+func (tc *TopicConsumer) Checkpoint() map[int32]int64 {
+	offsets := make(map[int32]int64, len(tc.consumers))
+	for partition, c := range tc.consumers {
+		offsets[int32(partition)] = c.Offset()
+	}
+	return offsets
+}
+
+// SeekAll moves the partitions present in offsets to the given offsets,
+// usually taken from Checkpoint. Other partitions keep their position.
+// Nothing is moved if offsets holds a partition the topic does not have.
+// Partitions that cannot be moved are reported in a *MultiError, the others
+// are moved regardless.
+func (tc *TopicConsumer) SeekAll(offsets map[int32]int64) error {
+	for partition := range offsets {
+		if partition < 0 || int(partition) >= len(tc.consumers) {
+			return fmt.Errorf("topic %s has no partition %d", tc.conf.Topic, partition)
+		}
+	}
+	var errs MultiError
+	for partition, offset := range offsets {
+		if err := tc.consumers[partition].SeekToOffset(offset); err != nil {
+			errs.Add(tc.conf.Topic, partition, err)
+		}
+	}
+	return errs.ErrorOrNil()
+}
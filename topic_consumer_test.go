@@ -0,0 +1,101 @@
+package kafka
+
+import (
+	"fmt"
+	"sort"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+var _ = Suite(&TopicConsumerSuite{})
+
+type TopicConsumerSuite struct{}
+
+func (s *TopicConsumerSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+func (s *TopicConsumerSuite) TestCheckpointAndSeekAll(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	// both partitions hold offsets 0 to 4, fetched two at a time
+	const size = 5
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		part := req.Topics[0].Partitions[0]
+		var messages []*proto.Message
+		for offset := part.FetchOffset; offset < size && len(messages) < 2; offset++ {
+			messages = append(messages, &proto.Message{
+				Offset: offset,
+				Value:  []byte(fmt.Sprintf("%d-%d", part.ID, offset)),
+			})
+		}
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Version:       req.Version,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: part.ID, TipOffset: size, Messages: messages},
+					},
+				},
+			},
+		}
+	})
+
+	broker, err := NewBroker("test-cluster-topic-consumer", []string{srv.Address()}, NewBrokerConf("tester"))
+	c.Assert(err, IsNil)
+
+	conf := NewConsumerConf("test", 0)
+	conf.StartOffset = 0
+	conf.RetryLimit = 0
+	tc, err := broker.TopicConsumer(conf)
+	c.Assert(err, IsNil)
+
+	consume := func(n int) []string {
+		var values []string
+		for i := 0; i < n; i++ {
+			msg, err := tc.Consume()
+			c.Assert(err, IsNil)
+			values = append(values, string(msg.Value))
+		}
+		return values
+	}
+
+	// fetched messages of a partition are returned before moving on
+	c.Assert(consume(3), DeepEquals, []string{"0-0", "0-1", "1-0"})
+	checkpoint := tc.Checkpoint()
+	c.Assert(checkpoint, DeepEquals, map[int32]int64{0: 2, 1: 1})
+
+	rest := consume(2*size - 3)
+	_, err = tc.Consume()
+	c.Assert(err, Equals, ErrNoData)
+	c.Assert(tc.Checkpoint(), DeepEquals, map[int32]int64{0: size, 1: size})
+
+	// restoring the checkpoint reads the same messages again, though
+	// partitions may be visited in a different order
+	c.Assert(tc.SeekAll(checkpoint), IsNil)
+	again := consume(2*size - 3)
+	sort.Strings(rest)
+	sort.Strings(again)
+	c.Assert(again, DeepEquals, rest)
+
+	// unknown partitions are rejected without moving the others
+	c.Assert(tc.SeekAll(map[int32]int64{0: 0, 2: 0}), NotNil)
+	c.Assert(tc.Checkpoint(), DeepEquals, map[int32]int64{0: size, 1: size})
+
+	// failures of single partitions are all reported
+	err = tc.SeekAll(map[int32]int64{0: -10, 1: -20})
+	merr, ok := err.(*MultiError)
+	c.Assert(ok, Equals, true)
+	c.Assert(merr.Len(), Equals, 2)
+	c.Assert(merr.Errors["test"][0], ErrorMatches, "invalid start offset: -10")
+	c.Assert(merr.Errors["test"][1], ErrorMatches, "invalid start offset: -20")
+	c.Assert(tc.Checkpoint(), DeepEquals, map[int32]int64{0: size, 1: size})
+}
@@ -0,0 +1,140 @@
+package kafka
+
+import (
+	"fmt"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+// EncoderFunc converts a Go value to the bytes of a message key or value.
+// json.Marshal is an EncoderFunc.
+type EncoderFunc func(v interface{}) ([]byte, error)
+
+// DecoderFunc parses the bytes of a message key or value and stores the
+// result in the value pointed to by v. json.Unmarshal is a DecoderFunc.
+type DecoderFunc func(data []byte, v interface{}) error
+
+// TypedProducer wraps a Producer, encoding message keys and values from Go
+// values before writing them.
+type TypedProducer struct {
+	producer     Producer
+	keyEncoder   EncoderFunc
+	valueEncoder EncoderFunc
+}
+
+// NewTypedProducer returns a TypedProducer writing through the given
+// producer. Nil encoder accepts only []byte and string values, passing them
+// as they are.
+func NewTypedProducer(p Producer, keyEncoder, valueEncoder EncoderFunc) *TypedProducer {
+	if keyEncoder == nil {
+		keyEncoder = encodeRaw
+	}
+	if valueEncoder == nil {
+		valueEncoder = encodeRaw
+	}
+	return &TypedProducer{
+		producer:     p,
+		keyEncoder:   keyEncoder,
+		valueEncoder: valueEncoder,
+	}
+}
+
+// Produce encodes the key and value and writes them as a single message to
+// the given topic and partition, returning the offset of the message. Nil key
+// or value is not encoded and written as null.
+func (p *TypedProducer) Produce(topic string, partition int32, key, value interface{}) (int64, error) {
+	msg, err := p.Message(key, value)
+	if err != nil {
+		return 0, err
+	}
+	return p.producer.Produce(topic, partition, msg)
+}
+
+// Message returns a message built of the encoded key and value, which can be
+// passed to the wrapped producer together with other messages.
+func (p *TypedProducer) Message(key, value interface{}) (*proto.Message, error) {
+	var msg proto.Message
+	var err error
+	if key != nil {
+		if msg.Key, err = p.keyEncoder(key); err != nil {
+			return nil, fmt.Errorf("cannot encode key: %s", err)
+		}
+	}
+	if value != nil {
+		if msg.Value, err = p.valueEncoder(value); err != nil {
+			return nil, fmt.Errorf("cannot encode value: %s", err)
+		}
+	}
+	return &msg, nil
+}
+
+// TypedConsumer wraps a Consumer, decoding the keys and values of consumed
+// messages to Go values.
+type TypedConsumer struct {
+	consumer     Consumer
+	keyDecoder   DecoderFunc
+	valueDecoder DecoderFunc
+}
+
+// NewTypedConsumer returns a TypedConsumer reading through the given
+// consumer. Nil decoder accepts only *[]byte and *string destinations.
+func NewTypedConsumer(c Consumer, keyDecoder, valueDecoder DecoderFunc) *TypedConsumer {
+	if keyDecoder == nil {
+		keyDecoder = decodeRaw
+	}
+	if valueDecoder == nil {
+		valueDecoder = decodeRaw
+	}
+	return &TypedConsumer{
+		consumer:     c,
+		keyDecoder:   keyDecoder,
+		valueDecoder: valueDecoder,
+	}
+}
+
+// Consume reads the next message and decodes its key and value into the
+// values pointed to by key and value. Nil destination, as well as null key or
+// value of the message, is not decoded.
+//
+// The message is returned even if decoding fails, it is consumed either way,
+// so that the caller can decide whether to skip it.
+func (c *TypedConsumer) Consume(key, value interface{}) (*proto.Message, error) {
+	msg, err := c.consumer.Consume()
+	if err != nil {
+		return nil, err
+	}
+	if key != nil && msg.Key != nil {
+		if err := c.keyDecoder(msg.Key, key); err != nil {
+			return msg, fmt.Errorf("cannot decode key at offset %d: %s", msg.Offset, err)
+		}
+	}
+	if value != nil && msg.Value != nil {
+		if err := c.valueDecoder(msg.Value, value); err != nil {
+			return msg, fmt.Errorf("cannot decode value at offset %d: %s", msg.Offset, err)
+		}
+	}
+	return msg, nil
+}
+
+func encodeRaw(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	default:
+		return nil, fmt.Errorf("cannot encode %T without an encoder", v)
+	}
+}
+
+func decodeRaw(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case *[]byte:
+		*v = data
+	case *string:
+		*v = string(data)
+	default:
+		return fmt.Errorf("cannot decode into %T without a decoder", v)
+	}
+	return nil
+}
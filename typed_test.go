@@ -0,0 +1,145 @@
+package kafka
+
+import (
+	"encoding/json"
+	"sync"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/discord/zorkian-kafka/proto"
+)
+
+var _ = Suite(&TypedSuite{})
+
+type TypedSuite struct{}
+
+func (s *TypedSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+type typedTestKey struct {
+	ID int
+}
+
+type typedTestValue struct {
+	Name string
+	Tags []string
+}
+
+func (s *TypedSuite) TestJSONRoundTrip(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var stored []*proto.Message
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		mu.Lock()
+		defer mu.Unlock()
+
+		req := request.(*proto.ProduceReq)
+		offset := int64(len(stored))
+		for _, msg := range req.Topics[0].Partitions[0].Messages {
+			stored = append(stored, &proto.Message{
+				Offset: int64(len(stored)),
+				Key:    msg.Key,
+				Value:  msg.Value,
+			})
+		}
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: 0, Offset: offset},
+					},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		mu.Lock()
+		defer mu.Unlock()
+
+		req := request.(*proto.FetchReq)
+		offset := req.Topics[0].Partitions[0].FetchOffset
+		var messages []*proto.Message
+		if offset < int64(len(stored)) {
+			messages = stored[offset:]
+		}
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{
+							ID:        0,
+							TipOffset: int64(len(stored)),
+							Messages:  messages,
+						},
+					},
+				},
+			},
+		}
+	})
+
+	broker, err := NewBroker("test-cluster-typed", []string{srv.Address()}, NewBrokerConf("tester"))
+	c.Assert(err, IsNil)
+
+	producer := NewTypedProducer(broker.Producer(NewProducerConf()), json.Marshal, json.Marshal)
+	want := typedTestValue{Name: "first", Tags: []string{"a", "b"}}
+	offset, err := producer.Produce("test", 0, typedTestKey{ID: 1}, want)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(0))
+	offset, err = producer.Produce("test", 0, typedTestKey{ID: 2}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(1))
+	_, err = producer.Produce("test", 0, typedTestKey{ID: 3}, make(chan int))
+	c.Assert(err, NotNil)
+
+	consConf := NewConsumerConf("test", 0)
+	consConf.StartOffset = 0
+	cons, err := broker.Consumer(consConf)
+	c.Assert(err, IsNil)
+	consumer := NewTypedConsumer(cons, json.Unmarshal, json.Unmarshal)
+
+	var key typedTestKey
+	var value typedTestValue
+	msg, err := consumer.Consume(&key, &value)
+	c.Assert(err, IsNil)
+	c.Assert(msg.Offset, Equals, int64(0))
+	c.Assert(key, DeepEquals, typedTestKey{ID: 1})
+	c.Assert(value, DeepEquals, want)
+
+	// null value is left untouched
+	value = typedTestValue{}
+	msg, err = consumer.Consume(&key, &value)
+	c.Assert(err, IsNil)
+	c.Assert(msg.Offset, Equals, int64(1))
+	c.Assert(msg.Value, IsNil)
+	c.Assert(key, DeepEquals, typedTestKey{ID: 2})
+	c.Assert(value, DeepEquals, typedTestValue{})
+}
+
+func (s *TypedSuite) TestRawEncoding(c *C) {
+	producer := NewTypedProducer(nil, nil, nil)
+	msg, err := producer.Message("key", []byte("value"))
+	c.Assert(err, IsNil)
+	c.Assert(msg.Key, DeepEquals, []byte("key"))
+	c.Assert(msg.Value, DeepEquals, []byte("value"))
+
+	_, err = producer.Message(42, nil)
+	c.Assert(err, NotNil)
+
+	var key string
+	var value []byte
+	c.Assert(decodeRaw([]byte("key"), &key), IsNil)
+	c.Assert(decodeRaw([]byte("value"), &value), IsNil)
+	c.Assert(key, Equals, "key")
+	c.Assert(value, DeepEquals, []byte("value"))
+	c.Assert(decodeRaw([]byte("1"), new(int)), NotNil)
+}